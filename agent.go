@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/keyer"
+	"fiatjaf.com/nostr/nip04"
+	"fiatjaf.com/nostr/nip19"
+	"fiatjaf.com/nostr/nip44"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+)
+
+var agentSocketFlag = &cli.StringFlag{
+	Name:    "socket",
+	Usage:   "path of the unix socket the agent listens on",
+	Sources: cli.EnvVars("NAK_AGENT_SOCK"),
+}
+
+var agent = &cli.Command{
+	Name:  "agent",
+	Usage: "keeps decrypted keys in memory and signs with them for other nak commands, like ssh-agent",
+	Description: `starts an agent listening on a unix socket, then keys can be added to it with 'nak agent add'.
+
+when NAK_AGENT_SOCK is set all other nak commands will sign (and encrypt/decrypt) through the agent instead of asking for passwords, as long as the key selected with --as (or the default identity, see 'nak identity use') is in the agent and no --sec is given.
+a --sec (or NOSTR_SECRET_KEY) with an ncryptsec also goes through the agent if that same ncryptsec was added to it, otherwise its password is asked as usual.
+
+example:
+		nak agent &
+		export NAK_AGENT_SOCK=~/.config/nak/agent/default
+		nak agent add --as personal --timeout 2h
+		nak event --as personal -c 'hello' relay.example.com
+		nak agent add --sec ncryptsec1...
+		nak event --sec ncryptsec1... -c 'no password asked' relay.example.com
+		nak agent lock`,
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		agentSocketFlag,
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "default time after which keys are forgotten (0 means never)",
+		},
+		&cli.BoolFlag{
+			Name:  "confirm",
+			Usage: "ask for confirmation on the agent terminal before every signature",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		socketPath := getAgentSocketPath(c)
+		listener, err := listenOnSocket(c, socketPath)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(socketPath)
+
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+		}()
+
+		state := &agentState{
+			keys:           make(map[nostr.PubKey]*agentKey),
+			defaultTimeout: c.Duration("timeout"),
+			defaultConfirm: c.Bool("confirm"),
+		}
+		go state.expireKeys(ctx)
+
+		log("agent listening on %s\n", color.CyanString(socketPath))
+		stdout("NAK_AGENT_SOCK=" + socketPath + "; export NAK_AGENT_SOCK;")
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				continue
+			}
+			go state.serve(ctx, conn)
+		}
+	},
+	Commands: []*cli.Command{
+		{
+			Name:  "add",
+			Usage: "decrypts a key and hands it to the running agent",
+			Description: `the key is taken from the argument or from the usual --sec, --as or default identity.
+ncryptsec keys are decrypted here, so the password never reaches the agent.`,
+			ArgsUsage:                 "[key]",
+			DisableSliceFlagSeparator: true,
+			Flags: []cli.Flag{
+				agentSocketFlag,
+				&cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "forget the key after this long (defaults to the agent's --timeout)",
+				},
+				&cli.BoolFlag{
+					Name:  "confirm",
+					Usage: "ask for confirmation on the agent terminal before each signature with this key",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				var sk nostr.SecretKey
+
+				// remember the ncryptsec the key came from so commands given that same --sec can find it later
+				var ncryptsec string
+				if input := c.Args().First(); input != "" {
+					var err error
+					if sk, err = parseSecretKeyOrPromptDecrypt(input); err != nil {
+						return err
+					}
+					if strings.HasPrefix(input, "ncryptsec1") {
+						ncryptsec = input
+					}
+				} else {
+					key, bunker, err := gatherSecretKeyOrBunkerFromArguments(ctx, c)
+					if err != nil {
+						return err
+					}
+					sk = key
+					if bunker != nil {
+						return fmt.Errorf("can't add a bunker to the agent")
+					}
+					if sec := c.String("sec"); c.String("as") == "" && strings.HasPrefix(sec, "ncryptsec1") {
+						ncryptsec = sec
+					}
+				}
+
+				req := agentRequest{Method: "add", SecretKey: sk.Hex(), NCryptSec: ncryptsec}
+				if c.IsSet("timeout") {
+					req.Timeout = c.Duration("timeout").String()
+				}
+				if c.IsSet("confirm") {
+					confirm := c.Bool("confirm")
+					req.Confirm = &confirm
+				}
+				if _, err := callAgent(getAgentSocketPath(c), req); err != nil {
+					return err
+				}
+
+				log("added %s\n", color.CyanString(nip19.EncodeNpub(sk.Public())))
+				return nil
+			},
+		},
+		{
+			Name:                      "list",
+			Usage:                     "lists the keys held by the agent",
+			DisableSliceFlagSeparator: true,
+			Flags:                     []cli.Flag{agentSocketFlag},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				resp, err := callAgent(getAgentSocketPath(c), agentRequest{Method: "list"})
+				if err != nil {
+					return err
+				}
+				for _, k := range resp.Keys {
+					info := ""
+					if k.Expires != 0 {
+						info += " expires " + time.Unix(int64(k.Expires), 0).Format(time.DateTime)
+					}
+					if k.Confirm {
+						info += " (confirm)"
+					}
+					stdout(nip19.EncodeNpub(k.PubKey) + info)
+				}
+				return nil
+			},
+		},
+		{
+			Name:                      "remove",
+			Usage:                     "makes the agent forget a key, or all of them if none is given",
+			ArgsUsage:                 "[pubkey]",
+			DisableSliceFlagSeparator: true,
+			Flags:                     []cli.Flag{agentSocketFlag},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				req := agentRequest{Method: "remove"}
+				if c.Args().Len() > 0 {
+					pk, err := parsePubKey(c.Args().First())
+					if err != nil {
+						return err
+					}
+					req.PubKey = &pk
+				}
+				_, err := callAgent(getAgentSocketPath(c), req)
+				return err
+			},
+		},
+		{
+			Name:                      "lock",
+			Usage:                     "locks the agent with a password, it refuses to do anything until unlocked",
+			DisableSliceFlagSeparator: true,
+			Flags:                     []cli.Flag{agentSocketFlag},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				password, err := askPassword("type a password to lock the agent: ", nil)
+				if err != nil {
+					return err
+				}
+				_, err = callAgent(getAgentSocketPath(c), agentRequest{Method: "lock", Password: password})
+				return err
+			},
+		},
+		{
+			Name:                      "unlock",
+			Usage:                     "unlocks an agent locked with 'nak agent lock'",
+			DisableSliceFlagSeparator: true,
+			Flags:                     []cli.Flag{agentSocketFlag},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				password, err := askPassword("type the password to unlock the agent: ", nil)
+				if err != nil {
+					return err
+				}
+				_, err = callAgent(getAgentSocketPath(c), agentRequest{Method: "unlock", Password: password})
+				return err
+			},
+		},
+	},
+}
+
+type agentRequest struct {
+	Method     string        `json:"method"`
+	PubKey     *nostr.PubKey `json:"pubkey,omitempty"`
+	SecretKey  string        `json:"secret_key,omitempty"`
+	NCryptSec  string        `json:"ncryptsec,omitempty"`
+	Timeout    string        `json:"timeout,omitempty"`
+	Confirm    *bool         `json:"confirm,omitempty"`
+	Password   string        `json:"password,omitempty"`
+	Event      *nostr.Event  `json:"event,omitempty"`
+	Peer       *nostr.PubKey `json:"peer,omitempty"`
+	Plaintext  string        `json:"plaintext,omitempty"`
+	Ciphertext string        `json:"ciphertext,omitempty"`
+}
+
+type agentResponse struct {
+	Error           string         `json:"error,omitempty"`
+	Keys            []agentKeyInfo `json:"keys,omitempty"`
+	Event           *nostr.Event   `json:"event,omitempty"`
+	Plaintext       string         `json:"plaintext,omitempty"`
+	Ciphertext      string         `json:"ciphertext,omitempty"`
+	ConversationKey string         `json:"conversation_key,omitempty"`
+}
+
+type agentKeyInfo struct {
+	PubKey  nostr.PubKey    `json:"pubkey"`
+	Expires nostr.Timestamp `json:"expires,omitempty"`
+	Confirm bool            `json:"confirm,omitempty"`
+}
+
+type agentKey struct {
+	sk        nostr.SecretKey
+	kr        nostr.Keyer
+	ncryptsec string // the one it was decrypted from, if any
+	added     time.Time
+	expires   time.Time
+	confirm   bool
+}
+
+type agentState struct {
+	mu             sync.Mutex
+	keys           map[nostr.PubKey]*agentKey
+	lockPassword   string
+	defaultTimeout time.Duration
+	defaultConfirm bool
+
+	// only one confirmation prompt can be on the terminal at a time
+	confirmMu sync.Mutex
+}
+
+func (state *agentState) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var req agentRequest
+		var resp agentResponse
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = "invalid request: " + err.Error()
+		} else if err := state.handle(ctx, req, &resp); err != nil {
+			resp.Error = err.Error()
+		}
+
+		data, _ := json.Marshal(resp)
+		if _, err := conn.Write(append(data, '\n')); err != nil {
+			return
+		}
+	}
+}
+
+func (state *agentState) handle(ctx context.Context, req agentRequest, resp *agentResponse) error {
+	state.mu.Lock()
+
+	if req.Method == "unlock" {
+		defer state.mu.Unlock()
+		if state.lockPassword == "" {
+			return fmt.Errorf("agent is not locked")
+		}
+		if req.Password != state.lockPassword {
+			return fmt.Errorf("wrong password")
+		}
+		state.lockPassword = ""
+		log("agent unlocked\n")
+		return nil
+	}
+	if state.lockPassword != "" {
+		state.mu.Unlock()
+		return fmt.Errorf("agent is locked")
+	}
+
+	switch req.Method {
+	case "lock":
+		defer state.mu.Unlock()
+		if req.Password == "" {
+			return fmt.Errorf("password can't be empty")
+		}
+		state.lockPassword = req.Password
+		log("agent locked\n")
+		return nil
+	case "add":
+		defer state.mu.Unlock()
+		sk, err := nostr.SecretKeyFromHex(req.SecretKey)
+		if err != nil {
+			return fmt.Errorf("invalid secret key: %w", err)
+		}
+		if req.NCryptSec != "" && !strings.HasPrefix(req.NCryptSec, "ncryptsec1") {
+			return fmt.Errorf("invalid ncryptsec")
+		}
+		key := &agentKey{
+			sk:        sk,
+			kr:        keyer.NewPlainKeySigner(sk),
+			ncryptsec: req.NCryptSec,
+			added:     time.Now(),
+			confirm:   state.defaultConfirm,
+		}
+		timeout := state.defaultTimeout
+		if req.Timeout != "" {
+			if timeout, err = time.ParseDuration(req.Timeout); err != nil {
+				return fmt.Errorf("invalid timeout: %w", err)
+			}
+		}
+		if timeout > 0 {
+			key.expires = time.Now().Add(timeout)
+		}
+		if req.Confirm != nil {
+			key.confirm = *req.Confirm
+		}
+		state.keys[sk.Public()] = key
+		log("added %s\n", color.CyanString(nip19.EncodeNpub(sk.Public())))
+		return nil
+	case "remove":
+		defer state.mu.Unlock()
+		if req.PubKey == nil {
+			clear(state.keys)
+			log("removed all keys\n")
+			return nil
+		}
+		if _, ok := state.keys[*req.PubKey]; !ok {
+			return fmt.Errorf("key not found")
+		}
+		delete(state.keys, *req.PubKey)
+		log("removed %s\n", color.CyanString(nip19.EncodeNpub(*req.PubKey)))
+		return nil
+	case "list":
+		defer state.mu.Unlock()
+		for pk, key := range state.keys {
+			info := agentKeyInfo{PubKey: pk, Confirm: key.confirm}
+			if !key.expires.IsZero() {
+				info.Expires = nostr.Timestamp(key.expires.Unix())
+			}
+			resp.Keys = append(resp.Keys, info)
+		}
+		// oldest first
+		slices.SortFunc(resp.Keys, func(a, b agentKeyInfo) int {
+			return state.keys[a.PubKey].added.Compare(state.keys[b.PubKey].added)
+		})
+		return nil
+	case "find":
+		defer state.mu.Unlock()
+		if req.NCryptSec == "" {
+			return fmt.Errorf("missing ncryptsec")
+		}
+		for pk, key := range state.keys {
+			if key.ncryptsec == req.NCryptSec {
+				resp.Keys = []agentKeyInfo{{PubKey: pk, Confirm: key.confirm}}
+				return nil
+			}
+		}
+		return fmt.Errorf("key not found")
+	}
+
+	// everything else requires a key
+	if req.PubKey == nil {
+		state.mu.Unlock()
+		return fmt.Errorf("missing pubkey")
+	}
+	key, ok := state.keys[*req.PubKey]
+	state.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("key not found")
+	}
+
+	switch req.Method {
+	case "sign_event":
+		if req.Event == nil {
+			return fmt.Errorf("missing event")
+		}
+		if key.confirm && !state.confirm(*req.PubKey, fmt.Sprintf("sign event of kind %d: %s", req.Event.Kind, clampWithEllipsis(req.Event.Content, 80))) {
+			return fmt.Errorf("signature denied")
+		}
+		if err := key.kr.SignEvent(ctx, req.Event); err != nil {
+			return err
+		}
+		resp.Event = req.Event
+		logverbose("signed event %s with %s\n", req.Event.ID, req.PubKey.Hex())
+		return nil
+	case "encrypt":
+		if req.Peer == nil {
+			return fmt.Errorf("missing peer")
+		}
+		if key.confirm && !state.confirm(*req.PubKey, "encrypt to "+nip19.EncodeNpub(*req.Peer)) {
+			return fmt.Errorf("encryption denied")
+		}
+		ciphertext, err := key.kr.Encrypt(ctx, req.Plaintext, *req.Peer)
+		resp.Ciphertext = ciphertext
+		return err
+	case "decrypt":
+		if req.Peer == nil {
+			return fmt.Errorf("missing peer")
+		}
+		if key.confirm && !state.confirm(*req.PubKey, "decrypt from "+nip19.EncodeNpub(*req.Peer)) {
+			return fmt.Errorf("decryption denied")
+		}
+		plaintext, err := key.kr.Decrypt(ctx, req.Ciphertext, *req.Peer)
+		resp.Plaintext = plaintext
+		return err
+	case "nip04_encrypt", "nip04_decrypt":
+		if req.Peer == nil {
+			return fmt.Errorf("missing peer")
+		}
+		what, _ := strings.CutPrefix(req.Method, "nip04_")
+		if key.confirm && !state.confirm(*req.PubKey, what+" with nip04 for "+nip19.EncodeNpub(*req.Peer)) {
+			return fmt.Errorf("%s denied", what)
+		}
+		ss, err := nip04.ComputeSharedSecret(*req.Peer, key.sk)
+		if err != nil {
+			return fmt.Errorf("failed to compute nip04 shared secret: %w", err)
+		}
+		if req.Method == "nip04_encrypt" {
+			resp.Ciphertext, err = nip04.Encrypt(req.Plaintext, ss)
+		} else {
+			resp.Plaintext, err = nip04.Decrypt(req.Ciphertext, ss)
+		}
+		return err
+	case "conversation_key":
+		if req.Peer == nil {
+			return fmt.Errorf("missing peer")
+		}
+		if key.confirm && !state.confirm(*req.PubKey, "get the conversation key with "+nip19.EncodeNpub(*req.Peer)) {
+			return fmt.Errorf("conversation key denied")
+		}
+		ck, err := nip44.GenerateConversationKey(*req.Peer, key.sk)
+		if err != nil {
+			return fmt.Errorf("failed to compute the conversation key: %w", err)
+		}
+		resp.ConversationKey = hex.EncodeToString(ck[:])
+		return nil
+	default:
+		return fmt.Errorf("unknown method '%s'", req.Method)
+	}
+}
+
+func (state *agentState) confirm(pk nostr.PubKey, what string) bool {
+	state.confirmMu.Lock()
+	defer state.confirmMu.Unlock()
+	log("%s wants to %s\n", color.CyanString(nip19.EncodeNpub(pk)), what)
+	return askConfirmation("allow? [y/n] ")
+}
+
+func (state *agentState) expireKeys(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			state.mu.Lock()
+			for pk, key := range state.keys {
+				if !key.expires.IsZero() && now.After(key.expires) {
+					delete(state.keys, pk)
+					log("forgot %s after timeout\n", color.CyanString(nip19.EncodeNpub(pk)))
+				}
+			}
+			state.mu.Unlock()
+		}
+	}
+}
+
+func getAgentSocketPath(c *cli.Command) string {
+	if path := c.String("socket"); path != "" {
+		return path
+	}
+	return getSocketPath(c, "agent")
+}
+
+func callAgent(socketPath string, req agentRequest) (agentResponse, error) {
+	var resp agentResponse
+
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return resp, fmt.Errorf("failed to connect to agent at %s: %w", socketPath, err)
+	}
+	defer conn.Close()
+
+	data, _ := json.Marshal(req)
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return resp, fmt.Errorf("failed to talk to agent: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return resp, fmt.Errorf("failed to read from agent: %w", err)
+	}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return resp, fmt.Errorf("invalid response from agent: %w", err)
+	}
+	if resp.Error != "" {
+		return resp, fmt.Errorf("agent: %s", resp.Error)
+	}
+
+	return resp, nil
+}
+
+// agentSigner is a nostr.Keyer that forwards everything to a running agent
+type agentSigner struct {
+	socketPath string
+	pubkey     nostr.PubKey
+}
+
+func (as agentSigner) GetPublicKey(ctx context.Context) (nostr.PubKey, error) {
+	return as.pubkey, nil
+}
+
+func (as agentSigner) SignEvent(ctx context.Context, evt *nostr.Event) error {
+	evt.PubKey = as.pubkey
+	resp, err := callAgent(as.socketPath, agentRequest{Method: "sign_event", PubKey: &as.pubkey, Event: evt})
+	if err != nil {
+		return err
+	}
+	if resp.Event == nil || !resp.Event.VerifySignature() {
+		return fmt.Errorf("agent returned an invalid signature")
+	}
+	*evt = *resp.Event
+	return nil
+}
+
+func (as agentSigner) Encrypt(ctx context.Context, plaintext string, recipient nostr.PubKey) (string, error) {
+	resp, err := callAgent(as.socketPath, agentRequest{Method: "encrypt", PubKey: &as.pubkey, Peer: &recipient, Plaintext: plaintext})
+	return resp.Ciphertext, err
+}
+
+func (as agentSigner) Decrypt(ctx context.Context, ciphertext string, sender nostr.PubKey) (string, error) {
+	resp, err := callAgent(as.socketPath, agentRequest{Method: "decrypt", PubKey: &as.pubkey, Peer: &sender, Ciphertext: ciphertext})
+	return resp.Plaintext, err
+}
+
+func (as agentSigner) NIP04Encrypt(ctx context.Context, recipient nostr.PubKey, plaintext string) (string, error) {
+	resp, err := callAgent(as.socketPath, agentRequest{Method: "nip04_encrypt", PubKey: &as.pubkey, Peer: &recipient, Plaintext: plaintext})
+	return resp.Ciphertext, err
+}
+
+func (as agentSigner) NIP04Decrypt(ctx context.Context, sender nostr.PubKey, ciphertext string) (string, error) {
+	resp, err := callAgent(as.socketPath, agentRequest{Method: "nip04_decrypt", PubKey: &as.pubkey, Peer: &sender, Ciphertext: ciphertext})
+	return resp.Plaintext, err
+}
+
+// ConversationKey returns the nip44 conversation key with peer, so payloads can be inspected
+func (as agentSigner) ConversationKey(peer nostr.PubKey) ([32]byte, error) {
+	var ck [32]byte
+	resp, err := callAgent(as.socketPath, agentRequest{Method: "conversation_key", PubKey: &as.pubkey, Peer: &peer})
+	if err != nil {
+		return ck, err
+	}
+	if _, err := hex.Decode(ck[:], []byte(resp.ConversationKey)); err != nil || len(resp.ConversationKey) != 64 {
+		return ck, fmt.Errorf("agent returned an invalid conversation key")
+	}
+	return ck, nil
+}
+
+// agentKeyerFromArguments returns a keyer backed by the agent at NAK_AGENT_SOCK if it holds the key we
+// want: the one from --as or the default identity. without any of these we use the default key as usual,
+// never just some key that happens to be in the agent. a --sec is only served by the agent if it is an
+// ncryptsec that was given to 'nak agent add', any other --sec is used directly.
+func agentKeyerFromArguments(c *cli.Command) (agentSigner, bool) {
+	socketPath := os.Getenv("NAK_AGENT_SOCK")
+	if socketPath == "" || c.Bool("prompt-sec") {
+		return agentSigner{}, false
+	}
+
+	if c.IsSet("sec") && c.String("as") == "" {
+		sec := c.String("sec")
+		if !strings.HasPrefix(sec, "ncryptsec1") {
+			return agentSigner{}, false
+		}
+		resp, err := callAgent(socketPath, agentRequest{Method: "find", NCryptSec: sec})
+		if err != nil || len(resp.Keys) == 0 {
+			logverbose("ncryptsec not in the agent: %s\n", err)
+			return agentSigner{}, false
+		}
+		logverbose("using agent key %s for the given ncryptsec\n", resp.Keys[0].PubKey.Hex())
+		return agentSigner{socketPath: socketPath, pubkey: resp.Keys[0].PubKey}, true
+	}
+
+	_, ident, hasIdentity, err := resolveIdentity(c)
+	if err != nil || !hasIdentity || ident.Bunker != "" {
+		return agentSigner{}, false
+	}
+
+	resp, err := callAgent(socketPath, agentRequest{Method: "list"})
+	if err != nil {
+		logverbose("%s\n", err)
+		return agentSigner{}, false
+	}
+
+	for _, k := range resp.Keys {
+		if k.PubKey == ident.PubKey {
+			logverbose("using agent key %s\n", k.PubKey.Hex())
+			return agentSigner{socketPath: socketPath, pubkey: k.PubKey}, true
+		}
+	}
+
+	return agentSigner{}, false
+}
+
+func parseSecretKeyOrPromptDecrypt(input string) (nostr.SecretKey, error) {
+	if strings.HasPrefix(input, "ncryptsec1") {
+		return promptDecrypt(input)
+	}
+	return parseSecretKey(input)
+}
@@ -22,10 +22,9 @@ var blossomCmd = &cli.Command{
 	DisableSliceFlagSeparator: true,
 	Flags: combineFlags([][]cli.Flag{},
 		&cli.StringSliceFlag{
-			Name:     "server",
-			Aliases:  []string{"s"},
-			Usage:    "the hostname of the target mediaserver",
-			Required: true,
+			Name:    "server",
+			Aliases: []string{"s"},
+			Usage:   "the hostname of the target mediaserver",
 		},
 	),
 	Commands: []*cli.Command{
@@ -44,8 +43,8 @@ var blossomCmd = &cli.Command{
 						return fmt.Errorf("invalid public key '%s': %w", pubkey, err)
 					}
 					servers := c.StringSlice("server")
-					if err != nil {
-						return err
+					if len(servers) == 0 {
+						return fmt.Errorf("no server specified")
 					}
 					client = blossom.NewClient(servers[0], keyer.NewReadOnlySigner(pk))
 				} else {
@@ -69,11 +68,22 @@ var blossomCmd = &cli.Command{
 			},
 		},
 		{
-			Name:                      "upload",
-			Usage:                     "uploads a file to a specific mediaserver.",
-			Description:               `takes any number of local file paths and uploads them to a mediaserver, printing the resulting blob descriptions when successful.`,
+			Name:  "upload",
+			Usage: "uploads a file to a specific mediaserver.",
+			Description: `takes any number of local file paths and uploads them to a mediaserver, printing the resulting blob descriptions when successful.
+
+with --encrypt-to the file is encrypted with a random AES-GCM key before being uploaded and the key, the hash and the url are sent to the recipients as a NIP-17 kind:15 file message, which is printed instead. they can decrypt it with "nak blossom download".
+
+example:
+  nak blossom upload -s blossom.band --encrypt-to npub1... report.pdf`,
 			DisableSliceFlagSeparator: true,
 			ArgsUsage:                 "[files...]",
+			Flags: []cli.Flag{
+				&PubKeySliceFlag{
+					Name:  "encrypt-to",
+					Usage: "encrypt the file and send it privately to this pubkey (can be passed multiple times)",
+				},
+			},
 			Action: func(ctx context.Context, c *cli.Command) error {
 				keyer, _, err := gatherKeyerFromArguments(ctx, c)
 				if err != nil {
@@ -86,6 +96,46 @@ var blossomCmd = &cli.Command{
 					return fmt.Errorf("no server specified")
 				}
 
+				if recipients := getPubKeySlice(c, "encrypt-to"); len(recipients) > 0 {
+					s, err := newDMSessionWithKeyer(ctx, c, keyer)
+					if err != nil {
+						return err
+					}
+
+					if isPiped() {
+						if c.Args().Len() > 0 {
+							return fmt.Errorf("do not pass arguments when piping from stdin")
+						}
+						data, err := io.ReadAll(os.Stdin)
+						if err != nil {
+							return fmt.Errorf("failed to read stdin: %w", err)
+						}
+						rumor, err := uploadEncryptedBlob(ctx, s, servers, data, recipients)
+						if err != nil {
+							return err
+						}
+						stdout(rumor.String())
+						return nil
+					}
+
+					for _, fpath := range c.Args().Slice() {
+						data, err := os.ReadFile(fpath)
+						if err != nil {
+							ctx = lineProcessingError(ctx, "failed to read '%s': %s", fpath, err)
+							continue
+						}
+						rumor, err := uploadEncryptedBlob(ctx, s, servers, data, recipients)
+						if err != nil {
+							ctx = lineProcessingError(ctx, "failed to send '%s': %s", fpath, err)
+							continue
+						}
+						stdout(rumor.String())
+					}
+
+					exitIfLineProcessingError(ctx)
+					return nil
+				}
+
 				if isPiped() {
 					// get file from stdin
 					if c.Args().Len() > 0 {
@@ -130,11 +180,16 @@ var blossomCmd = &cli.Command{
 			},
 		},
 		{
-			Name:                      "download",
-			Usage:                     "downloads files from mediaservers",
-			Description:               `takes any number of sha256 hashes as hex, downloads them and prints them to stdout (unless --output is specified).`,
+			Name:  "download",
+			Usage: "downloads files from mediaservers",
+			Description: `takes any number of sha256 hashes as hex, downloads them and prints them to stdout (unless --output is specified).
+
+NIP-17 kind:15 file messages with an encrypted file (as sent by "nak blossom upload --encrypt-to") can be given instead of hashes, as arguments or through stdin, and the file will be downloaded from the url in them and decrypted.
+
+example:
+  nak dm inbox | jq -c 'select(.kind == 15)' | nak blossom download -s blossom.band -o report.pdf`,
 			DisableSliceFlagSeparator: true,
-			ArgsUsage:                 "[sha256...]",
+			ArgsUsage:                 "[sha256 or kind:15 message...]",
 			Flags: []cli.Flag{
 				&cli.StringSliceFlag{
 					Name:    "output",
@@ -150,9 +205,36 @@ var blossomCmd = &cli.Command{
 
 				outputs := c.StringSlice("output")
 
+				inputs := c.Args().Slice()
+				if len(inputs) == 0 && isPiped() {
+					for input := range getJsonsOrBlank() {
+						if input != "{}" {
+							inputs = append(inputs, input)
+						}
+					}
+				}
+
 				hasError := false
 				var hash [32]byte
-				for i, hhash := range c.Args().Slice() {
+				for i, hhash := range inputs {
+					if msg, ok := parseEncryptedFileMessage(hhash); ok {
+						data, err := downloadEncryptedBlob(ctx, client, msg)
+						if err != nil {
+							log("download failed for '%s': %s\n", msg.ID.Hex(), err)
+							hasError = true
+							continue
+						}
+						if len(outputs)-1 >= i && outputs[i] != "--" {
+							if err := os.WriteFile(outputs[i], data, 0644); err != nil {
+								log("failed to write '%s': %s\n", outputs[i], err)
+								hasError = true
+							}
+						} else {
+							os.Stdout.Write(data)
+						}
+						continue
+					}
+
 					if len(hhash) != 64 {
 						log("invalid blob hash '%s'\n", hhash)
 						hasError = true
@@ -312,6 +394,8 @@ if any of the files are not found the command will fail, otherwise it will succe
 				return nil
 			},
 		},
+		blossomSync,
+		blossomGC,
 	},
 }
 
@@ -321,8 +405,8 @@ func getBlossomClient(ctx context.Context, c *cli.Command) (*blossom.Client, err
 		return nil, err
 	}
 	servers := c.StringSlice("server")
-	if err != nil {
-		return nil, err
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no server specified")
 	}
 	return blossom.NewClient(servers[0], keyer), nil
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip19"
+	"fiatjaf.com/nostr/nipb0/blossom"
+	"github.com/mailru/easyjson"
+)
+
+// uploadEncryptedBlob encrypts data with a random AES-GCM key, uploads the ciphertext to all the servers
+// and sends the key and the location to the recipients as a NIP-17 kind:15 file message
+func uploadEncryptedBlob(
+	ctx context.Context,
+	s *dmSession,
+	servers []string,
+	data []byte,
+	recipients []nostr.PubKey,
+) (nostr.Event, error) {
+	key := make([]byte, 32)
+	nonce := make([]byte, 12)
+	rand.Read(key)
+	rand.Read(nonce)
+
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	ciphertext := gcm.Seal(nil, nonce, data, nil)
+
+	urls := make([]string, 0, len(servers))
+	for _, server := range servers {
+		client := blossom.NewClient(server, s.kr)
+		bd, err := client.UploadBlob(ctx, bytes.NewReader(ciphertext), "")
+		if err != nil {
+			log("failed to upload to '%s': %s\n", server, err)
+			continue
+		}
+		urls = append(urls, bd.URL)
+	}
+	if len(urls) == 0 {
+		return nostr.Event{}, fmt.Errorf("failed to upload the encrypted file to any server")
+	}
+
+	hash := sha256.Sum256(ciphertext)
+	originalHash := sha256.Sum256(data)
+
+	rumor := s.makeRumor(urls[0], recipients)
+	rumor.Kind = 15
+	rumor.Tags = append(rumor.Tags,
+		nostr.Tag{"file-type", http.DetectContentType(data)},
+		nostr.Tag{"encryption-algorithm", "aes-gcm"},
+		nostr.Tag{"decryption-key", hex.EncodeToString(key)},
+		nostr.Tag{"decryption-nonce", hex.EncodeToString(nonce)},
+		nostr.Tag{"x", hex.EncodeToString(hash[:])},
+		nostr.Tag{"ox", hex.EncodeToString(originalHash[:])},
+		nostr.Tag{"size", strconv.Itoa(len(ciphertext))},
+	)
+	for _, url := range urls[1:] {
+		rumor.Tags = append(rumor.Tags, nostr.Tag{"fallback", url})
+	}
+	rumor.ID = rumor.GetID()
+
+	if err := s.send(ctx, rumor, recipients); err != nil {
+		return rumor, err
+	}
+	for _, pk := range recipients {
+		log("file sent to %s\n", nip19.EncodeNpub(pk))
+	}
+
+	return rumor, nil
+}
+
+// parseEncryptedFileMessage checks if the input is a kind:15 file message with an encrypted file
+func parseEncryptedFileMessage(input string) (nostr.Event, bool) {
+	var evt nostr.Event
+	if err := easyjson.Unmarshal([]byte(input), &evt); err != nil {
+		return evt, false
+	}
+	if evt.Kind != 15 {
+		return evt, false
+	}
+	if alg := evt.Tags.Find("encryption-algorithm"); alg == nil || alg[1] != "aes-gcm" {
+		return evt, false
+	}
+	return evt, evt.Tags.Find("decryption-key") != nil && evt.Tags.Find("decryption-nonce") != nil
+}
+
+// downloadEncryptedBlob fetches the file referenced by a kind:15 message (from its url, the fallbacks
+// or, by its hash, from the given blossom client), checks it and decrypts it
+func downloadEncryptedBlob(ctx context.Context, client *blossom.Client, msg nostr.Event) ([]byte, error) {
+	key, err := hex.DecodeString(msg.Tags.Find("decryption-key")[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid decryption-key: %w", err)
+	}
+	nonce, err := hex.DecodeString(msg.Tags.Find("decryption-nonce")[1])
+	if err != nil || len(nonce) == 0 {
+		return nil, fmt.Errorf("invalid decryption-nonce: %w", err)
+	}
+	var expected []byte
+	if x := msg.Tags.Find("x"); x != nil {
+		expected, _ = hex.DecodeString(x[1])
+	}
+
+	urls := []string{msg.Content}
+	for _, tag := range msg.Tags {
+		if len(tag) >= 2 && tag[0] == "fallback" {
+			urls = append(urls, tag[1])
+		}
+	}
+
+	var ciphertext []byte
+	for _, url := range urls {
+		data, err := fetchBlobURL(ctx, url)
+		if err != nil {
+			logverbose("failed to download from %s: %s\n", url, err)
+			continue
+		}
+		if expected != nil {
+			if hash := sha256.Sum256(data); !bytes.Equal(hash[:], expected) {
+				logverbose("file from %s doesn't match the expected hash\n", url)
+				continue
+			}
+		}
+		ciphertext = data
+		break
+	}
+	if ciphertext == nil && len(expected) == 32 && client != nil {
+		data, err := client.Download(ctx, [32]byte(expected))
+		if err != nil {
+			return nil, fmt.Errorf("failed to download from %v and from the server: %w", urls, err)
+		}
+		if hash := sha256.Sum256(data); !bytes.Equal(hash[:], expected) {
+			return nil, fmt.Errorf("file from the server doesn't match the expected hash")
+		}
+		ciphertext = data
+	}
+	if ciphertext == nil {
+		return nil, fmt.Errorf("failed to download from %v", urls)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid decryption-key: %w", err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(nonce))
+	if err != nil {
+		return nil, fmt.Errorf("invalid decryption-nonce: %w", err)
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	if ox := msg.Tags.Find("ox"); ox != nil {
+		if hash := sha256.Sum256(plaintext); hex.EncodeToString(hash[:]) != ox[1] {
+			return nil, fmt.Errorf("decrypted file doesn't match the original hash")
+		}
+	}
+
+	return plaintext, nil
+}
+
+func fetchBlobURL(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("got status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nipb0/blossom"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+)
+
+var blossomGC = &cli.Command{
+	Name:  "gc",
+	Usage: "deletes our blobs that none of our events reference anymore",
+	Description: `lists our blobs on our blossom servers (from kind:10063 or --server) and fetches all our events from our write relays (or from the relays given as arguments), then looks for blob hashes anywhere in them: urls in the content, imeta and x tags, nsite manifest paths and so on.
+
+files sent encrypted in direct messages are only referenced inside gift-wraps, so the gift store (see 'nak gift inbox') is brought up to date and the rumors in it are searched too. if that fails nothing is deleted.
+
+blobs not referenced anywhere are printed with their sizes and, after confirmation, deleted. blobs uploaded recently (see --grace) are always kept, since the events that use them may not have been published yet.
+
+--kind only narrows down where references are looked for, not which blobs can be deleted: a blob used by any other kind (e.g. the picture in our profile) will be deleted too.
+
+example:
+  nak blossom gc --grace 720h
+  nak blossom gc -k 1 -k 20 -k 35128`,
+	ArgsUsage:                 "[relay...]",
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "grace",
+			Usage: "keep blobs uploaded less than this long ago",
+			Value: 7 * 24 * time.Hour,
+		},
+		&KindSliceFlag{
+			Name:    "kind",
+			Aliases: []string{"k"},
+			Usage:   "only consider references from events of these kinds (blobs used by other kinds will be deleted!)",
+		},
+		&cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "don't ask for confirmation before deleting",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		kr, _, err := gatherKeyerFromArguments(ctx, c)
+		if err != nil {
+			return err
+		}
+		us, err := kr.GetPublicKey(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get our public key: %w", err)
+		}
+
+		servers, err := blossomServersFor(ctx, c, us)
+		if err != nil {
+			return err
+		}
+
+		relays := c.Args().Slice()
+		if len(relays) == 0 {
+			relays = sys.FetchWriteRelays(ctx, us)
+		}
+		if len(relays) == 0 {
+			return fmt.Errorf("no relays to fetch our events from, give some as arguments")
+		}
+
+		// gather every hash mentioned in our events, going back page by page so relay limits don't cut off old ones
+		filter := nostr.Filter{Authors: []nostr.PubKey{us}}
+		if kinds := getKindSlice(c, "kind"); len(kinds) > 0 {
+			filter.Kinds = kinds
+			log(color.RedString("only looking for references in kinds %v, blobs used by any other kind will be deleted too\n"), kinds)
+		}
+		referenced := make(map[string]struct{})
+		seen := make(map[nostr.ID]struct{})
+		paginator := sys.Pool.PaginatorWithInterval(0)
+		for ie := range paginator(ctx, relays, filter, nostr.SubscriptionOptions{Label: "nak-blossom-gc"}) {
+			if _, ok := seen[ie.Event.ID]; ok {
+				continue
+			}
+			seen[ie.Event.ID] = struct{}{}
+			for _, hash := range blobHashesIn(ie.Event) {
+				referenced[hash] = struct{}{}
+			}
+		}
+		if len(seen) == 0 {
+			// better not to delete everything just because the relays didn't answer
+			return fmt.Errorf("no events of ours found in %v, refusing to continue", relays)
+		}
+		log("found %d blob references in %d events\n", len(referenced), len(seen))
+
+		// and in our direct messages, where encrypted files are referenced
+		store, err := openGiftStore(ctx, c.String("config-path"), kr, us)
+		if err != nil {
+			return fmt.Errorf("can't check for blobs referenced in direct messages: %w", err)
+		}
+		defer store.close()
+		if len(sys.FetchInboxRelays(ctx, us, 3)) == 0 && len(fetchDMRelays(ctx, us)) == 0 {
+			// then nobody could have sent us anything, not even our own copies of what we sent
+			logverbose("no inbox or dm relays, only looking at the direct messages we already have\n")
+		} else if upToDate, err := store.update(ctx, c, kr, nil, 0, false); err != nil {
+			return fmt.Errorf("can't check for blobs referenced in direct messages: %w", err)
+		} else if !upToDate {
+			return fmt.Errorf("couldn't fetch all our direct messages, refusing to continue")
+		}
+		private := 0
+		for _, rumor := range store.rumors() {
+			for _, hash := range blobHashesIn(rumor) {
+				if _, ok := referenced[hash]; !ok {
+					referenced[hash] = struct{}{}
+					private++
+				}
+			}
+		}
+		log("found %d more blob references in %d direct messages\n", private, len(store.rumors()))
+
+		type garbage struct {
+			server string
+			hash   string
+			size   int64
+		}
+		unreferenced := make([]garbage, 0, 20)
+		var total int64
+		cutoff := nostr.Now() - nostr.Timestamp(c.Duration("grace").Seconds())
+		for _, server := range servers {
+			bds, err := blossom.NewClient(server, kr).List(ctx)
+			if err != nil {
+				log("failed to list blobs on %s: %s\n", color.YellowString(server), err)
+				continue
+			}
+			for _, bd := range bds {
+				if _, ok := referenced[bd.SHA256]; ok {
+					continue
+				}
+				if nostr.Timestamp(bd.Uploaded) > cutoff {
+					continue
+				}
+				unreferenced = append(unreferenced, garbage{server, bd.SHA256, int64(bd.Size)})
+				total += int64(bd.Size)
+			}
+		}
+
+		if len(unreferenced) == 0 {
+			log("no unreferenced blobs\n")
+			return nil
+		}
+		slices.SortFunc(unreferenced, func(a, b garbage) int { return int(b.size - a.size) })
+		for _, g := range unreferenced {
+			stdout(fmt.Sprintf("%s %s %s", g.hash, color.CyanString(formatBlobSize(g.size)), color.YellowString(g.server)))
+		}
+
+		msg := fmt.Sprintf("delete %d unreferenced blobs (%s)? [y/n] ", len(unreferenced), formatBlobSize(total))
+		if !c.Bool("yes") && !askConfirmation(msg) {
+			return fmt.Errorf("aborted")
+		}
+
+		hasError := false
+		for _, g := range unreferenced {
+			if err := blossom.NewClient(g.server, kr).Delete(ctx, g.hash); err != nil {
+				log("failed to delete %s from %s: %s\n", g.hash, color.YellowString(g.server), err)
+				hasError = true
+				continue
+			}
+			logverbose("deleted %s from %s\n", g.hash, g.server)
+		}
+		if hasError {
+			return fmt.Errorf("some blobs couldn't be deleted")
+		}
+		log("deleted %d blobs, %s freed\n", len(unreferenced), formatBlobSize(total))
+		return nil
+	},
+}
+
+var blobHashRegex = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// blobHashesIn finds everything that looks like a sha256 in the content and tags of an event, which
+// covers blob urls, imeta and x tags and nsite manifests (it also catches ids and pubkeys, but keeping
+// a blob because of that is harmless)
+func blobHashesIn(evt nostr.Event) []string {
+	hashes := blobHashRegex.FindAllString(evt.Content, -1)
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		for _, value := range tag[1:] {
+			hashes = append(hashes, blobHashRegex.FindAllString(value, -1)...)
+		}
+	}
+	return hashes
+}
+
+func formatBlobSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
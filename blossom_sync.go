@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/keyer"
+	"fiatjaf.com/nostr/nipb0/blossom"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+)
+
+var blossomSync = &cli.Command{
+	Name:  "sync",
+	Usage: "makes all the blossom servers of a pubkey have the same blobs",
+	Description: `lists the blobs on every server from the kind:10063 list of the pubkey (or the ones given with --server), prints which server has which blob, then copies each missing blob to where it is missing, first by asking the server to mirror it from another one and, if that fails, by downloading and uploading it again.
+
+the pubkey defaults to ours. blobs are always mirrored or uploaded with our key.
+
+example:
+  nak blossom sync --dry-run
+  nak blossom sync npub1... -s blossom.band -s nostr.download`,
+	ArgsUsage:                 "[pubkey]",
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only print the coverage and what would be copied",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		kr, _, err := gatherKeyerFromArguments(ctx, c)
+		if err != nil {
+			return err
+		}
+		us, err := kr.GetPublicKey(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get our public key: %w", err)
+		}
+
+		pk := us
+		if arg := c.Args().First(); arg != "" {
+			if pk, err = parsePubKey(arg); err != nil {
+				return fmt.Errorf("invalid public key '%s': %w", arg, err)
+			}
+		}
+
+		servers, err := blossomServersFor(ctx, c, pk)
+		if err != nil {
+			return err
+		}
+
+		// listing our own blobs may need authorization
+		var lister nostr.Keyer = kr
+		if pk != us {
+			lister = keyer.NewReadOnlySigner(pk)
+		}
+
+		// which server has which blob (as the url of the blob in that server)
+		coverage := make(map[string][]string)
+		available := make([]string, 0, len(servers))
+		for _, server := range servers {
+			bds, err := blossom.NewClient(server, lister).List(ctx)
+			if err != nil {
+				log("failed to list blobs on %s: %s\n", color.YellowString(server), err)
+				continue
+			}
+			i := len(available)
+			available = append(available, server)
+			for _, bd := range bds {
+				if _, ok := coverage[bd.SHA256]; !ok {
+					coverage[bd.SHA256] = make([]string, len(servers))
+				}
+				coverage[bd.SHA256][i] = bd.URL
+			}
+		}
+		if len(available) < 2 {
+			return fmt.Errorf("need at least two servers that can be listed to sync, got %d", len(available))
+		}
+
+		hashes := make([]string, 0, len(coverage))
+		for hash := range coverage {
+			hashes = append(hashes, hash)
+		}
+		slices.Sort(hashes)
+
+		printBlossomCoverage(available, hashes, coverage)
+
+		copied, failed := 0, 0
+		for _, hash := range hashes {
+			have := coverage[hash]
+			source := slices.IndexFunc(have, func(url string) bool { return url != "" })
+
+			for i, server := range available {
+				if have[i] != "" {
+					continue
+				}
+
+				if c.Bool("dry-run") {
+					log("would copy %s from %s to %s\n", hash, color.YellowString(available[source]), color.YellowString(server))
+					copied++
+					continue
+				}
+
+				if err := copyBlob(ctx, kr, hash, available[source], have[source], server); err != nil {
+					log("failed to copy %s to %s: %s\n", hash, color.YellowString(server), color.RedString(err.Error()))
+					failed++
+					continue
+				}
+				log("copied %s to %s\n", hash, color.GreenString(server))
+				copied++
+			}
+		}
+
+		switch {
+		case c.Bool("dry-run"):
+			log("%d copies would be made\n", copied)
+		case failed > 0:
+			return fmt.Errorf("%d blobs copied, %d failed", copied, failed)
+		default:
+			log("%d blobs copied\n", copied)
+		}
+		return nil
+	},
+}
+
+// blossomServersFor returns the servers given with --server or the ones in the kind:10063 of the pubkey
+func blossomServersFor(ctx context.Context, c *cli.Command, pk nostr.PubKey) ([]string, error) {
+	if servers := c.StringSlice("server"); len(servers) > 0 {
+		return servers, nil
+	}
+
+	list := sys.FetchBlossomServerList(ctx, pk)
+	if len(list.Items) == 0 {
+		return nil, fmt.Errorf("no blossom servers in kind:10063, give some with --server")
+	}
+	servers := make([]string, len(list.Items))
+	for i, s := range list.Items {
+		servers[i] = s.Value()
+	}
+	return servers, nil
+}
+
+// copyBlob asks the target server to mirror the blob (BUD-04), if it can't we download it from the
+// source ourselves and upload it
+func copyBlob(ctx context.Context, kr nostr.Keyer, hhash, source, sourceURL, target string) error {
+	client := blossom.NewClient(target, kr)
+	_, err := client.MirrorBlob(ctx, sourceURL)
+	if err == nil {
+		return nil
+	}
+	logverbose("mirror of %s to %s failed, uploading instead: %s\n", hhash, target, err)
+
+	var hash [32]byte
+	if _, err := hex.Decode(hash[:], []byte(hhash)); err != nil {
+		return fmt.Errorf("invalid blob hash '%s': %w", hhash, err)
+	}
+	data, err := blossom.NewClient(source, kr).Download(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("failed to download from %s: %w", source, err)
+	}
+	if _, err := client.UploadBlob(ctx, bytes.NewReader(data), ""); err != nil {
+		return fmt.Errorf("failed to upload: %w", err)
+	}
+	return nil
+}
+
+func printBlossomCoverage(servers []string, hashes []string, coverage map[string][]string) {
+	for i, server := range servers {
+		stdout(fmt.Sprintf("[%d] %s", i+1, color.YellowString(server)))
+	}
+
+	header := strings.Repeat(" ", 64)
+	for i := range servers {
+		header += fmt.Sprintf(" %d", i+1)
+	}
+	stdout(header)
+
+	for _, hash := range hashes {
+		line := hash
+		for i := range servers {
+			if coverage[hash][i] != "" {
+				line += " " + color.GreenString("✓")
+			} else {
+				line += " " + color.RedString("✗")
+			}
+		}
+		stdout(line)
+	}
+}
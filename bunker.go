@@ -3,11 +3,11 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"maps"
 	"net"
 	"net/url"
 	"os"
@@ -147,6 +147,28 @@ var bunker = &cli.Command{
 			Name:  "qrcode",
 			Usage: "display a QR code for the bunker URI",
 		},
+		&cli.DurationFlag{
+			Name:  "client-expiry",
+			Usage: "clients authorized from now on lose access after this long",
+		},
+		&cli.BoolFlag{
+			Name:  "interactive",
+			Usage: "instead of refusing requests from unknown clients or outside a client's permissions, ask for approval (on the terminal or, if there is no terminal, through an auth_url page the operator logs into)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "identity",
+			Usage: "also serve this identity from the keystore (see 'nak identity'), can be given multiple times",
+		},
+		&cli.StringFlag{
+			Name:      "audit-log",
+			Usage:     "append a json record for every request to this file (query it with 'nak bunker log')",
+			TakesFile: true,
+		},
+		&cli.StringFlag{
+			Name:  "approval-addr",
+			Usage: "address to serve the approval page on when --interactive is used without a terminal",
+			Value: "127.0.0.1:0",
+		},
 	},
 	Action: func(ctx context.Context, c *cli.Command) error {
 		// read config from file
@@ -160,6 +182,16 @@ var bunker = &cli.Command{
 		var baseSecret plainOrEncryptedKey
 		{
 			sec := c.String("sec")
+			if name := c.String("as"); name != "" {
+				_, ident, _, err := resolveIdentity(c)
+				if err != nil {
+					return err
+				}
+				if ident.Bunker != "" {
+					return fmt.Errorf("identity '%s' is itself a bunker, it can't be served from here", name)
+				}
+				sec = ident.NCryptSec
+			}
 			if c.Bool("prompt-sec") {
 				var err error
 				sec, err = askPassword("type your secret key as ncryptsec, nsec or hex: ", nil)
@@ -181,6 +213,29 @@ var bunker = &cli.Command{
 			}
 		}
 
+		// extra identities to serve besides the main key, from the keystore
+		var baseIdentities []BunkerConfigIdentity
+		if names := c.StringSlice("identity"); len(names) > 0 {
+			store, err := loadIdentityStore(c)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				ident, exists := store.Identities[name]
+				if !exists {
+					return fmt.Errorf("identity '%s' not found, see 'nak identity list'", name)
+				}
+				if ident.Bunker != "" {
+					return fmt.Errorf("identity '%s' is itself a bunker, it can't be served from here", name)
+				}
+				ncryptsec := ident.NCryptSec
+				baseIdentities = append(baseIdentities, BunkerConfigIdentity{
+					Name:   name,
+					Secret: plainOrEncryptedKey{Encrypted: &ncryptsec},
+				})
+			}
+		}
+
 		// default case: persist() is nil
 		var persist func()
 
@@ -235,11 +290,16 @@ var bunker = &cli.Command{
 					config.Clients = append(config.Clients, BunkerConfigClient{PubKey: bak})
 				}
 			}
+			for _, bi := range baseIdentities {
+				if !slices.ContainsFunc(config.Identities, func(ci BunkerConfigIdentity) bool { return ci.Name == bi.Name }) {
+					config.Identities = append(config.Identities, bi)
+				}
+			}
 
 			if config.Secret.Plain == nil && config.Secret.Encrypted == nil {
 				// we don't have any secret key stored, so just use whatever was given via flags (or defaults)
 				config.Secret = baseSecret
-			} else if !c.IsSet("sec") && !c.IsSet("prompt-sec") {
+			} else if !c.IsSet("sec") && !c.IsSet("prompt-sec") && !c.IsSet("as") {
 				// we didn't provide any keys explicitly, so we just use the stored
 			} else {
 				// we have a secret key stored
@@ -251,6 +311,7 @@ var bunker = &cli.Command{
 		} else {
 			config.Secret = baseSecret
 			config.Relays = baseRelaysUrls
+			config.Identities = baseIdentities
 			for _, bak := range baseAuthorizedKeys {
 				config.Clients = append(config.Clients, BunkerConfigClient{PubKey: bak})
 			}
@@ -273,16 +334,41 @@ var bunker = &cli.Command{
 			return fmt.Errorf("no relays given")
 		}
 
-		// decrypt key here if necessary
-		var sec nostr.SecretKey
-		if config.Secret.Plain != nil {
-			sec = *config.Secret.Plain
-		} else {
-			plain, err := promptDecrypt(*config.Secret.Encrypted)
+		// decrypt keys here if necessary
+		decryptSecret := func(secret plainOrEncryptedKey) (nostr.SecretKey, error) {
+			if secret.Plain != nil {
+				return *secret.Plain, nil
+			}
+			plain, err := decryptIdentityKey(*secret.Encrypted)
 			if err != nil {
-				return fmt.Errorf("failed to decrypt: %w", err)
+				return nostr.SecretKey{}, fmt.Errorf("failed to decrypt: %w", err)
+			}
+			return plain, nil
+		}
+
+		// the main key is always the first identity, then come the extra ones
+		sec, err := decryptSecret(config.Secret)
+		if err != nil {
+			return err
+		}
+		identities := []*bunkerIdentity{newBunkerIdentity("", sec, &config.Clients)}
+		for i := range config.Identities {
+			sk, err := decryptSecret(config.Identities[i].Secret)
+			if err != nil {
+				return fmt.Errorf("identity '%s': %w", config.Identities[i].Name, err)
+			}
+			if slices.ContainsFunc(identities, func(id *bunkerIdentity) bool { return id.pubkey == sk.Public() }) {
+				return fmt.Errorf("identity '%s' is already being served", config.Identities[i].Name)
 			}
-			sec = plain
+			identities = append(identities, newBunkerIdentity(config.Identities[i].Name, sk, &config.Identities[i].Clients))
+		}
+		getIdentity := func(pubkey nostr.PubKey) *bunkerIdentity {
+			for _, id := range identities {
+				if id.pubkey == pubkey {
+					return id
+				}
+			}
+			return nil
 		}
 
 		if persist != nil {
@@ -308,13 +394,14 @@ var bunker = &cli.Command{
 		}
 
 		// try to connect to the relays here
-		qs := url.Values{}
 		allRelays := make([]string, len(config.Relays), len(config.Relays)+5)
 		copy(allRelays, config.Relays)
-		for _, c := range config.Clients {
-			for _, url := range c.CustomRelays {
-				if !slices.ContainsFunc(allRelays, func(u string) bool { return u == url }) {
-					allRelays = append(allRelays, url)
+		for _, id := range identities {
+			for _, c := range *id.clients {
+				for _, url := range c.CustomRelays {
+					if !slices.ContainsFunc(allRelays, func(u string) bool { return u == url }) {
+						allRelays = append(allRelays, url)
+					}
 				}
 			}
 		}
@@ -323,9 +410,6 @@ var bunker = &cli.Command{
 			log("failed to connect to any of the given relays.\n")
 			os.Exit(3)
 		}
-		for _, relay := range config.Relays {
-			qs.Add("relay", relay)
-		}
 		if len(relays) == 0 {
 			return fmt.Errorf("not connected to any relays: please specify at least one")
 		}
@@ -333,43 +417,48 @@ var bunker = &cli.Command{
 		// other arguments
 		authorizedSecrets := c.StringSlice("authorized-secrets")
 
-		// this will be used to auto-authorize the next person who connects who isn't pre-authorized
-		// it will be stored
-		newSecret := randString(12)
-
-		// guards config.Clients and newSecret, which are accessed from the socket
-		// goroutine, the per-request handler goroutines and here
+		// guards the clients and newSecret of all identities and the relays, which are accessed
+		// from the socket goroutine, the per-request handler goroutines and here
 		var mu sync.Mutex
 
-		// static information
-		pubkey := sec.Public()
-		npub := nip19.EncodeNpub(pubkey)
-
-		bunkerInfo := func() (string, string) {
-			iqs := make(url.Values)
-			maps.Copy(iqs, qs)
-			iqs.Set("secret", newSecret)
-			bunkerURI := fmt.Sprintf("bunker://%s?%s", pubkey.Hex(), iqs.Encode())
-
-			authorizedKeysStr := ""
-			if len(config.Clients) != 0 {
-				authorizedKeysStr = "\n  authorized clients:"
-				for _, c := range config.Clients {
-					authorizedKeysStr += "\n    - " + colors.italic(c.PubKey.Hex())
-					name := ""
-					if c.Name != "" {
-						name = c.Name
-						if c.URL != "" {
-							name += " " + colors.underline(c.URL)
-						}
-					} else if c.URL != "" {
-						name = colors.underline(c.URL)
-					}
-					if name != "" {
-						authorizedKeysStr += " (" + name + ")"
+		bunkerURI := func(id *bunkerIdentity) string {
+			qs := url.Values{"relay": config.Relays, "secret": {id.newSecret}}
+			return fmt.Sprintf("bunker://%s?%s", id.pubkey.Hex(), qs.Encode())
+		}
+
+		clientsInfo := func(clients []BunkerConfigClient, indent string) string {
+			if len(clients) == 0 {
+				return ""
+			}
+			authorizedKeysStr := "\n" + indent + "authorized clients:"
+			for _, c := range clients {
+				authorizedKeysStr += "\n" + indent + "  - " + colors.italic(c.PubKey.Hex())
+				name := ""
+				if c.Name != "" {
+					name = c.Name
+					if c.URL != "" {
+						name += " " + colors.underline(c.URL)
 					}
+				} else if c.URL != "" {
+					name = colors.underline(c.URL)
+				}
+				if name != "" {
+					authorizedKeysStr += " (" + name + ")"
+				}
+				if c.Permissions != nil {
+					authorizedKeysStr += " [" + c.Permissions.String() + "]"
+				}
+				if c.expired() {
+					authorizedKeysStr += " " + color.RedString("expired")
+				} else if c.Expires != 0 {
+					authorizedKeysStr += " expires " + c.Expires.Time().Format(time.DateTime)
 				}
 			}
+			return authorizedKeysStr
+		}
+
+		bunkerInfo := func() string {
+			primary := identities[0]
 
 			authorizedSecretsStr := ""
 			if len(authorizedSecrets) != 0 {
@@ -383,6 +472,9 @@ var bunker = &cli.Command{
 			for _, s := range authorizedSecrets {
 				preauthorizedFlags += " -s " + s
 			}
+			for _, id := range identities[1:] {
+				preauthorizedFlags += " --identity " + id.name
+			}
 
 			secretKeyFlag := ""
 			if sec := c.String("sec"); sec != "" {
@@ -398,166 +490,543 @@ var bunker = &cli.Command{
 				}
 			}
 
-			// only print the restart command if not persisting:
+			info := fmt.Sprintf("listening at %v:\n  pubkey: %s \n  npub: %s%s%s",
+				colors.bold(config.Relays),
+				colors.bold(primary.pubkey.Hex()),
+				colors.bold(nip19.EncodeNpub(primary.pubkey)),
+				clientsInfo(*primary.clients, "  "),
+				authorizedSecretsStr,
+			)
+
+			// only print the restart command if not persisting
 			if persist == nil {
 				restartCommand := fmt.Sprintf("nak bunker %s%s %s",
 					secretKeyFlag,
 					preauthorizedFlags,
 					strings.Join(relayURLsPossiblyWithoutSchema, " "),
 				)
+				info += "\n  to restart: " + color.CyanString(restartCommand)
+			}
+			info += "\n  bunker: " + colors.bold(bunkerURI(primary)) + "\n"
+
+			for _, id := range identities[1:] {
+				info += fmt.Sprintf("  identity %s:\n    npub: %s%s\n    bunker: %s\n",
+					colors.bold(id.name),
+					colors.bold(nip19.EncodeNpub(id.pubkey)),
+					clientsInfo(*id.clients, "    "),
+					colors.bold(bunkerURI(id)),
+				)
+			}
 
-				return fmt.Sprintf("listening at %v:\n  pubkey: %s \n  npub: %s%s%s\n  to restart: %s\n  bunker: %s\n",
-					colors.bold(config.Relays),
-					colors.bold(pubkey.Hex()),
-					colors.bold(npub),
-					authorizedKeysStr,
-					authorizedSecretsStr,
-					color.CyanString(restartCommand),
-					colors.bold(bunkerURI),
-				), bunkerURI
-			} else {
-				// otherwise just print the data
-				return fmt.Sprintf("listening at %v:\n  pubkey: %s \n  npub: %s%s%s\n  bunker: %s\n",
-					colors.bold(config.Relays),
-					colors.bold(pubkey.Hex()),
-					colors.bold(npub),
-					authorizedKeysStr,
-					authorizedSecretsStr,
-					colors.bold(bunkerURI),
-				), bunkerURI
+			return info
+		}
+
+		// only set in --interactive mode
+		var approvals *bunkerApprovals
+		approvalsFooter := func() string {
+			if approvals == nil {
+				return ""
 			}
+			return approvals.footer()
 		}
 
-		setBunkerInfo := func() {
-			info, bunkerURI := bunkerInfo()
+		// redraws the footer, and the qr codes of the given identities, whose secrets may have rotated
+		setBunkerInfo := func(rotated ...*bunkerIdentity) {
 			if c.Bool("qrcode") {
-				// the secret embedded in the bunker uri may have rotated,
-				// so the qr code on screen has to be rendered again
-				qr := strings.Builder{}
-				qrterminal.Generate(bunkerURI, qrterminal.L, &qr)
-				terminal.Log("QR Code for bunker URI:\n%s\n", qr.String())
+				for _, id := range rotated {
+					qr := strings.Builder{}
+					qrterminal.Generate(bunkerURI(id), qrterminal.L, &qr)
+					terminal.Log("QR Code for bunker URI:\n%s\n", qr.String())
+				}
 			}
-			terminal.SetFooter(info)
+			terminal.SetFooter(bunkerInfo() + approvalsFooter())
 		}
 
-		info, bunkerURI := bunkerInfo()
 		if c.Bool("qrcode") {
-			log("QR Code for bunker URI:\n")
-			qrterminal.Generate(bunkerURI, qrterminal.L, os.Stdout)
-			log("\n\n")
+			for _, id := range identities {
+				log("QR Code for bunker URI %s:\n", id.name)
+				qrterminal.Generate(bunkerURI(id), qrterminal.L, os.Stdout)
+				log("\n\n")
+			}
 		}
-		terminal.SetFooter(info)
+		terminal.SetFooter(bunkerInfo())
 
-		// subscribe to relays
-		events := sys.Pool.SubscribeMany(ctx, allRelays, nostr.Filter{
-			Kinds:     []nostr.Kind{nostr.KindNostrConnect},
-			Tags:      nostr.TagMap{"p": []string{pubkey.Hex()}},
-			Since:     nostr.Now(),
-			LimitZero: true,
-		}, nostr.SubscriptionOptions{Label: "nak-bunker"})
-
-		signer := nip46.NewStaticKeySigner(sec)
-		signer.DefaultRelays = config.Relays
-
-		signer.AuthorizeRequest = func(harmless bool, from nostr.PubKey, secret string) bool {
-			mu.Lock()
+		var auditLog *bunkerAuditLog
+		if path := c.String("audit-log"); path != "" {
+			var err error
+			auditLog, err = openBunkerAuditLog(path)
+			if err != nil {
+				return err
+			}
+			defer auditLog.close()
+		}
 
-			if slices.ContainsFunc(config.Clients, func(b BunkerConfigClient) bool { return b.PubKey == from }) {
-				mu.Unlock()
-				return true
+		if c.Bool("interactive") {
+			approvals = &bunkerApprovals{
+				onChange: func() {
+					mu.Lock()
+					info := bunkerInfo()
+					mu.Unlock()
+					terminal.SetFooter(info + approvalsFooter())
+				},
 			}
-			if slices.Contains(authorizedSecrets, secret) {
-				// add client to authorized list for subsequent requests
-				config.Clients = append(config.Clients, BunkerConfigClient{PubKey: from})
-				if persist != nil {
-					persist()
+			if footerWidth == 0 || approvals.readKeys(ctx) != nil {
+				if err := approvals.serveHTTP(ctx, c.String("approval-addr")); err != nil {
+					return err
 				}
-				setBunkerInfo()
-				mu.Unlock()
-				return true
+				log("no terminal, requests will be approved through auth_url links at %s, log in there with the password %s\n",
+					approvals.baseURL, color.YellowString(approvals.password))
 			}
+		}
 
-			if secret == newSecret {
-				// store this key
-				config.Clients = append(config.Clients, BunkerConfigClient{PubKey: from})
-				// discard this and generate a new secret
-				newSecret = randString(12)
+		// adds a client to the authorized list (replacing an expired entry for the same key if there is one).
+		// must be called with mu held
+		authorizeClient := func(id *bunkerIdentity, client BunkerConfigClient) {
+			if client.Expires == 0 && c.Duration("client-expiry") > 0 {
+				client.Expires = nostr.Now() + nostr.Timestamp(c.Duration("client-expiry").Seconds())
+			}
+			*id.clients = slices.DeleteFunc(*id.clients, func(b BunkerConfigClient) bool { return b.PubKey == client.PubKey })
+			*id.clients = append(*id.clients, client)
+		}
 
-				if persist != nil {
-					persist()
+		for _, id := range identities {
+			id.signer.DefaultRelays = config.Relays
+			id.signer.AuthorizeRequest = func(harmless bool, from nostr.PubKey, secret string) bool {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if client := id.client(from); client != nil {
+					if !client.expired() {
+						return true
+					}
+					terminal.Log("client %s has expired\n", from.Hex())
+				}
+				if id.approvedOnce[from] > 0 {
+					id.approvedOnce[from]--
+					return true
+				}
+				if slices.Contains(authorizedSecrets, secret) {
+					// add client to authorized list for subsequent requests
+					authorizeClient(id, BunkerConfigClient{PubKey: from})
+					if persist != nil {
+						persist()
+					}
+					setBunkerInfo()
+					return true
 				}
 
-				setBunkerInfo()
-				mu.Unlock()
-				return true
+				if secret == id.newSecret {
+					// store this key
+					authorizeClient(id, BunkerConfigClient{PubKey: from})
+					// discard this and generate a new secret
+					id.newSecret = rand.Text()
+
+					if persist != nil {
+						persist()
+					}
+
+					setBunkerInfo(id)
+					return true
+				}
+
+				return false
 			}
+		}
 
+		publishBunkerResponse := func(id *bunkerIdentity, to nostr.PubKey, eventResponse nostr.Event) (sentThrough []string) {
+			// use custom relays if they are defined for this client
+			// (normally if the initial connection came from a nostrconnect:// URL)
+			mu.Lock()
+			relays := config.Relays
+			if client := id.client(to); client != nil && len(client.CustomRelays) > 0 {
+				relays = client.CustomRelays
+			}
 			mu.Unlock()
-			return false
+
+			for res := range sys.Pool.PublishMany(ctx, relays, eventResponse) {
+				if res.Error == nil {
+					terminal.Log("* sent response through %s\n", res.Relay.URL)
+					sentThrough = append(sentThrough, res.Relay.URL)
+				} else {
+					terminal.Log("* failed to send response through %s: %s\n", res.RelayURL, res.Error)
+				}
+			}
+			return sentThrough
 		}
 
+		// the same request may arrive through more than one relay
+		seen := make(map[nostr.ID]struct{})
+
 		handleBunkerRequest := func(ie nostr.RelayEvent) {
+			mu.Lock()
+			if _, ok := seen[ie.Event.ID]; ok {
+				mu.Unlock()
+				return
+			}
+			seen[ie.Event.ID] = struct{}{}
+			mu.Unlock()
+
+			// route the request to the identity it is addressed to
+			var id *bunkerIdentity
+			if tag := ie.Event.Tags.Find("p"); len(tag) >= 2 {
+				if pk, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+					id = getIdentity(pk)
+				}
+			}
+			if id == nil {
+				return
+			}
+
 			// handle the NIP-46 request event
 			from := ie.Event.PubKey
-			req, resp, eventResponse, err := signer.HandleRequest(ctx, ie.Event)
+
+			// check the client permissions before handing it to the signer
+			breq, isNIP04, err := decryptBunkerRequest(id.sec, ie.Event)
+			if err != nil {
+				terminal.Log("< failed to decrypt request from %s: %s\n", from.Hex(), err.Error())
+				return
+			}
+
+			audit := bunkerAuditRecord{Identity: id.pubkey, Client: from, Method: breq.Method, Decision: "allowed"}
+			if breq.Method == "sign_event" && len(breq.Params) > 0 {
+				var evt struct {
+					Kind nostr.Kind `json:"kind"`
+				}
+				if err := json.Unmarshal([]byte(breq.Params[0]), &evt); err == nil {
+					audit.Kind = &evt.Kind
+				}
+			}
+
+			mu.Lock()
+			id.lastActivity[from] = nostr.Now()
+			var perms *BunkerPermissions
+			known := false
+			if client := id.client(from); client != nil {
+				perms = client.Permissions
+				known = !client.expired()
+				audit.Name = client.Name
+			}
+			hasSecret := breq.Method == "connect" && len(breq.Params) >= 2 &&
+				(breq.Params[1] == id.newSecret || slices.Contains(authorizedSecrets, breq.Params[1]))
+			mu.Unlock()
+
+			deny := func(reason string) {
+				terminal.Log("- denied %s from '%s': %s\n", breq.Method, color.New(color.Bold, color.FgBlue).Sprint(from.Hex()), reason)
+				audit.Decision = "denied"
+				audit.Reason = reason
+				eventResponse, err := makeBunkerResponse(id.sec, from, bunkerResponse{ID: breq.ID, Error: reason}, isNIP04)
+				if err != nil {
+					terminal.Log("< failed to build response: %s\n", err)
+					auditLog.write(audit)
+					return
+				}
+				audit.Relays = publishBunkerResponse(id, from, eventResponse)
+				auditLog.write(audit)
+			}
+			ask := func(reason string) bunkerApproval {
+				return approvals.ask(ctx, from, breq, reason, func(url string) {
+					terminal.Log("~ sending auth_url %s to '%s'\n", url, from.Hex())
+					eventResponse, err := makeBunkerResponse(id.sec, from, bunkerResponse{ID: breq.ID, Result: "auth_url", Error: url}, isNIP04)
+					if err == nil {
+						publishBunkerResponse(id, from, eventResponse)
+					}
+				})
+			}
+
+			if approvals != nil && !known && !hasSecret {
+				switch ask("unknown client") {
+				case approvalAlways:
+					audit.Decision = "approved"
+					mu.Lock()
+					authorizeClient(id, BunkerConfigClient{PubKey: from})
+					if persist != nil {
+						persist()
+					}
+					setBunkerInfo()
+					mu.Unlock()
+				case approvalOnce:
+					audit.Decision = "approved"
+					mu.Lock()
+					id.approvedOnce[from]++
+					mu.Unlock()
+					defer func() {
+						mu.Lock()
+						delete(id.approvedOnce, from)
+						mu.Unlock()
+					}()
+				default:
+					deny("not authorized")
+					return
+				}
+			} else if err := perms.allows(breq); err != nil {
+				if approvals == nil {
+					deny(err.Error())
+					return
+				}
+				switch ask(err.Error()) {
+				case approvalAlways:
+					audit.Decision = "approved"
+					mu.Lock()
+					if client := id.client(from); client != nil {
+						client.Permissions.allow(breq)
+						if persist != nil {
+							persist()
+						}
+						setBunkerInfo()
+					}
+					mu.Unlock()
+				case approvalOnce:
+					audit.Decision = "approved"
+				default:
+					deny(err.Error())
+					return
+				}
+			}
+
+			req, resp, eventResponse, err := id.signer.HandleRequest(ctx, ie.Event)
 			if err != nil {
 				if errors.Is(err, nip46.AlreadyHandled) {
 					return
 				}
 
 				terminal.Log("< failed to handle request from %s: %s\n", from.Hex(), err.Error())
+				audit.Decision = "failed"
+				audit.Reason = err.Error()
+				auditLog.write(audit)
 				return
 			}
 
 			jreq, _ := json.MarshalIndent(req, "", "  ")
-			terminal.Log("- got request from '%s': %s\n", color.New(color.Bold, color.FgBlue).Sprint(from.Hex()), string(jreq))
+			to := ""
+			if id.name != "" {
+				to = " to " + colors.bold(id.name)
+			}
+			terminal.Log("- got request from '%s'%s: %s\n", color.New(color.Bold, color.FgBlue).Sprint(from.Hex()), to, string(jreq))
 			jresp, _ := json.MarshalIndent(resp, "", "  ")
 			terminal.Log("~ responding with %s\n", string(jresp))
 
-			// use custom relays if they are defined for this client
-			// (normally if the initial connection came from a nostrconnect:// URL)
-			relays := config.Relays
+			// a client asking for specific permissions on connect gets exactly those
+			if breq.Method == "connect" && len(breq.Params) >= 3 && resp.Error == "" {
+				if requested := parseNIP46Perms(breq.Params[2]); requested != nil {
+					mu.Lock()
+					if client := id.client(from); client != nil && client.Permissions == nil {
+						client.Permissions = requested
+						if persist != nil {
+							persist()
+						}
+						setBunkerInfo()
+					}
+					mu.Unlock()
+				}
+			}
+
+			if resp.Error != "" {
+				audit.Decision = "rejected"
+				audit.Reason = resp.Error
+			} else if breq.Method == "sign_event" {
+				var signed nostr.Event
+				if err := json.Unmarshal([]byte(resp.Result), &signed); err == nil {
+					audit.EventID = signed.ID.Hex()
+				}
+			}
+			audit.Relays = publishBunkerResponse(id, from, eventResponse)
+			auditLog.write(audit)
+		}
+
+		// each relay gets its own subscription so relays can be added and removed while running
+		pubkeys := make([]string, len(identities))
+		for i, id := range identities {
+			pubkeys[i] = id.pubkey.Hex()
+		}
+		subscriptions := make(map[string]context.CancelFunc)
+
+		// must be called with mu held
+		subscribe := func(url string) {
+			if _, ok := subscriptions[url]; ok {
+				return
+			}
+			subctx, cancel := context.WithCancel(ctx)
+			subscriptions[url] = cancel
+			go func() {
+				for ie := range sys.Pool.SubscribeMany(subctx, []string{url}, nostr.Filter{
+					Kinds:     []nostr.Kind{nostr.KindNostrConnect},
+					Tags:      nostr.TagMap{"p": pubkeys},
+					Since:     nostr.Now(),
+					LimitZero: true,
+				}, nostr.SubscriptionOptions{Label: "nak-bunker"}) {
+					go handleBunkerRequest(ie)
+				}
+			}()
+		}
+
+		// must be called with mu held, keeps the subscription if some client still uses the relay
+		unsubscribe := func(url string) {
+			for _, id := range identities {
+				for _, client := range *id.clients {
+					if slices.Contains(client.CustomRelays, url) {
+						return
+					}
+				}
+			}
+			if cancel, ok := subscriptions[url]; ok {
+				cancel()
+				delete(subscriptions, url)
+			}
+		}
+
+		// handles the commands sent through the unix socket by `nak bunker clients`, `revoke` etc
+		handleControl := func(req bunkerControlRequest) (resp bunkerControlResponse) {
 			mu.Lock()
-			for _, c := range config.Clients {
-				if c.PubKey == from && len(c.CustomRelays) > 0 {
-					relays = c.CustomRelays
-					break
+			defer mu.Unlock()
+
+			targets := identities
+			if req.Identity != "" {
+				idx := slices.IndexFunc(identities, func(id *bunkerIdentity) bool { return id.name == req.Identity })
+				if idx == -1 {
+					resp.Error = fmt.Sprintf("unknown identity '%s'", req.Identity)
+					return resp
 				}
+				targets = identities[idx : idx+1]
 			}
-			mu.Unlock()
 
-			for res := range sys.Pool.PublishMany(ctx, relays, eventResponse) {
-				if res.Error == nil {
-					terminal.Log("* sent response through %s\n", res.Relay.URL)
-				} else {
-					terminal.Log("* failed to send response through %s: %s\n", res.RelayURL, res.Error)
+			switch req.Command {
+			case "clients":
+				for _, id := range targets {
+					for _, client := range *id.clients {
+						resp.Clients = append(resp.Clients, bunkerControlClient{
+							Identity:           id.name,
+							Signer:             id.pubkey,
+							BunkerConfigClient: client,
+							LastActivity:       id.lastActivity[client.PubKey],
+						})
+					}
+				}
+			case "revoke":
+				if len(req.Args) != 1 {
+					resp.Error = "revoke takes exactly one pubkey"
+					return resp
+				}
+				pk, err := nostr.PubKeyFromHex(req.Args[0])
+				if err != nil {
+					resp.Error = fmt.Sprintf("invalid pubkey: %s", err)
+					return resp
+				}
+				for _, id := range targets {
+					if id.client(pk) == nil {
+						continue
+					}
+					*id.clients = slices.DeleteFunc(*id.clients, func(b BunkerConfigClient) bool { return b.PubKey == pk })
+					delete(id.approvedOnce, pk)
+					delete(id.lastActivity, pk)
+					resp.Revoked++
+				}
+				if resp.Revoked == 0 {
+					resp.Error = fmt.Sprintf("client %s not found", pk.Hex())
+					return resp
+				}
+				terminal.Log("* revoked client %s\n", pk.Hex())
+				if persist != nil {
+					persist()
+				}
+				setBunkerInfo()
+			case "rotate-secret":
+				id := targets[0]
+				// like the secret minted on startup this isn't persisted, it only lasts while we are running
+				id.newSecret = rand.Text()
+				terminal.Log("* rotated connection secret\n")
+				setBunkerInfo(id)
+				resp.Bunker = bunkerURI(id)
+			case "relays":
+			case "add-relays", "remove-relays":
+				updated := slices.Clone(config.Relays)
+				for _, arg := range req.Args {
+					url := nostr.NormalizeURL(arg)
+					if req.Command == "add-relays" {
+						if !slices.Contains(updated, url) {
+							updated = append(updated, url)
+						}
+					} else {
+						updated = slices.DeleteFunc(updated, func(u string) bool { return u == url })
+					}
+				}
+				if len(updated) == 0 {
+					resp.Error = "can't remove all relays"
+					return resp
 				}
+
+				// only touch the subscriptions once we know the change is valid
+				for _, url := range updated {
+					if !slices.Contains(config.Relays, url) {
+						subscribe(url)
+						terminal.Log("* added relay %s\n", url)
+					}
+				}
+				for _, url := range config.Relays {
+					if !slices.Contains(updated, url) {
+						unsubscribe(url)
+						terminal.Log("* removed relay %s\n", url)
+					}
+				}
+				config.Relays = updated
+				for _, id := range identities {
+					id.signer.DefaultRelays = config.Relays
+				}
+				if persist != nil {
+					persist()
+				}
+				// bunker uris have changed
+				setBunkerInfo(identities...)
+			default:
+				resp.Error = fmt.Sprintf("unknown command '%s'", req.Command)
+				return resp
 			}
+
+			resp.Relays = config.Relays
+			return resp
 		}
 
-		// unix socket nostrconnect:// handling
+		// unix socket handling, for nostrconnect:// uris and control commands
 		go func() {
-			for uri := range onSocketConnect(ctx, c, terminal.Log) {
+			for msg := range onSocketConnect(ctx, c, terminal.Log) {
+				if msg.control != nil {
+					msg.reply <- handleControl(*msg.control)
+					continue
+				}
+
+				uri := msg.uri
 				clientPublicKey, err := nostr.PubKeyFromHex(uri.Host)
 				if err != nil {
 					continue
 				}
 				terminal.Log("- got nostrconnect:// request from '%s': %s\n", color.New(color.Bold, color.FgBlue).Sprint(clientPublicKey.Hex()), uri.String())
 
+				// the identity this client is connecting to is given by `nak bunker connect --identity`
+				id := identities[0]
+				qs := uri.Query()
+				if name := qs.Get("identity"); name != "" {
+					idx := slices.IndexFunc(identities, func(id *bunkerIdentity) bool { return id.name == name })
+					if idx == -1 {
+						terminal.Log("* unknown identity '%s'\n", name)
+						continue
+					}
+					id = identities[idx]
+					qs.Del("identity")
+					uri.RawQuery = qs.Encode()
+				}
+
 				relays := uri.Query()["relay"]
 
 				// pre-authorize this client since the user has explicitly added it
 				mu.Lock()
 				clientAdded := false
-				if !slices.ContainsFunc(config.Clients, func(c BunkerConfigClient) bool {
-					return c.PubKey == clientPublicKey
-				}) {
-					config.Clients = append(config.Clients, BunkerConfigClient{
+				if client := id.client(clientPublicKey); client == nil || client.expired() {
+					authorizeClient(id, BunkerConfigClient{
 						PubKey:       clientPublicKey,
 						Name:         uri.Query().Get("name"),
 						URL:          uri.Query().Get("url"),
 						Icon:         uri.Query().Get("icon"),
 						CustomRelays: relays,
+						Permissions:  parseNIP46Perms(uri.Query().Get("perms")),
 					})
 					clientAdded = true
 				}
@@ -570,24 +1039,17 @@ var bunker = &cli.Command{
 				}
 				mu.Unlock()
 
-				resp, eventResponse, err := signer.HandleNostrConnectURI(ctx, uri)
+				resp, eventResponse, err := id.signer.HandleNostrConnectURI(ctx, uri)
 				if err != nil {
 					terminal.Log("* failed to handle: %s\n", err)
 					continue
 				}
 
-				go func() {
-					for event := range sys.Pool.SubscribeMany(ctx, relays, nostr.Filter{
-						Kinds:     []nostr.Kind{nostr.KindNostrConnect},
-						Tags:      nostr.TagMap{"p": []string{pubkey.Hex()}},
-						Since:     nostr.Now(),
-						LimitZero: true,
-					}, nostr.SubscriptionOptions{Label: "nak-bunker"}) {
-						// handle directly instead of forwarding into the main events
-						// channel, which is owned (and eventually closed) by the pool
-						go handleBunkerRequest(event)
-					}
-				}()
+				mu.Lock()
+				for _, url := range relays {
+					subscribe(nostr.NormalizeURL(url))
+				}
+				mu.Unlock()
 
 				time.Sleep(time.Millisecond * 25)
 				jresp, _ := json.MarshalIndent(resp, "", "  ")
@@ -602,13 +1064,22 @@ var bunker = &cli.Command{
 			}
 		}()
 
-		for ie := range events {
-			go handleBunkerRequest(ie)
+		mu.Lock()
+		for _, url := range allRelays {
+			subscribe(url)
 		}
+		mu.Unlock()
 
+		<-ctx.Done()
 		return nil
 	},
 	Commands: []*cli.Command{
+		bunkerLog,
+		bunkerClient,
+		bunkerClients,
+		bunkerRevoke,
+		bunkerRotateSecret,
+		bunkerRelays,
 		{
 			Name:      "connect",
 			Usage:     "use the client-initiated NostrConnect flow of NIP46",
@@ -618,13 +1089,29 @@ var bunker = &cli.Command{
 					Name:  "profile",
 					Usage: "profile name of the bunker to connect to",
 				},
+				&cli.StringFlag{
+					Name:  "target-identity",
+					Usage: "name of the identity (served with --identity) the client should be connected to, instead of the main key",
+				},
 			},
 			Action: func(ctx context.Context, c *cli.Command) error {
 				if c.Args().Len() != 1 {
 					return fmt.Errorf("must be called with a nostrconnect://... uri")
 				}
 
-				if err := sendToSocket(c, c.Args().First()); err != nil {
+				uri := c.Args().First()
+				if name := c.String("target-identity"); name != "" {
+					parsed, err := url.Parse(uri)
+					if err != nil {
+						return fmt.Errorf("invalid uri: %w", err)
+					}
+					qs := parsed.Query()
+					qs.Set("identity", name)
+					parsed.RawQuery = qs.Encode()
+					uri = parsed.String()
+				}
+
+				if err := sendToSocket(c, uri); err != nil {
 					return fmt.Errorf("failed to connect to running bunker: %w", err)
 				}
 
@@ -639,16 +1126,72 @@ type BunkerConfig struct {
 	Secret  plainOrEncryptedKey  `json:"sec"`
 	Relays  []string             `json:"relays"`
 
+	// other keys served by the same bunker, each with its own clients
+	Identities []BunkerConfigIdentity `json:"identities,omitempty"`
+
 	// deprecated
 	AuthorizedKeys []nostr.PubKey `json:"authorized-keys,omitempty"`
 }
 
+type BunkerConfigIdentity struct {
+	Name    string               `json:"name"`
+	Secret  plainOrEncryptedKey  `json:"sec"`
+	Clients []BunkerConfigClient `json:"clients"`
+}
+
+// bunkerIdentity is one of the keys served by a running bunker
+type bunkerIdentity struct {
+	name    string
+	sec     nostr.SecretKey
+	pubkey  nostr.PubKey
+	signer  *nip46.StaticKeySigner
+	clients *[]BunkerConfigClient
+
+	// used to auto-authorize the next client who connects who isn't pre-authorized
+	newSecret string
+
+	// clients approved once by the operator, consumed by AuthorizeRequest
+	approvedOnce map[nostr.PubKey]int
+
+	// when each client last made a request, only kept in memory
+	lastActivity map[nostr.PubKey]nostr.Timestamp
+}
+
+func newBunkerIdentity(name string, sec nostr.SecretKey, clients *[]BunkerConfigClient) *bunkerIdentity {
+	return &bunkerIdentity{
+		name:         name,
+		sec:          sec,
+		pubkey:       sec.Public(),
+		signer:       nip46.NewStaticKeySigner(sec),
+		clients:      clients,
+		newSecret:    rand.Text(),
+		approvedOnce: make(map[nostr.PubKey]int),
+		lastActivity: make(map[nostr.PubKey]nostr.Timestamp),
+	}
+}
+
+func (id *bunkerIdentity) client(pubkey nostr.PubKey) *BunkerConfigClient {
+	for i := range *id.clients {
+		if (*id.clients)[i].PubKey == pubkey {
+			return &(*id.clients)[i]
+		}
+	}
+	return nil
+}
+
 type BunkerConfigClient struct {
 	PubKey       nostr.PubKey `json:"pubkey"`
 	Name         string       `json:"name,omitempty"`
 	URL          string       `json:"url,omitempty"`
 	Icon         string       `json:"icon,omitempty"`
 	CustomRelays []string     `json:"custom_relays,omitempty"`
+
+	Permissions *BunkerPermissions `json:"permissions,omitempty"`
+	Expires     nostr.Timestamp    `json:"expires,omitempty"`
+}
+
+func (bc BunkerConfigClient) expired() bool {
+	return bc.Expires != 0 && bc.Expires < nostr.Now()
 }
 
 type plainOrEncryptedKey struct {
@@ -719,35 +1262,76 @@ func (a plainOrEncryptedKey) equals(b plainOrEncryptedKey) bool {
 	return true
 }
 
-func getSocketPath(c *cli.Command) string {
+// getSocketPath returns the path of the socket for the current profile under one of our directories
+// in the config path, like "bunkerconn" or "agent"
+func getSocketPath(c *cli.Command, dir string) string {
 	profile := "default"
 	if c.IsSet("profile") {
 		profile = c.String("profile")
 	}
-	return filepath.Join(c.String("config-path"), "bunkerconn", profile)
+	return filepath.Join(c.String("config-path"), dir, profile)
 }
 
-func onSocketConnect(ctx context.Context, c *cli.Command, log func(string, ...any)) chan *url.URL {
-	res := make(chan *url.URL)
-	socketPath := getSocketPath(c)
-
-	// ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
-		log(color.RedString("failed to create socket directory: %s\n", err))
-		return res
+// listenOnSocket listens on a unix socket inside a directory no other user can access, so nobody can
+// connect to it in the moment between its creation and setting its permissions. our own directories
+// under the config path are made private, any other must already be. a stale socket file is replaced,
+// but not one that is still being listened on.
+func listenOnSocket(c *cli.Command, socketPath string) (net.Listener, error) {
+	dir := filepath.Dir(socketPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if filepath.Dir(dir) == filepath.Clean(c.String("config-path")) {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to set socket directory permissions: %w", err)
+		}
+	} else if runtime.GOOS != "windows" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check socket directory: %w", err)
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			return nil, fmt.Errorf("%s can be accessed by other users, put the socket in a directory only you can access", dir)
+		}
 	}
 
-	// delete existing socket file if it exists
 	if _, err := os.Stat(socketPath); err == nil {
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("something is already listening on %s", socketPath)
+		}
 		if err := os.Remove(socketPath); err != nil {
-			log(color.RedString("failed to remove existing socket file: %s\n", err))
-			return res
+			return nil, fmt.Errorf("failed to remove existing socket file: %w", err)
 		}
 	}
 
 	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
-		log(color.RedString("failed to listen on unix socket %s: %s\n", socketPath, err))
+		return nil, fmt.Errorf("failed to listen on unix socket %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+
+	return listener, nil
+}
+
+// bunkerSocketMessage is either a nostrconnect:// uri sent by `nak bunker connect` or a control
+// command, which must be answered through reply
+type bunkerSocketMessage struct {
+	uri     *url.URL
+	control *bunkerControlRequest
+	reply   chan bunkerControlResponse
+}
+
+func onSocketConnect(ctx context.Context, c *cli.Command, log func(string, ...any)) chan bunkerSocketMessage {
+	res := make(chan bunkerSocketMessage)
+	socketPath := getSocketPath(c, "bunkerconn")
+
+	listener, err := listenOnSocket(c, socketPath)
+	if err != nil {
+		log(color.RedString("%s\n", err))
 		return res
 	}
 
@@ -777,9 +1361,21 @@ func onSocketConnect(ctx context.Context, c *cli.Command, log func(string, ...an
 						break
 					}
 
+					if buf[0] == '{' {
+						var req bunkerControlRequest
+						if err := json.Unmarshal(buf[:n], &req); err != nil {
+							continue
+						}
+						reply := make(chan bunkerControlResponse, 1)
+						res <- bunkerSocketMessage{control: &req, reply: reply}
+						data, _ := json.Marshal(<-reply)
+						conn.Write(append(data, '\n'))
+						continue
+					}
+
 					uri, err := url.Parse(string(buf[:n]))
 					if err == nil && uri.Scheme == "nostrconnect" {
-						res <- uri
+						res <- bunkerSocketMessage{uri: uri}
 					}
 				}
 			}(conn)
@@ -790,7 +1386,7 @@ func onSocketConnect(ctx context.Context, c *cli.Command, log func(string, ...an
 }
 
 func sendToSocket(c *cli.Command, value string) error {
-	socketPath := getSocketPath(c)
+	socketPath := getSocketPath(c, "bunkerconn")
 
 	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
 	if err != nil {
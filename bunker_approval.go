@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip19"
+	"github.com/fatih/color"
+	"github.com/mattn/go-tty/v2"
+)
+
+type bunkerApproval int
+
+const (
+	approvalDenied bunkerApproval = iota
+	approvalOnce
+	approvalAlways
+)
+
+// how long a request waits for the operator before being denied
+const bunkerApprovalTimeout = 5 * time.Minute
+
+type bunkerPendingRequest struct {
+	token   string
+	from    nostr.PubKey
+	req     bunkerRequest
+	reason  string
+	decided chan bunkerApproval
+}
+
+// bunkerApprovals is the queue of requests waiting for the operator to decide on them,
+// either by pressing keys on the terminal or, when there is no terminal, through an auth_url page.
+// the client gets the link to that page too, so deciding there requires logging in with a password
+// that is only printed on the bunker terminal.
+type bunkerApprovals struct {
+	mu       sync.Mutex
+	pending  []*bunkerPendingRequest
+	onChange func()
+
+	// set when serving approvals over http instead of the terminal
+	baseURL  string
+	password string
+	sessions map[string]struct{}
+}
+
+// ask puts a request on the queue and waits for a decision. when approving over http
+// challenge is called right away with the url that should be sent to the client as an auth_url.
+func (ba *bunkerApprovals) ask(
+	ctx context.Context,
+	from nostr.PubKey,
+	req bunkerRequest,
+	reason string,
+	challenge func(url string),
+) bunkerApproval {
+	pr := &bunkerPendingRequest{
+		token:   rand.Text(),
+		from:    from,
+		req:     req,
+		reason:  reason,
+		decided: make(chan bunkerApproval, 1),
+	}
+
+	ba.mu.Lock()
+	ba.pending = append(ba.pending, pr)
+	ba.mu.Unlock()
+	ba.onChange()
+
+	if ba.baseURL != "" {
+		challenge(ba.baseURL + "/" + pr.token)
+	}
+
+	decision := approvalDenied
+	select {
+	case decision = <-pr.decided:
+	case <-time.After(bunkerApprovalTimeout):
+	case <-ctx.Done():
+	}
+
+	ba.mu.Lock()
+	ba.pending = slices.DeleteFunc(ba.pending, func(p *bunkerPendingRequest) bool { return p == pr })
+	ba.mu.Unlock()
+	ba.onChange()
+
+	return decision
+}
+
+func (ba *bunkerApprovals) decide(token string, decision bunkerApproval) bool {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+
+	for _, pr := range ba.pending {
+		if pr.token == token || (token == "" && pr == ba.pending[0]) {
+			select {
+			case pr.decided <- decision:
+				return true
+			default:
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// footer renders the queue to be appended to the bunker terminal footer
+func (ba *bunkerApprovals) footer() string {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+
+	if len(ba.pending) == 0 {
+		return ""
+	}
+
+	str := "\n  " + color.YellowString("pending requests:")
+	for i, pr := range ba.pending {
+		line := fmt.Sprintf("\n    [%d] %s %s (%s)", i+1, shortenNpub(pr.from), describeBunkerRequest(pr.req), pr.reason)
+		if i == 0 {
+			line = colors.bold(line)
+		}
+		str += line
+	}
+	if ba.baseURL == "" {
+		str += "\n  press " + colors.bold("y") + " to approve the first once, " +
+			colors.bold("a") + " to always approve it, " +
+			colors.bold("n") + " to deny it"
+	}
+	return str
+}
+
+// readKeys handles the operator key presses on the terminal, returns an error if there is no terminal
+func (ba *bunkerApprovals) readKeys(ctx context.Context) error {
+	t, err := tty.Open()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		t.Close()
+	}()
+
+	go func() {
+		for {
+			r, err := t.ReadRune()
+			if err != nil {
+				return
+			}
+			switch r {
+			case 'y', 'Y':
+				ba.decide("", approvalOnce)
+			case 'a', 'A':
+				ba.decide("", approvalAlways)
+			case 'n', 'N':
+				ba.decide("", approvalDenied)
+			}
+		}
+	}()
+
+	return nil
+}
+
+const bunkerOperatorCookie = "nak-bunker-operator"
+
+// serveHTTP starts the page that auth_url links point to. anyone with the link can see the request,
+// but only who logs in with the password printed on the terminal can decide on it.
+func (ba *bunkerApprovals) serveHTTP(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	ba.baseURL = "http://" + listener.Addr().String() + "/approve"
+	ba.password = rand.Text()
+	ba.sessions = make(map[string]struct{})
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" && r.Method == http.MethodPost {
+			next := r.FormValue("next")
+			if !strings.HasPrefix(next, "/approve/") {
+				next = "/approve/"
+			}
+			if subtle.ConstantTimeCompare([]byte(r.FormValue("password")), []byte(ba.password)) != 1 {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, loginPage(next, "wrong password"))
+				return
+			}
+			session := rand.Text()
+			ba.mu.Lock()
+			ba.sessions[session] = struct{}{}
+			ba.mu.Unlock()
+			http.SetCookie(w, &http.Cookie{
+				Name:     bunkerOperatorCookie,
+				Value:    session,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.URL.Path, "/approve/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !ba.isOperator(r) {
+			if r.Method == http.MethodPost {
+				http.Error(w, "only the bunker operator can decide on requests", http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, loginPage(r.URL.Path, ""))
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			decision := approvalDenied
+			switch r.FormValue("decision") {
+			case "once":
+				decision = approvalOnce
+			case "always":
+				decision = approvalAlways
+			}
+			if token == "" || !ba.decide(token, decision) {
+				http.Error(w, "request not found or already decided", http.StatusNotFound)
+				return
+			}
+			http.Redirect(w, r, "/approve/", http.StatusSeeOther)
+			return
+		}
+
+		// the page for a single request, or all of them
+		ba.mu.Lock()
+		pending := slices.Clone(ba.pending)
+		ba.mu.Unlock()
+		if token != "" {
+			pending = slices.DeleteFunc(pending, func(pr *bunkerPendingRequest) bool { return pr.token != token })
+		}
+
+		page := strings.Builder{}
+		page.WriteString("<!doctype html>")
+		if len(pending) == 0 {
+			page.WriteString(`<p>no pending requests. <a href="/approve/">see all</a></p>`)
+		}
+		for _, pr := range pending {
+			preview := ""
+			if pr.req.Method == "sign_event" && len(pr.req.Params) > 0 {
+				preview = "<pre>" + html.EscapeString(pr.req.Params[0]) + "</pre>"
+			}
+			fmt.Fprintf(&page, `
+<p><b>%s</b> wants to <b>%s</b> (%s)</p>
+%s
+<form method="post" action="/approve/%s">
+  <button name="decision" value="once">approve once</button>
+  <button name="decision" value="always">always approve</button>
+  <button name="decision" value="deny">deny</button>
+</form>`,
+				html.EscapeString(nip19.EncodeNpub(pr.from)),
+				html.EscapeString(describeBunkerRequest(pr.req)),
+				html.EscapeString(pr.reason),
+				preview,
+				pr.token,
+			)
+		}
+		fmt.Fprint(w, page.String())
+	})}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go server.Serve(listener)
+
+	return nil
+}
+
+func (ba *bunkerApprovals) isOperator(r *http.Request) bool {
+	cookie, err := r.Cookie(bunkerOperatorCookie)
+	if err != nil {
+		return false
+	}
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	_, ok := ba.sessions[cookie.Value]
+	return ok
+}
+
+func loginPage(next string, problem string) string {
+	if problem != "" {
+		problem = "<p>" + html.EscapeString(problem) + "</p>"
+	}
+	return fmt.Sprintf(`<!doctype html>
+%s
+<p>type the password shown on the bunker terminal to decide on this request:</p>
+<form method="post" action="/login">
+  <input type="hidden" name="next" value="%s">
+  <input type="password" name="password" autofocus>
+  <button>log in</button>
+</form>`, problem, html.EscapeString(next))
+}
+
+// describeBunkerRequest is a one-line preview of what a request wants to do
+func describeBunkerRequest(req bunkerRequest) string {
+	switch req.Method {
+	case "sign_event":
+		if len(req.Params) == 0 {
+			break
+		}
+		var evt nostr.Event
+		if err := json.Unmarshal([]byte(req.Params[0]), &evt); err != nil {
+			break
+		}
+		content := strings.ReplaceAll(evt.Content, "\n", " ")
+		return fmt.Sprintf("sign_event kind %d: %q", evt.Kind, clampWithEllipsis(content, 60))
+	case "nip04_encrypt", "nip04_decrypt", "nip44_encrypt", "nip44_decrypt":
+		if len(req.Params) == 0 {
+			break
+		}
+		if peer, err := nostr.PubKeyFromHex(req.Params[0]); err == nil {
+			return req.Method + " with " + shortenNpub(peer)
+		}
+	}
+	return req.Method
+}
+
+func shortenNpub(pk nostr.PubKey) string {
+	npub := nip19.EncodeNpub(pk)
+	return npub[0:12] + "…" + npub[len(npub)-6:]
+}
+
+// allow extends the permissions so they include what the request asks for
+func (p *BunkerPermissions) allow(req bunkerRequest) {
+	if len(p.Methods) > 0 && !slices.Contains(p.Methods, req.Method) {
+		p.Methods = append(p.Methods, req.Method)
+	}
+
+	switch req.Method {
+	case "sign_event":
+		if len(p.Kinds) == 0 || len(req.Params) == 0 {
+			return
+		}
+		var evt struct {
+			Kind nostr.Kind `json:"kind"`
+		}
+		if err := json.Unmarshal([]byte(req.Params[0]), &evt); err == nil && !slices.Contains(p.Kinds, evt.Kind) {
+			p.Kinds = append(p.Kinds, evt.Kind)
+		}
+	case "nip04_encrypt", "nip04_decrypt", "nip44_encrypt", "nip44_decrypt":
+		if len(p.Peers) == 0 || len(req.Params) == 0 {
+			return
+		}
+		if peer, err := nostr.PubKeyFromHex(req.Params[0]); err == nil && !slices.Contains(p.Peers, peer) {
+			p.Peers = append(p.Peers, peer)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	"fiatjaf.com/nostr"
+	"github.com/urfave/cli/v3"
+)
+
+// bunkerAuditRecord is one line in the --audit-log file
+type bunkerAuditRecord struct {
+	Time     nostr.Timestamp `json:"time"`
+	Identity nostr.PubKey    `json:"identity"`
+	Client   nostr.PubKey    `json:"client"`
+	Name     string          `json:"name,omitempty"`
+	Method   string          `json:"method"`
+	Kind     *nostr.Kind     `json:"kind,omitempty"`
+	EventID  string          `json:"event_id,omitempty"`
+	Decision string          `json:"decision"`
+	Reason   string          `json:"reason,omitempty"`
+	Relays   []string        `json:"relays,omitempty"`
+}
+
+type bunkerAuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openBunkerAuditLog(path string) (*bunkerAuditLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &bunkerAuditLog{file: file}, nil
+}
+
+// write appends a record, it can be called on a nil log when --audit-log isn't set
+func (al *bunkerAuditLog) write(rec bunkerAuditRecord) {
+	if al == nil {
+		return
+	}
+
+	rec.Time = nostr.Now()
+	data, _ := json.Marshal(rec)
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if _, err := al.file.Write(append(data, '\n')); err != nil {
+		log("failed to write to audit log: %s\n", err)
+	}
+}
+
+func (al *bunkerAuditLog) close() {
+	if al != nil {
+		al.file.Close()
+	}
+}
+
+var bunkerLog = &cli.Command{
+	Name:  "log",
+	Usage: "queries the audit log written by 'nak bunker --audit-log'",
+	Description: `prints the matching records as json lines.
+
+example:
+		nak bunker log ~/bunker-audit.jsonl --method sign_event --since '2 days ago'
+		nak bunker log ~/bunker-audit.jsonl --client npub1... --decision denied`,
+	ArgsUsage:                 "<audit-log-file>",
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&PubKeySliceFlag{
+			Name:  "client",
+			Usage: "only records from this client pubkey",
+		},
+		&PubKeySliceFlag{
+			Name:  "signer",
+			Usage: "only records for this bunker pubkey (when serving more than one identity)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "method",
+			Usage: "only records for this method (e.g. sign_event, nip44_decrypt)",
+		},
+		&KindSliceFlag{
+			Name:    "kind",
+			Aliases: []string{"k"},
+			Usage:   "only sign_event records for this event kind",
+		},
+		&cli.StringSliceFlag{
+			Name:  "decision",
+			Usage: "only records with this decision (allowed, approved, denied, rejected, failed)",
+		},
+		&NaturalTimeFlag{
+			Name:    "since",
+			Aliases: []string{"s"},
+			Usage:   "only records newer than this",
+		},
+		&NaturalTimeFlag{
+			Name:    "until",
+			Aliases: []string{"u"},
+			Usage:   "only records older than this",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		if c.Args().Len() != 1 {
+			return fmt.Errorf("must be called with the path of the audit log file")
+		}
+
+		file, err := os.Open(c.Args().First())
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		defer file.Close()
+
+		clients := getPubKeySlice(c, "client")
+		signers := getPubKeySlice(c, "signer")
+		methods := c.StringSlice("method")
+		kinds := getKindSlice(c, "kind")
+		decisions := c.StringSlice("decision")
+		since := getNaturalDate(c, "since")
+		until := getNaturalDate(c, "until")
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var rec bunkerAuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				ctx = lineProcessingError(ctx, "invalid audit record: %s", err)
+				continue
+			}
+
+			if len(clients) > 0 && !slices.Contains(clients, rec.Client) {
+				continue
+			}
+			if len(signers) > 0 && !slices.Contains(signers, rec.Identity) {
+				continue
+			}
+			if len(methods) > 0 && !slices.Contains(methods, rec.Method) {
+				continue
+			}
+			if len(kinds) > 0 && (rec.Kind == nil || !slices.Contains(kinds, *rec.Kind)) {
+				continue
+			}
+			if len(decisions) > 0 && !slices.Contains(decisions, rec.Decision) {
+				continue
+			}
+			if since != 0 && rec.Time < since {
+				continue
+			}
+			if until != 0 && rec.Time > until {
+				continue
+			}
+
+			stdout(scanner.Text())
+		}
+
+		exitIfLineProcessingError(ctx)
+		return scanner.Err()
+	},
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip04"
+	"fiatjaf.com/nostr/nip44"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+)
+
+var bunkerClient = &cli.Command{
+	Name:  "client",
+	Usage: "calls nip46 methods on a remote signer and prints the raw requests and responses",
+	Description: `the request is printed to stderr and the raw response to stdout, along with the round-trip time.
+
+a "connect" request (with the secret from the uri, if any) is sent first unless --no-connect is given. the client key is the one from --connect-as (or the default key), so once authorized it stays authorized.
+
+pubkey parameters for the encrypt/decrypt methods can be given as npub. if the sign_event parameter is missing the event is read from stdin.
+
+example:
+		nak bunker client 'bunker://...' ping
+		nak bunker client 'bunker://...' nip44_encrypt npub1... 'hello'
+		echo '{"kind":1,"content":"test","tags":[],"created_at":1700000000}' | nak bunker client 'bunker://...' sign_event
+		nak bunker client conformance 'bunker://...'`,
+	ArgsUsage:                 "<bunker-uri> <method> [param...]",
+	DisableSliceFlagSeparator: true,
+	Flags:                     bunkerClientFlags,
+	Action: func(ctx context.Context, c *cli.Command) error {
+		if c.Args().Len() < 2 {
+			return fmt.Errorf("must be called with a bunker uri and a method")
+		}
+		method := c.Args().Get(1)
+		params := c.Args().Slice()[2:]
+
+		switch method {
+		case "nip04_encrypt", "nip04_decrypt", "nip44_encrypt", "nip44_decrypt":
+			if len(params) > 0 {
+				pk, err := parsePubKey(params[0])
+				if err != nil {
+					return err
+				}
+				params[0] = pk.Hex()
+			}
+		case "sign_event":
+			if len(params) == 0 {
+				for stdinEvent := range getJsonsOrBlank() {
+					params = []string{stdinEvent}
+					break
+				}
+			}
+		}
+
+		rc, err := newNIP46RawClient(ctx, c, c.Args().First())
+		if err != nil {
+			return err
+		}
+
+		if !c.Bool("no-connect") && method != "connect" {
+			if _, err := rc.callAndPrint(ctx, "connect", rc.connectParams()); err != nil {
+				return err
+			}
+		}
+
+		res, err := rc.callAndPrint(ctx, method, params)
+		if err != nil {
+			return err
+		}
+		stdout(res.raw)
+
+		if res.resp.Error != "" {
+			return fmt.Errorf("signer returned an error: %s", res.resp.Error)
+		}
+		return nil
+	},
+	Commands: []*cli.Command{
+		{
+			Name:  "conformance",
+			Usage: "checks if a remote signer behaves as nip46 says it should",
+			Description: `runs through connect, ping, get_public_key, sign_event and the encryption methods, checking the results.
+
+failures in required behavior make the command exit with an error, optional methods only produce warnings.`,
+			ArgsUsage:                 "<bunker-uri>",
+			DisableSliceFlagSeparator: true,
+			Flags:                     bunkerClientFlags,
+			Action: func(ctx context.Context, c *cli.Command) error {
+				rc, err := newNIP46RawClient(ctx, c, c.Args().First())
+				if err != nil {
+					return err
+				}
+				return runBunkerConformance(ctx, rc)
+			},
+		},
+	},
+}
+
+var bunkerClientFlags = []cli.Flag{
+	&cli.DurationFlag{
+		Name:  "timeout",
+		Usage: "how long to wait for each response",
+		Value: time.Second * 30,
+	},
+	&cli.BoolFlag{
+		Name:  "no-connect",
+		Usage: "don't send a connect request before the method",
+	},
+}
+
+type nip46RawResponse struct {
+	raw     string
+	resp    bunkerResponse
+	isNIP04 bool
+}
+
+// nip46RawClient talks to a remote signer without any of the conveniences of nip46.BunkerClient,
+// so we can see exactly what is being sent and received
+type nip46RawClient struct {
+	clientKey nostr.SecretKey
+	signer    nostr.PubKey
+	relays    []string
+	secret    string
+	timeout   time.Duration
+	ck        [32]byte
+
+	mu      sync.Mutex
+	waiting map[string]chan nip46RawResponse
+}
+
+func newNIP46RawClient(ctx context.Context, c *cli.Command, bunkerURI string) (*nip46RawClient, error) {
+	u, err := url.Parse(bunkerURI)
+	if err != nil || u.Scheme != "bunker" {
+		return nil, fmt.Errorf("invalid bunker uri '%s'", bunkerURI)
+	}
+	signer, err := nostr.PubKeyFromHex(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signer pubkey in bunker uri: %w", err)
+	}
+	relays := u.Query()["relay"]
+	if len(relays) == 0 {
+		return nil, fmt.Errorf("bunker uri has no relays")
+	}
+	for i, r := range relays {
+		relays[i] = nostr.NormalizeURL(r)
+	}
+
+	rc := &nip46RawClient{
+		clientKey: getSecretKey(c, "connect-as"),
+		signer:    signer,
+		relays:    relays,
+		secret:    u.Query().Get("secret"),
+		timeout:   c.Duration("timeout"),
+		waiting:   make(map[string]chan nip46RawResponse),
+	}
+	rc.ck, err = nip44.GenerateConversationKey(signer, rc.clientKey)
+	if err != nil {
+		return nil, err
+	}
+
+	logverbose("using client key %s\n", rc.clientKey.Public().Hex())
+
+	go func() {
+		for ie := range sys.Pool.SubscribeMany(ctx, relays, nostr.Filter{
+			Kinds:     []nostr.Kind{nostr.KindNostrConnect},
+			Authors:   []nostr.PubKey{signer},
+			Tags:      nostr.TagMap{"p": []string{rc.clientKey.Public().Hex()}},
+			Since:     nostr.Now(),
+			LimitZero: true,
+		}, nostr.SubscriptionOptions{Label: "nak-bunker-client"}) {
+			res := nip46RawResponse{}
+			if strings.Contains(ie.Event.Content, "?iv=") {
+				res.isNIP04 = true
+				ss, err := nip04.ComputeSharedSecret(signer, rc.clientKey)
+				if err != nil {
+					continue
+				}
+				res.raw, err = nip04.Decrypt(ie.Event.Content, ss)
+				if err != nil {
+					logverbose("failed to decrypt nip04 response %s: %s\n", ie.Event.ID, err)
+					continue
+				}
+			} else {
+				res.raw, err = nip44.Decrypt(ie.Event.Content, rc.ck)
+				if err != nil {
+					logverbose("failed to decrypt response %s: %s\n", ie.Event.ID, err)
+					continue
+				}
+			}
+			if err := json.Unmarshal([]byte(res.raw), &res.resp); err != nil {
+				logverbose("invalid response %s: %s\n", res.raw, err)
+				continue
+			}
+
+			rc.mu.Lock()
+			ch, ok := rc.waiting[res.resp.ID]
+			rc.mu.Unlock()
+			if ok {
+				select {
+				case ch <- res:
+				default:
+				}
+			}
+		}
+	}()
+
+	return rc, nil
+}
+
+func (rc *nip46RawClient) connectParams() []string {
+	params := []string{rc.signer.Hex()}
+	if rc.secret != "" {
+		params = append(params, rc.secret)
+	}
+	return params
+}
+
+// call sends a request and waits for the response, calling onAuthURL if the signer asks for
+// the user to go somewhere first (in which case it keeps waiting for the real response)
+func (rc *nip46RawClient) call(
+	ctx context.Context,
+	method string,
+	params []string,
+	onRequest func(raw string),
+	onAuthURL func(url string),
+) (nip46RawResponse, time.Duration, error) {
+	if params == nil {
+		params = []string{}
+	}
+	req := bunkerRequest{ID: randString(12), Method: method, Params: params}
+	raw, _ := json.Marshal(req)
+	if onRequest != nil {
+		onRequest(string(raw))
+	}
+
+	ciphertext, err := nip44.Encrypt(string(raw), rc.ck)
+	if err != nil {
+		return nip46RawResponse{}, 0, err
+	}
+	evt := nostr.Event{
+		Kind:      nostr.KindNostrConnect,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", rc.signer.Hex()}},
+		Content:   ciphertext,
+	}
+	if err := evt.Sign(rc.clientKey); err != nil {
+		return nip46RawResponse{}, 0, err
+	}
+
+	ch := make(chan nip46RawResponse, 1)
+	rc.mu.Lock()
+	rc.waiting[req.ID] = ch
+	rc.mu.Unlock()
+	defer func() {
+		rc.mu.Lock()
+		delete(rc.waiting, req.ID)
+		rc.mu.Unlock()
+	}()
+
+	start := time.Now()
+	published := false
+	for res := range sys.Pool.PublishMany(ctx, rc.relays, evt) {
+		if res.Error == nil {
+			published = true
+			logverbose("sent request %s through %s\n", evt.ID, res.RelayURL)
+		} else {
+			logverbose("failed to send request through %s: %s\n", res.RelayURL, res.Error)
+		}
+	}
+	if !published {
+		return nip46RawResponse{}, 0, fmt.Errorf("failed to send request to any of %v", rc.relays)
+	}
+
+	timeout := time.After(rc.timeout)
+	for {
+		select {
+		case res := <-ch:
+			if res.resp.Result == "auth_url" {
+				if onAuthURL != nil {
+					onAuthURL(res.resp.Error)
+				}
+				// give the user more time to do whatever they have to do
+				timeout = time.After(rc.timeout + 2*time.Minute)
+				continue
+			}
+			return res, time.Since(start), nil
+		case <-timeout:
+			return nip46RawResponse{}, time.Since(start), fmt.Errorf("no response to '%s' after %s", method, time.Since(start).Round(time.Millisecond))
+		case <-ctx.Done():
+			return nip46RawResponse{}, time.Since(start), context.Cause(ctx)
+		}
+	}
+}
+
+func (rc *nip46RawClient) callAndPrint(ctx context.Context, method string, params []string) (nip46RawResponse, error) {
+	res, latency, err := rc.call(ctx, method, params,
+		func(raw string) { log("%s %s\n", color.YellowString(">"), raw) },
+		func(url string) { log(color.CyanString("signer asks to open %s\n"), url) },
+	)
+	if err != nil {
+		return res, err
+	}
+	log("%s %s %s\n", color.GreenString("<"), res.raw, color.HiBlackString("(%s)", latency.Round(time.Millisecond)))
+	return res, nil
+}
+
+func runBunkerConformance(ctx context.Context, rc *nip46RawClient) error {
+	failures := 0
+	check := func(required bool, name string, latency time.Duration, err error) bool {
+		timing := color.HiBlackString("(%s)", latency.Round(time.Millisecond))
+		switch {
+		case err == nil:
+			log("%s %s %s\n", color.GreenString("✓"), name, timing)
+			return true
+		case required:
+			failures++
+			log("%s %s: %s %s\n", color.RedString("✗"), name, err, timing)
+		default:
+			log("%s %s: %s %s\n", color.YellowString("!"), name, err, timing)
+		}
+		return false
+	}
+	call := func(method string, params ...string) (bunkerResponse, time.Duration, error) {
+		res, latency, err := rc.call(ctx, method, params, func(raw string) { logverbose("> %s\n", raw) },
+			func(url string) { log(color.CyanString("signer asks to open %s\n"), url) })
+		if err != nil {
+			return res.resp, latency, err
+		}
+		logverbose("< %s\n", res.raw)
+		if res.isNIP04 {
+			log("%s %s responded with nip04 encryption instead of nip44\n", color.YellowString("!"), method)
+		}
+		if res.resp.Error != "" {
+			return res.resp, latency, fmt.Errorf("error: %s", res.resp.Error)
+		}
+		return res.resp, latency, nil
+	}
+
+	// connect
+	resp, latency, err := call("connect", rc.connectParams()...)
+	if err == nil && resp.Result != "ack" && (rc.secret == "" || resp.Result != rc.secret) {
+		err = fmt.Errorf("expected 'ack', got '%s'", resp.Result)
+	}
+	if !check(true, "connect", latency, err) {
+		return fmt.Errorf("can't go on without connecting")
+	}
+
+	// ping
+	resp, latency, err = call("ping")
+	if err == nil && resp.Result != "pong" {
+		err = fmt.Errorf("expected 'pong', got '%s'", resp.Result)
+	}
+	check(true, "ping", latency, err)
+
+	// get_public_key
+	var user nostr.PubKey
+	resp, latency, err = call("get_public_key")
+	if err == nil {
+		user, err = nostr.PubKeyFromHex(resp.Result)
+		if err != nil {
+			err = fmt.Errorf("expected a hex pubkey, got '%s'", resp.Result)
+		}
+	}
+	if !check(true, "get_public_key", latency, err) {
+		return fmt.Errorf("can't go on without the user pubkey")
+	}
+	if user == rc.signer {
+		log("%s the user pubkey is the same as the signer pubkey, which is allowed but not recommended\n", color.YellowString("!"))
+	}
+
+	// sign_event
+	unsigned := nostr.Event{
+		Kind:      1,
+		CreatedAt: nostr.Now() - 60,
+		Tags:      nostr.Tags{{"t", "nak-conformance"}},
+		Content:   "nip46 conformance test from nak, " + randString(8),
+	}
+	unsignedJSON, _ := json.Marshal(struct {
+		Kind      nostr.Kind      `json:"kind"`
+		Content   string          `json:"content"`
+		Tags      nostr.Tags      `json:"tags"`
+		CreatedAt nostr.Timestamp `json:"created_at"`
+	}{unsigned.Kind, unsigned.Content, unsigned.Tags, unsigned.CreatedAt})
+	resp, latency, err = call("sign_event", string(unsignedJSON))
+	if err == nil {
+		var signed nostr.Event
+		if err = json.Unmarshal([]byte(resp.Result), &signed); err != nil {
+			err = fmt.Errorf("result is not an event: %w", err)
+		} else if signed.PubKey != user {
+			err = fmt.Errorf("signed by %s instead of the user pubkey", signed.PubKey.Hex())
+		} else if signed.Kind != unsigned.Kind || signed.Content != unsigned.Content ||
+			signed.CreatedAt != unsigned.CreatedAt || len(signed.Tags) != len(unsigned.Tags) {
+			err = fmt.Errorf("event was modified")
+		} else if signed.ID != signed.GetID() {
+			err = fmt.Errorf("wrong id")
+		} else if !signed.VerifySignature() {
+			err = fmt.Errorf("invalid signature")
+		}
+	}
+	check(true, "sign_event", latency, err)
+
+	// encryption, checked against a throwaway peer key that we control
+	peer := nostr.Generate()
+	plaintext := "conformance " + randString(16)
+
+	resp, latency, err = call("nip44_encrypt", peer.Public().Hex(), plaintext)
+	if err == nil {
+		var ck [32]byte
+		if ck, err = nip44.GenerateConversationKey(user, peer); err == nil {
+			var decrypted string
+			if decrypted, err = nip44.Decrypt(resp.Result, ck); err == nil && decrypted != plaintext {
+				err = fmt.Errorf("ciphertext doesn't decrypt to the plaintext")
+			}
+		}
+	}
+	check(true, "nip44_encrypt", latency, err)
+
+	if ck, err := nip44.GenerateConversationKey(user, peer); err == nil {
+		ciphertext, _ := nip44.Encrypt(plaintext, ck)
+		resp, latency, err = call("nip44_decrypt", peer.Public().Hex(), ciphertext)
+		if err == nil && resp.Result != plaintext {
+			err = fmt.Errorf("expected '%s', got '%s'", plaintext, resp.Result)
+		}
+		check(true, "nip44_decrypt", latency, err)
+	}
+
+	resp, latency, err = call("nip04_encrypt", peer.Public().Hex(), plaintext)
+	if err == nil {
+		var ss []byte
+		if ss, err = nip04.ComputeSharedSecret(user, peer); err == nil {
+			var decrypted string
+			if decrypted, err = nip04.Decrypt(resp.Result, ss); err == nil && decrypted != plaintext {
+				err = fmt.Errorf("ciphertext doesn't decrypt to the plaintext")
+			}
+		}
+	}
+	check(false, "nip04_encrypt", latency, err)
+
+	if ss, err := nip04.ComputeSharedSecret(user, peer); err == nil {
+		ciphertext, _ := nip04.Encrypt(plaintext, ss)
+		resp, latency, err = call("nip04_decrypt", peer.Public().Hex(), ciphertext)
+		if err == nil && resp.Result != plaintext {
+			err = fmt.Errorf("expected '%s', got '%s'", plaintext, resp.Result)
+		}
+		check(false, "nip04_decrypt", latency, err)
+	}
+
+	// switch_relays may return null or a list of relays
+	resp, latency, err = call("switch_relays")
+	if err == nil && resp.Result != "null" && resp.Result != "" {
+		var relays []string
+		if jerr := json.Unmarshal([]byte(resp.Result), &relays); jerr != nil {
+			err = fmt.Errorf("expected null or a list of relays, got '%s'", resp.Result)
+		}
+	}
+	check(false, "switch_relays", latency, err)
+
+	// unknown methods must get an error back instead of being ignored
+	_, latency, err = call("nak_nonexistent_method")
+	if err == nil {
+		err = fmt.Errorf("expected an error")
+	} else if strings.HasPrefix(err.Error(), "error: ") {
+		err = nil
+	}
+	check(false, "error on unknown method", latency, err)
+
+	if failures > 0 {
+		return fmt.Errorf("%d required checks failed", failures)
+	}
+	log("all required checks passed\n")
+	return nil
+}
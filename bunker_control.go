@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/urfave/cli/v3"
+)
+
+// bunkerControlRequest is sent as json through the bunker unix socket to change it while it runs
+type bunkerControlRequest struct {
+	Command  string   `json:"command"`
+	Args     []string `json:"args,omitempty"`
+	Identity string   `json:"identity,omitempty"`
+}
+
+type bunkerControlResponse struct {
+	Error   string                `json:"error,omitempty"`
+	Clients []bunkerControlClient `json:"clients,omitempty"`
+	Revoked int                   `json:"revoked,omitempty"`
+	Bunker  string                `json:"bunker,omitempty"`
+	Relays  []string              `json:"relays,omitempty"`
+}
+
+type bunkerControlClient struct {
+	Identity string       `json:"identity,omitempty"`
+	Signer   nostr.PubKey `json:"signer"`
+	BunkerConfigClient
+	LastActivity nostr.Timestamp `json:"last_activity,omitempty"`
+}
+
+func callBunkerSocket(c *cli.Command, req bunkerControlRequest) (bunkerControlResponse, error) {
+	var resp bunkerControlResponse
+	socketPath := getSocketPath(c, "bunkerconn")
+
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return resp, fmt.Errorf("failed to connect to bunker unix socket at %s: %w", socketPath, err)
+	}
+	defer conn.Close()
+
+	data, _ := json.Marshal(req)
+	if _, err := conn.Write(data); err != nil {
+		return resp, fmt.Errorf("failed to send command to bunker: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return resp, fmt.Errorf("no response from bunker (is it too old to support '%s'?): %w", req.Command, err)
+	}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return resp, fmt.Errorf("invalid response from bunker: %w", err)
+	}
+	if resp.Error != "" {
+		return resp, fmt.Errorf("%s", resp.Error)
+	}
+	return resp, nil
+}
+
+var bunkerControlFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "profile",
+		Usage: "profile name of the running bunker",
+	},
+	&cli.StringFlag{
+		Name:  "target-identity",
+		Usage: "name of the identity (served with --identity) to act on, instead of all of them or the main key",
+	},
+}
+
+var bunkerClients = &cli.Command{
+	Name:        "clients",
+	Usage:       "lists the clients authorized by a running bunker, with their last activity",
+	Description: `prints one json object per client. last_activity is only known for requests made since the bunker was started.`,
+	Flags:       bunkerControlFlags,
+	Action: func(ctx context.Context, c *cli.Command) error {
+		resp, err := callBunkerSocket(c, bunkerControlRequest{
+			Command:  "clients",
+			Identity: c.String("target-identity"),
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, client := range resp.Clients {
+			j, _ := json.Marshal(client)
+			stdout(string(j))
+		}
+		return nil
+	},
+}
+
+var bunkerRevoke = &cli.Command{
+	Name:      "revoke",
+	Usage:     "removes a client from a running bunker, so its requests are no longer accepted",
+	ArgsUsage: "<client-pubkey>",
+	Flags:     bunkerControlFlags,
+	Action: func(ctx context.Context, c *cli.Command) error {
+		if c.Args().Len() != 1 {
+			return fmt.Errorf("must be called with the client pubkey")
+		}
+		pk, err := parsePubKey(c.Args().First())
+		if err != nil {
+			return err
+		}
+
+		resp, err := callBunkerSocket(c, bunkerControlRequest{
+			Command:  "revoke",
+			Args:     []string{pk.Hex()},
+			Identity: c.String("target-identity"),
+		})
+		if err != nil {
+			return err
+		}
+
+		log("revoked %s from %d identities\n", pk.Hex(), resp.Revoked)
+		return nil
+	},
+}
+
+var bunkerRotateSecret = &cli.Command{
+	Name:        "rotate-secret",
+	Usage:       "makes a running bunker discard its connection secret and mint a new one, which is not persisted and only lasts while that bunker runs",
+	Description: `prints the new bunker:// uri. clients already authorized are not affected.`,
+	Flags:       bunkerControlFlags,
+	Action: func(ctx context.Context, c *cli.Command) error {
+		resp, err := callBunkerSocket(c, bunkerControlRequest{
+			Command:  "rotate-secret",
+			Identity: c.String("target-identity"),
+		})
+		if err != nil {
+			return err
+		}
+
+		stdout(resp.Bunker)
+		return nil
+	},
+}
+
+var bunkerRelays = &cli.Command{
+	Name:  "relays",
+	Usage: "lists or changes the relays of a running bunker",
+	Flags: bunkerControlFlags,
+	Action: func(ctx context.Context, c *cli.Command) error {
+		resp, err := callBunkerSocket(c, bunkerControlRequest{Command: "relays"})
+		if err != nil {
+			return err
+		}
+		for _, url := range resp.Relays {
+			stdout(url)
+		}
+		return nil
+	},
+	Commands: []*cli.Command{
+		{
+			Name:      "add",
+			Usage:     "starts listening on more relays",
+			ArgsUsage: "<relay-url>...",
+			Action: func(ctx context.Context, c *cli.Command) error {
+				return changeBunkerRelays(c, "add-relays")
+			},
+		},
+		{
+			Name:      "remove",
+			Usage:     "stops listening on some relays",
+			ArgsUsage: "<relay-url>...",
+			Action: func(ctx context.Context, c *cli.Command) error {
+				return changeBunkerRelays(c, "remove-relays")
+			},
+		},
+	},
+}
+
+func changeBunkerRelays(c *cli.Command, command string) error {
+	if c.Args().Len() == 0 {
+		return fmt.Errorf("must be called with at least one relay url")
+	}
+
+	resp, err := callBunkerSocket(c, bunkerControlRequest{Command: command, Args: c.Args().Slice()})
+	if err != nil {
+		return err
+	}
+
+	log("bunker is now listening on:\n")
+	for _, url := range resp.Relays {
+		stdout(url)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip04"
+	"fiatjaf.com/nostr/nip44"
+)
+
+// BunkerPermissions restricts what a client can do. a nil *BunkerPermissions allows everything,
+// and each empty list inside it also means there is no restriction on that aspect.
+type BunkerPermissions struct {
+	Methods []string       `json:"methods,omitempty"`
+	Kinds   []nostr.Kind   `json:"kinds,omitempty"`
+	Peers   []nostr.PubKey `json:"peers,omitempty"`
+}
+
+// these are always allowed for authorized clients, otherwise they wouldn't even be able to connect
+var bunkerHarmlessMethods = []string{"connect", "ping", "get_public_key", "get_relays", "logout"}
+
+// bunkerRequest and bunkerResponse mirror the nip46 json messages, we parse them here
+// before handing the event to the signer so permissions can be checked
+type bunkerRequest struct {
+	ID     string   `json:"id"`
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+}
+
+type bunkerResponse struct {
+	ID     string `json:"id"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// parseNIP46Perms reads the "perms" parameter from nostrconnect:// URIs and connect requests,
+// which looks like "nip44_encrypt,sign_event:1,sign_event:7"
+func parseNIP46Perms(perms string) *BunkerPermissions {
+	perms = strings.TrimSpace(perms)
+	if perms == "" {
+		return nil
+	}
+
+	p := &BunkerPermissions{}
+	anyKind := false
+	for perm := range strings.SplitSeq(perms, ",") {
+		method, param, _ := strings.Cut(strings.TrimSpace(perm), ":")
+		if method == "" {
+			continue
+		}
+		if !slices.Contains(p.Methods, method) {
+			p.Methods = append(p.Methods, method)
+		}
+		if method == "sign_event" {
+			if kind, err := strconv.ParseUint(param, 10, 16); err == nil {
+				p.Kinds = append(p.Kinds, nostr.Kind(kind))
+			} else {
+				anyKind = true
+			}
+		}
+	}
+	if anyKind {
+		p.Kinds = nil
+	}
+
+	return p
+}
+
+// allows returns an error explaining why the request is not allowed, or nil
+func (p *BunkerPermissions) allows(req bunkerRequest) error {
+	if p == nil || slices.Contains(bunkerHarmlessMethods, req.Method) {
+		return nil
+	}
+
+	if len(p.Methods) > 0 && !slices.Contains(p.Methods, req.Method) {
+		return fmt.Errorf("method '%s' not allowed", req.Method)
+	}
+
+	switch req.Method {
+	case "sign_event":
+		if len(p.Kinds) == 0 {
+			return nil
+		}
+		if len(req.Params) == 0 {
+			return fmt.Errorf("missing event")
+		}
+		var evt struct {
+			Kind nostr.Kind `json:"kind"`
+		}
+		if err := json.Unmarshal([]byte(req.Params[0]), &evt); err != nil {
+			return fmt.Errorf("invalid event: %w", err)
+		}
+		if !slices.Contains(p.Kinds, evt.Kind) {
+			return fmt.Errorf("signing kind %d not allowed", evt.Kind)
+		}
+	case "nip04_encrypt", "nip04_decrypt", "nip44_encrypt", "nip44_decrypt":
+		if len(p.Peers) == 0 {
+			return nil
+		}
+		if len(req.Params) == 0 {
+			return fmt.Errorf("missing peer")
+		}
+		peer, err := nostr.PubKeyFromHex(req.Params[0])
+		if err != nil {
+			return fmt.Errorf("invalid peer: %w", err)
+		}
+		if !slices.Contains(p.Peers, peer) {
+			return fmt.Errorf("%s with %s not allowed", req.Method, peer.Hex())
+		}
+	}
+
+	return nil
+}
+
+func (p *BunkerPermissions) String() string {
+	if p == nil {
+		return "all"
+	}
+
+	parts := make([]string, 0, 3)
+	if len(p.Methods) > 0 {
+		parts = append(parts, "methods: "+strings.Join(p.Methods, ","))
+	}
+	if len(p.Kinds) > 0 {
+		kinds := make([]string, len(p.Kinds))
+		for i, k := range p.Kinds {
+			kinds[i] = strconv.Itoa(int(k))
+		}
+		parts = append(parts, "kinds: "+strings.Join(kinds, ","))
+	}
+	if len(p.Peers) > 0 {
+		parts = append(parts, fmt.Sprintf("peers: %d", len(p.Peers)))
+	}
+	if len(parts) == 0 {
+		return "all"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// decryptBunkerRequest opens a kind 24133 request, which may be encrypted with nip44 or (for old clients) nip04
+func decryptBunkerRequest(sec nostr.SecretKey, evt nostr.Event) (req bunkerRequest, isNIP04 bool, err error) {
+	var plaintext string
+	if strings.Contains(evt.Content, "?iv=") {
+		isNIP04 = true
+		ss, err := nip04.ComputeSharedSecret(evt.PubKey, sec)
+		if err != nil {
+			return req, isNIP04, err
+		}
+		plaintext, err = nip04.Decrypt(evt.Content, ss)
+		if err != nil {
+			return req, isNIP04, err
+		}
+	} else {
+		ck, err := nip44.GenerateConversationKey(evt.PubKey, sec)
+		if err != nil {
+			return req, isNIP04, err
+		}
+		plaintext, err = nip44.Decrypt(evt.Content, ck)
+		if err != nil {
+			return req, isNIP04, err
+		}
+	}
+
+	err = json.Unmarshal([]byte(plaintext), &req)
+	return req, isNIP04, err
+}
+
+// makeBunkerResponse builds a response event for when we answer requests ourselves instead of through the signer
+func makeBunkerResponse(sec nostr.SecretKey, to nostr.PubKey, resp bunkerResponse, isNIP04 bool) (nostr.Event, error) {
+	plaintext, _ := json.Marshal(resp)
+
+	var ciphertext string
+	if isNIP04 {
+		ss, err := nip04.ComputeSharedSecret(to, sec)
+		if err != nil {
+			return nostr.Event{}, err
+		}
+		ciphertext, err = nip04.Encrypt(string(plaintext), ss)
+		if err != nil {
+			return nostr.Event{}, err
+		}
+	} else {
+		ck, err := nip44.GenerateConversationKey(to, sec)
+		if err != nil {
+			return nostr.Event{}, err
+		}
+		ciphertext, err = nip44.Encrypt(string(plaintext), ck)
+		if err != nil {
+			return nostr.Event{}, err
+		}
+	}
+
+	evt := nostr.Event{
+		Kind:      nostr.KindNostrConnect,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", to.Hex()}},
+		Content:   ciphertext,
+	}
+	err := evt.Sign(sec)
+	return evt, err
+}
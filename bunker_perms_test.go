@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBunkerPermissions(t *testing.T) {
+	friend := nostr.SecretKey{31: 1}.Public()
+	stranger := nostr.SecretKey{31: 2}.Public()
+
+	sign := func(kind int) bunkerRequest {
+		return bunkerRequest{Method: "sign_event", Params: []string{`{"kind":` + strconv.Itoa(kind) + `,"content":"x"}`}}
+	}
+	crypt := func(method string, peer nostr.PubKey) bunkerRequest {
+		return bunkerRequest{Method: method, Params: []string{peer.Hex(), "x"}}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		perms   *BunkerPermissions
+		req     bunkerRequest
+		allowed bool
+	}{
+		{"no permissions allow anything", nil, sign(30023), true},
+		{"listed kind", parseNIP46Perms("sign_event:1,sign_event:7"), sign(7), true},
+		{"unlisted kind", parseNIP46Perms("sign_event:1,sign_event:7"), sign(0), false},
+		{"bare sign_event allows any kind", parseNIP46Perms("sign_event:1,sign_event"), sign(30023), true},
+		{"method not listed", parseNIP46Perms("sign_event"), crypt("nip44_encrypt", friend), false},
+		{"harmless method", parseNIP46Perms("sign_event:1"), bunkerRequest{Method: "get_public_key"}, true},
+		{"ping", &BunkerPermissions{Methods: []string{"nip04_decrypt"}}, bunkerRequest{Method: "ping"}, true},
+		{"malformed event", parseNIP46Perms("sign_event:1"), bunkerRequest{Method: "sign_event", Params: []string{"{kind"}}, false},
+		{"missing event", parseNIP46Perms("sign_event:1"), bunkerRequest{Method: "sign_event"}, false},
+		{"nip04 to a listed peer", &BunkerPermissions{Peers: []nostr.PubKey{friend}}, crypt("nip04_encrypt", friend), true},
+		{"nip04 to an unlisted peer", &BunkerPermissions{Peers: []nostr.PubKey{friend}}, crypt("nip04_decrypt", stranger), false},
+		{"nip44 to a listed peer", &BunkerPermissions{Peers: []nostr.PubKey{friend}}, crypt("nip44_decrypt", friend), true},
+		{"nip44 to an unlisted peer", &BunkerPermissions{Peers: []nostr.PubKey{friend}}, crypt("nip44_encrypt", stranger), false},
+		{"invalid peer", &BunkerPermissions{Peers: []nostr.PubKey{friend}}, bunkerRequest{Method: "nip44_encrypt", Params: []string{"nope"}}, false},
+		{"peers don't restrict signing", &BunkerPermissions{Peers: []nostr.PubKey{friend}}, sign(1), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.perms.allows(tc.req)
+			if tc.allowed {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+
+	require.Nil(t, parseNIP46Perms("  "))
+	require.Equal(t, []string{"nip44_encrypt", "sign_event"}, parseNIP46Perms("nip44_encrypt, sign_event:1,sign_event:7").Methods)
+
+	t.Run("allow widens", func(t *testing.T) {
+		p := parseNIP46Perms("sign_event:1")
+		p.Peers = []nostr.PubKey{friend}
+		require.Error(t, p.allows(sign(7)))
+		p.allow(sign(7))
+		require.NoError(t, p.allows(sign(7)))
+		require.Error(t, p.allows(sign(0)))
+
+		p.allow(crypt("nip44_encrypt", stranger))
+		require.NoError(t, p.allows(crypt("nip44_encrypt", stranger)))
+		require.Error(t, p.allows(crypt("nip04_encrypt", stranger)))
+		require.ElementsMatch(t, []nostr.PubKey{friend, stranger}, p.Peers)
+	})
+
+	t.Run("allow keeps an empty set unrestricted", func(t *testing.T) {
+		p := &BunkerPermissions{}
+		p.allow(sign(1))
+		p.allow(crypt("nip04_encrypt", friend))
+		require.Empty(t, p.Methods)
+		require.Empty(t, p.Kinds)
+		require.Empty(t, p.Peers)
+		require.NoError(t, p.allows(sign(30023)))
+		require.NoError(t, p.allows(crypt("nip44_decrypt", stranger)))
+	})
+}
@@ -4,10 +4,13 @@ import (
 	"encoding/hex"
 	stdjson "encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip49"
 	"github.com/stretchr/testify/require"
 )
 
@@ -15,18 +18,37 @@ import (
 // to the next. for example, if in the first test we set --limit 2 then doesn't specify --limit in the second then
 // it will still return true for cmd.IsSet("limit") and then we will set .LimitZero = true
 
+// all calls share an empty config path so nothing from the user's ~/.config/nak (like a default identity) leaks in
+var testConfigPath string
+
+func TestMain(m *testing.M) {
+	var err error
+	testConfigPath, err = os.MkdirTemp("", "nak-test-config")
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(testConfigPath)
+	os.Exit(code)
+}
+
 func call(t *testing.T, cmd string) string {
 	var output strings.Builder
 	stdout = func(a ...any) {
 		output.WriteString(fmt.Sprint(a...))
 		output.WriteString("\n")
 	}
-	err := app.Run(t.Context(), strings.Split(cmd, " "))
+	err := app.Run(t.Context(), testArgs(cmd))
 	require.NoError(t, err)
 
 	return strings.TrimSpace(output.String())
 }
 
+func testArgs(cmd string) []string {
+	args := strings.Split(cmd, " ")
+	return append([]string{args[0], "--config-path", testConfigPath}, args[1:]...)
+}
+
 func TestEventBasic(t *testing.T) {
 	output := call(t, "nak event --ts 1699485669 --sec 01")
 
@@ -249,3 +271,57 @@ func TestEventJQ(t *testing.T) {
 	num := call(t, "nak event --ts 1699485669 -k 7 --jq .kind --jq-raw")
 	require.Equal(t, "7", num)
 }
+
+func TestEventPow(t *testing.T) {
+	output := call(t, "nak event --ts 1699485669 -k 1 -c hello --jq . --pow 8 --sec 01")
+
+	var evt nostr.Event
+	err := stdjson.Unmarshal([]byte(output), &evt)
+	require.NoError(t, err)
+
+	nonce := evt.Tags.Find("nonce")
+	require.NotNil(t, nonce)
+	require.Equal(t, "8", nonce[2])
+	require.GreaterOrEqual(t, powDifficulty(evt.ID), 8)
+	require.Equal(t, evt.GetID(), evt.ID)
+}
+
+func TestIdentityAs(t *testing.T) {
+	alice := nostr.SecretKey{31: 1}
+	bob := nostr.SecretKey{31: 2}
+
+	store := IdentityStore{Default: "alice", Identities: make(map[string]Identity)}
+	for name, sk := range map[string]nostr.SecretKey{"alice": alice, "bob": bob} {
+		ncryptsec, err := nip49.Encrypt(sk, "test", 8, 0x02)
+		require.NoError(t, err)
+		store.Identities[name] = Identity{PubKey: sk.Public(), NCryptSec: ncryptsec}
+	}
+	data, err := stdjson.Marshal(store)
+	require.NoError(t, err)
+	path := filepath.Join(testConfigPath, "identities.json")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	defer os.Remove(path)
+
+	// so we aren't asked for it
+	identityPassword = "test"
+	defer func() { identityPassword = "" }()
+
+	var evt nostr.Event
+
+	// --as wins over --sec
+	output := call(t, "nak event --ts 1699485669 --sec 03 --as bob")
+	require.NoError(t, stdjson.Unmarshal([]byte(output), &evt))
+	require.Equal(t, bob.Public(), evt.PubKey)
+	require.True(t, evt.VerifySignature())
+
+	output = call(t, "nak event --ts 1699485669 --as alice")
+	require.NoError(t, stdjson.Unmarshal([]byte(output), &evt))
+	require.Equal(t, alice.Public(), evt.PubKey)
+
+	// unknown names are an error, not a fallback to some other key
+	err = app.Run(t.Context(), testArgs("nak event --ts 1699485669 --as carol"))
+	require.ErrorContains(t, err, "carol")
+
+	// flags persist between calls, so don't leave --as set for the next tests
+	call(t, "nak event --ts 1699485669 --sec 01 --as=")
+}
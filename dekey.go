@@ -45,6 +45,11 @@ var dekey = &cli.Command{
 			Usage: "do not ask for confirmation, just not send the decoupled encryption key to any device",
 		},
 	),
+	Commands: []*cli.Command{
+		dekeyDevices,
+		dekeyRevoke,
+		dekeyMigrate,
+	},
 	Action: func(ctx context.Context, c *cli.Command) error {
 		kr, _, err := gatherKeyerFromArguments(ctx, c)
 		if err != nil {
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/keyer"
+	"fiatjaf.com/nostr/nip19"
+	"fiatjaf.com/nostr/nip44"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+)
+
+// dekeyDevice is one of the devices of a user, as seen from their kind:4454 announcements and the
+// kind:4455 key messages sent to and from them. since devices delete these once they get the key we
+// also keep what we have seen locally.
+type dekeyDevice struct {
+	PubKey   nostr.PubKey    `json:"pubkey"`
+	Name     string          `json:"name,omitempty"`
+	LastSeen nostr.Timestamp `json:"last_seen"`
+	Trusted  bool            `json:"trusted,omitempty"` // has received or sent a decoupled encryption key
+	Revoked  bool            `json:"revoked,omitempty"`
+
+	// the announcement, if it hasn't been deleted yet
+	announcement *nostr.Event
+}
+
+var dekeyDevices = &cli.Command{
+	Name:  "devices",
+	Usage: "lists the devices that have announced themselves or exchanged the decoupled encryption key",
+	Description: `devices that have been given the key are marked with a *, revoked ones with an x and this device with a >.
+devices that got the key delete their announcement, so their names are only known if this device has seen them before.`,
+	DisableSliceFlagSeparator: true,
+	Action: func(ctx context.Context, c *cli.Command) error {
+		kr, _, err := gatherKeyerFromArguments(ctx, c)
+		if err != nil {
+			return err
+		}
+		userPub, err := kr.GetPublicKey(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get user public key: %w", err)
+		}
+
+		configPath := c.String("config-path")
+		relays := sys.FetchWriteRelays(ctx, userPub)
+		announcement, ePub, _ := fetchDekeyAnnouncement(ctx, relays, userPub)
+		if ePub != nostr.ZeroPK {
+			log("current decoupled encryption key: %s (since %s)\n",
+				color.CyanString(ePub.Hex()),
+				announcement.CreatedAt.Time().Format(time.DateTime),
+			)
+		} else {
+			log("no decoupled encryption key announced yet\n")
+		}
+
+		var ourDevice nostr.PubKey
+		if deviceSec, err := loadDekeyDeviceKey(configPath); err == nil {
+			ourDevice = deviceSec.Public()
+		}
+
+		for _, device := range fetchDekeyDevices(ctx, configPath, relays, userPub) {
+			mark := " "
+			switch {
+			case device.PubKey == ourDevice:
+				mark = ">"
+			case device.Revoked:
+				mark = "x"
+			case device.Trusted:
+				mark = "*"
+			}
+			name := device.Name
+			if name == "" {
+				name = colors.italic("unnamed")
+			}
+			stdout(fmt.Sprintf("%s %s %s last seen %s",
+				mark,
+				device.PubKey.Hex(),
+				color.YellowString(name),
+				device.LastSeen.Time().Format(time.DateTime),
+			))
+		}
+
+		return nil
+	},
+}
+
+var dekeyRevoke = &cli.Command{
+	Name:  "revoke",
+	Usage: "rotates the decoupled encryption key and shares the new one with all devices except the revoked one",
+	Description: `the device can be given by name or by (a prefix of) its pubkey, as shown by "nak dekey devices".
+
+the revoked device will still be able to read the messages it could read before, but not new ones. afterwards run "nak dekey migrate" so old messages stay readable with the new key.`,
+	ArgsUsage:                 "<device>",
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "don't ask for confirmation",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		if c.Args().Len() != 1 {
+			return fmt.Errorf("must be called with the device name or pubkey")
+		}
+		target := c.Args().First()
+
+		kr, _, err := gatherKeyerFromArguments(ctx, c)
+		if err != nil {
+			return err
+		}
+		userPub, err := kr.GetPublicKey(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get user public key: %w", err)
+		}
+
+		configPath := c.String("config-path")
+		deviceSec, err := loadDekeyDeviceKey(configPath)
+		if err != nil {
+			return fmt.Errorf("this device has no device key, run `nak dekey` first: %w", err)
+		}
+		devicePub := deviceSec.Public()
+
+		relays := sys.FetchWriteRelays(ctx, userPub)
+		relayList := connectToAllRelays(ctx, c, relays)
+		if len(relayList) == 0 {
+			return fmt.Errorf("no relays to use")
+		}
+
+		_, ePub, ok := fetchDekeyAnnouncement(ctx, relays, userPub)
+		if !ok {
+			return fmt.Errorf("no decoupled encryption key announced, nothing to revoke")
+		}
+		devices := fetchDekeyDevices(ctx, configPath, relays, userPub)
+
+		// find the device
+		matches := slices.DeleteFunc(slices.Clone(devices), func(d *dekeyDevice) bool {
+			return d.Revoked || (d.Name != target && d.PubKey.Hex() != target &&
+				!(len(target) >= 8 && strings.HasPrefix(d.PubKey.Hex(), target)))
+		})
+		switch len(matches) {
+		case 0:
+			return fmt.Errorf("no device matching '%s', see `nak dekey devices`", target)
+		case 1:
+		default:
+			return fmt.Errorf("'%s' matches %d devices, use the pubkey instead", target, len(matches))
+		}
+		revoked := matches[0]
+		if revoked.PubKey == devicePub {
+			return fmt.Errorf("can't revoke this same device, do it from another one")
+		}
+
+		// devices that never got the key (pending announcements) must still go through `nak dekey`
+		remaining := slices.DeleteFunc(slices.Clone(devices), func(d *dekeyDevice) bool {
+			return d == revoked || d.PubKey == devicePub || d.Revoked || !d.Trusted
+		})
+
+		log("revoking %s (%s), the key %s will be replaced and shared with %d other devices\n",
+			color.YellowString(revoked.Name), revoked.PubKey.Hex(), ePub.Hex(), len(remaining))
+		if !c.Bool("yes") && !askConfirmation("proceed? ") {
+			return fmt.Errorf("canceled")
+		}
+
+		// generate and announce the new key
+		eSec := nostr.Generate()
+		eKeyPath := filepath.Join(configPath, "dekey", "p", userPub.Hex(), "e", eSec.Public().Hex())
+		os.MkdirAll(filepath.Dir(eKeyPath), 0700)
+		if err := os.WriteFile(eKeyPath, []byte(eSec.Hex()), 0600); err != nil {
+			return fmt.Errorf("failed to write decoupled encryption key: %w", err)
+		}
+
+		evt10044 := nostr.Event{
+			Kind:      10044,
+			CreatedAt: nostr.Now(),
+			Tags:      nostr.Tags{{"n", eSec.Public().Hex()}},
+		}
+		if err := kr.SignEvent(ctx, &evt10044); err != nil {
+			return fmt.Errorf("failed to sign kind:10044: %w", err)
+		}
+		if err := publishFlow(ctx, c, kr, evt10044, relayList); err != nil {
+			return err
+		}
+		log(color.GreenString("- new decoupled encryption key %s announced\n"), eSec.Public().Hex())
+
+		// share it with the remaining devices
+		for _, device := range remaining {
+			ss, err := nip44.GenerateConversationKey(device.PubKey, deviceSec)
+			if err != nil {
+				continue
+			}
+			ciphertext, err := nip44.Encrypt(eSec.Hex(), ss)
+			if err != nil {
+				continue
+			}
+			evt4455 := nostr.Event{
+				Kind:    4455,
+				Content: ciphertext,
+				// devices only look for key messages newer than the announcement
+				CreatedAt: evt10044.CreatedAt + 1,
+				Tags: nostr.Tags{
+					{"p", device.PubKey.Hex()},
+					{"P", devicePub.Hex()},
+				},
+			}
+			if err := kr.SignEvent(ctx, &evt4455); err != nil {
+				log(color.RedString("failed to sign key message: %v\n"), err)
+				continue
+			}
+			if err := publishFlow(ctx, c, kr, evt4455, relayList); err != nil {
+				log(color.RedString("failed to publish key message: %v\n"), err)
+			} else {
+				log("  - new key sent to %s\n", color.GreenString(device.Name))
+			}
+		}
+
+		// and forget the revoked device, remembering that it was revoked so old key messages
+		// that mention it don't make it trusted again
+		revoked.Revoked = true
+		saveDekeyDevices(configPath, userPub, devices)
+		if revoked.announcement != nil {
+			deletion := nostr.Event{
+				CreatedAt: nostr.Now(),
+				Kind:      5,
+				Tags:      nostr.Tags{{"e", revoked.announcement.ID.Hex()}},
+			}
+			if err := kr.SignEvent(ctx, &deletion); err != nil {
+				log(color.RedString("failed to sign 4454 deletion: %v\n"), err)
+			} else if err := publishFlow(ctx, c, kr, deletion, relayList); err != nil {
+				log(color.RedString("failed to publish 4454 deletion: %v\n"), err)
+			}
+		}
+
+		log("done, now run %s so old messages are readable with the new key\n", color.CyanString("nak dekey migrate"))
+		stdout(eSec.Public().Hex())
+		return nil
+	},
+}
+
+var dekeyMigrate = &cli.Command{
+	Name:  "migrate",
+	Usage: "re-wraps gift-wrapped messages sent to our old decoupled encryption keys to the current one",
+	Description: `all the old keys stored locally are tried. the new wraps are sent to ourselves only, in our dm relays, sealed by us. the original authors are kept inside, and their messages get a "migrated" tag so nak knows to accept them under our seal (other clients will likely reject these).
+
+example:
+  nak dekey migrate --dry-run`,
+	ArgsUsage:                 "[relay...]",
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only count the messages that would be migrated",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		kr, _, err := gatherKeyerFromArguments(ctx, c)
+		if err != nil {
+			return err
+		}
+		userPub, err := kr.GetPublicKey(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get user public key: %w", err)
+		}
+
+		configPath := c.String("config-path")
+		eSec, has, err := getDecoupledEncryptionSecretKey(ctx, configPath, userPub)
+		if !has {
+			return fmt.Errorf("we don't have the current decoupled encryption key, run `nak dekey` first")
+		}
+		if err != nil {
+			return err
+		}
+		ePub := eSec.Public()
+		current := keyer.NewPlainKeySigner(eSec)
+
+		// all the other keys we have stored are old ones
+		oldCiphers := make([]nostr.Cipher, 0, 4)
+		receivers := []string{ePub.Hex()}
+		entries, _ := os.ReadDir(filepath.Join(configPath, "dekey", "p", userPub.Hex(), "e"))
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(configPath, "dekey", "p", userPub.Hex(), "e", entry.Name()))
+			if err != nil {
+				continue
+			}
+			old, err := nostr.SecretKeyFromHex(strings.TrimSpace(string(data)))
+			if err != nil || old == eSec {
+				continue
+			}
+			oldCiphers = append(oldCiphers, dekeyOldCipher{keyer.NewPlainKeySigner(old), old.Public(), userPub})
+			receivers = append(receivers, old.Public().Hex())
+		}
+		if len(oldCiphers) == 0 {
+			log("no old decoupled encryption keys stored locally, nothing to migrate\n")
+			return nil
+		}
+		log("migrating messages from %d old keys to %s\n", len(oldCiphers), color.CyanString(ePub.Hex()))
+
+		relays := c.Args().Slice()
+		if len(relays) == 0 {
+			relays = nostr.AppendUnique(sys.FetchInboxRelays(ctx, userPub, 3), fetchDMRelays(ctx, userPub)...)
+		}
+		if len(relays) == 0 {
+			return fmt.Errorf("no relays to fetch messages from, give some as arguments")
+		}
+
+		// gather what is already wrapped to the current key so we don't migrate it twice
+		migrated := make(map[nostr.ID]struct{})
+		toMigrate := make([]nostr.Event, 0, 100)
+		for ie := range sys.Pool.FetchMany(ctx, relays, nostr.Filter{
+			Kinds: []nostr.Kind{1059},
+			Tags:  nostr.TagMap{"p": receivers},
+		}, nostr.SubscriptionOptions{Label: "nak-nip4e"}) {
+			if ie.Event.Tags.FindWithValue("p", ePub.Hex()) != nil {
+				if rumor, err := unwrapGift(ctx, []nostr.Cipher{current}, ie.Event, userPub); err == nil {
+					migrated[originalRumorID(rumor)] = struct{}{}
+				}
+				continue
+			}
+
+			rumor, err := unwrapGift(ctx, oldCiphers, ie.Event, userPub)
+			if err != nil {
+				logverbose("failed to unwrap %s: %s\n", ie.Event.ID.Hex(), err)
+				continue
+			}
+			toMigrate = append(toMigrate, rumor)
+		}
+
+		dmRelays := dmRelaysOrInbox(ctx, userPub)
+		count := 0
+		for _, rumor := range toMigrate {
+			if _, ok := migrated[originalRumorID(rumor)]; ok {
+				continue
+			}
+			migrated[originalRumorID(rumor)] = struct{}{}
+			count++
+
+			if c.Bool("dry-run") {
+				logverbose("would migrate %s from %s\n", rumor.ID.Hex(), nip19.EncodeNpub(rumor.PubKey))
+				continue
+			}
+
+			// the seal will be ours, so rumors from others must be marked or they'd be taken as forgeries
+			if rumor.PubKey != userPub {
+				rumor = markMigrated(rumor)
+			}
+			wrap, err := giftWrap(ctx, kr, current, rumor, ePub)
+			if err != nil {
+				return fmt.Errorf("failed to wrap %s: %w", rumor.ID.Hex(), err)
+			}
+			sent := false
+			for res := range sys.Pool.PublishMany(ctx, dmRelays, wrap) {
+				if res.Error == nil {
+					sent = true
+				} else {
+					logverbose("failed to publish to %s: %s\n", res.RelayURL, res.Error)
+				}
+			}
+			if !sent {
+				return fmt.Errorf("failed to publish migrated message %s to any of %v", rumor.ID.Hex(), dmRelays)
+			}
+		}
+
+		if c.Bool("dry-run") {
+			log("%d messages would be migrated\n", count)
+		} else {
+			log("%d messages migrated\n", count)
+		}
+		return nil
+	},
+}
+
+// dekeyOldCipher decrypts with one of our old decoupled keys, including the messages we sent to
+// ourselves, which were encrypted from that key to itself
+type dekeyOldCipher struct {
+	nostr.Cipher
+	self nostr.PubKey
+	user nostr.PubKey
+}
+
+func (oc dekeyOldCipher) Decrypt(ctx context.Context, ciphertext string, sender nostr.PubKey) (string, error) {
+	plain, err := oc.Cipher.Decrypt(ctx, ciphertext, sender)
+	if err != nil && sender == oc.user {
+		return oc.Cipher.Decrypt(ctx, ciphertext, oc.self)
+	}
+	return plain, err
+}
+
+func loadDekeyDeviceKey(configPath string) (nostr.SecretKey, error) {
+	data, err := os.ReadFile(filepath.Join(configPath, "dekey", "device-key"))
+	if err != nil {
+		return nostr.SecretKey{}, err
+	}
+	return nostr.SecretKeyFromHex(strings.TrimSpace(string(data)))
+}
+
+// fetchDekeyAnnouncement gets the kind:10044 and the decoupled encryption public key in it
+func fetchDekeyAnnouncement(ctx context.Context, relays []string, userPub nostr.PubKey) (nostr.Event, nostr.PubKey, bool) {
+	result := sys.Pool.FetchManyReplaceable(ctx, relays, nostr.Filter{
+		Kinds:   []nostr.Kind{10044},
+		Authors: []nostr.PubKey{userPub},
+	}, nostr.SubscriptionOptions{Label: "nak-nip4e"})
+
+	evt, ok := result.Load(nostr.ReplaceableKey{PubKey: userPub, D: ""})
+	if !ok {
+		return nostr.Event{}, nostr.ZeroPK, false
+	}
+	if tag := evt.Tags.Find("n"); tag != nil {
+		if ePub, err := nostr.PubKeyFromHex(tag[1]); err == nil {
+			return evt, ePub, true
+		}
+	}
+	return evt, nostr.ZeroPK, false
+}
+
+// fetchDekeyDevices assembles the list of devices from the announcements and key messages plus
+// what we have seen before, most recently seen first, and stores it again
+func fetchDekeyDevices(ctx context.Context, configPath string, relays []string, userPub nostr.PubKey) []*dekeyDevice {
+	devices := make([]*dekeyDevice, 0, 5)
+	if data, err := os.ReadFile(dekeyDevicesPath(configPath, userPub)); err == nil {
+		json.Unmarshal(data, &devices)
+	}
+
+	get := func(pk nostr.PubKey) *dekeyDevice {
+		for _, d := range devices {
+			if d.PubKey == pk {
+				return d
+			}
+		}
+		d := &dekeyDevice{PubKey: pk}
+		devices = append(devices, d)
+		return d
+	}
+	seenAt := func(d *dekeyDevice, ts nostr.Timestamp) {
+		if ts > d.LastSeen {
+			d.LastSeen = ts
+		}
+	}
+
+	for ie := range sys.Pool.FetchMany(ctx, relays, nostr.Filter{
+		Kinds:   []nostr.Kind{4454, 4455},
+		Authors: []nostr.PubKey{userPub},
+	}, nostr.SubscriptionOptions{Label: "nak-nip4e"}) {
+		evt := ie.Event
+		switch evt.Kind {
+		case 4454:
+			tag := evt.Tags.Find("P")
+			if tag == nil {
+				continue
+			}
+			pk, err := nostr.PubKeyFromHex(tag[1])
+			if err != nil {
+				continue
+			}
+			d := get(pk)
+			if d.announcement == nil || evt.CreatedAt > d.announcement.CreatedAt {
+				d.announcement = &evt
+				if client := evt.Tags.Find("client"); client != nil {
+					d.Name = client[1]
+				}
+			}
+			seenAt(d, evt.CreatedAt)
+		case 4455:
+			for _, name := range []string{"p", "P"} {
+				tag := evt.Tags.Find(name)
+				if tag == nil {
+					continue
+				}
+				pk, err := nostr.PubKeyFromHex(tag[1])
+				if err != nil {
+					continue
+				}
+				d := get(pk)
+				seenAt(d, evt.CreatedAt)
+				d.Trusted = true
+			}
+		}
+	}
+
+	slices.SortFunc(devices, func(a, b *dekeyDevice) int { return int(b.LastSeen - a.LastSeen) })
+	saveDekeyDevices(configPath, userPub, devices)
+	return devices
+}
+
+func dekeyDevicesPath(configPath string, userPub nostr.PubKey) string {
+	return filepath.Join(configPath, "dekey", "p", userPub.Hex(), "devices.json")
+}
+
+func saveDekeyDevices(configPath string, userPub nostr.PubKey, devices []*dekeyDevice) {
+	path := dekeyDevicesPath(configPath, userPub)
+	os.MkdirAll(filepath.Dir(path), 0700)
+	data, _ := json.MarshalIndent(devices, "", "  ")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		log(color.RedString("failed to save known devices: %s\n"), err)
+	}
+}
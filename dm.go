@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip19"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+)
+
+var dm = &cli.Command{
+	Name:  "dm",
+	Usage: "sends and reads NIP-17 private direct messages",
+	Description: `messages are kind:14 rumors gift-wrapped to each participant and to ourselves, then published to the kind:10050 relays of each.
+
+a decoupled encryption key (if it has been created or received with "nak dekey" previously) will be used by default, both ours and the other participants'.`,
+	DisableSliceFlagSeparator: true,
+	Commands: []*cli.Command{
+		{
+			Name:      "send",
+			Usage:     "sends a message to someone (and to more people with -p)",
+			ArgsUsage: "<npub> [message]",
+			Description: `if the message is not given it is read from stdin.
+
+example:
+  nak dm send npub1... 'hello'
+  echo 'hello everybody' | nak dm send npub1... -p npub1... -p npub1...`,
+			Flags: []cli.Flag{
+				&PubKeySliceFlag{
+					Name:    "recipient",
+					Aliases: []string{"p"},
+					Usage:   "other people to add to the conversation",
+				},
+				&cli.StringFlag{
+					Name:    "reply",
+					Aliases: []string{"e"},
+					Usage:   "id of a previous message in the conversation this is replying to",
+				},
+				&cli.StringFlag{
+					Name:  "subject",
+					Usage: "conversation title",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				if c.Args().Len() == 0 {
+					return fmt.Errorf("must be called with the recipient")
+				}
+				first, err := parsePubKey(c.Args().First())
+				if err != nil {
+					return err
+				}
+				recipients := []nostr.PubKey{first}
+				for _, pk := range getPubKeySlice(c, "recipient") {
+					if !slices.Contains(recipients, pk) {
+						recipients = append(recipients, pk)
+					}
+				}
+
+				content := strings.Join(c.Args().Tail(), " ")
+				if content == "" {
+					data, err := io.ReadAll(os.Stdin)
+					if err != nil {
+						return fmt.Errorf("failed to read message from stdin: %w", err)
+					}
+					content = strings.TrimSpace(string(data))
+				}
+				if content == "" {
+					return fmt.Errorf("empty message")
+				}
+
+				s, err := newDMSession(ctx, c)
+				if err != nil {
+					return err
+				}
+
+				rumor := s.makeRumor(content, recipients)
+				if reply := c.String("reply"); reply != "" {
+					id, err := parseEventID(reply)
+					if err != nil {
+						return fmt.Errorf("invalid --reply: %w", err)
+					}
+					rumor.Tags = append(rumor.Tags, nostr.Tag{"e", id.Hex()})
+				}
+				if subject := c.String("subject"); subject != "" {
+					rumor.Tags = append(rumor.Tags, nostr.Tag{"subject", subject})
+				}
+
+				if err := s.send(ctx, rumor, recipients); err != nil {
+					return err
+				}
+
+				stdout(rumor.String())
+				return nil
+			},
+		},
+		{
+			Name:  "inbox",
+			Usage: "fetches all messages sent to us (and by us) from our dm relays and prints them as json",
+			Description: `example:
+  nak dm inbox --since '1 week ago' | jq -r .content`,
+			Flags: []cli.Flag{
+				&NaturalTimeFlag{
+					Name:    "since",
+					Aliases: []string{"s"},
+					Usage:   "only messages newer than this",
+				},
+				&cli.UintFlag{
+					Name:    "limit",
+					Aliases: []string{"l"},
+					Usage:   "only the latest n messages",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				s, err := newDMSession(ctx, c)
+				if err != nil {
+					return err
+				}
+
+				messages := s.fetch(ctx, getNaturalDate(c, "since"))
+				if limit := int(c.Uint("limit")); limit > 0 && len(messages) > limit {
+					messages = messages[len(messages)-limit:]
+				}
+				for _, rumor := range messages {
+					stdout(rumor.String())
+				}
+				return nil
+			},
+		},
+		{
+			Name:        "chat",
+			Usage:       "shows the conversation with someone and lets you reply to it",
+			ArgsUsage:   "<npub>",
+			Description: `prints the history then waits for new messages. when running on a terminal each line typed is sent as a message.`,
+			Flags: []cli.Flag{
+				&NaturalTimeFlag{
+					Name:    "since",
+					Aliases: []string{"s"},
+					Usage:   "only show history newer than this",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				if c.Args().Len() != 1 {
+					return fmt.Errorf("must be called with the pubkey of the other person")
+				}
+				them, err := parsePubKey(c.Args().First())
+				if err != nil {
+					return err
+				}
+
+				s, err := newDMSession(ctx, c)
+				if err != nil {
+					return err
+				}
+				conversation := []nostr.PubKey{s.us}
+				if them != s.us {
+					conversation = append(conversation, them)
+				}
+
+				pm := sys.FetchProfileMetadata(ctx, them)
+				log("conversation with %s (%s)\n", colors.bold(pm.ShortName()), pm.NpubShort())
+
+				var mu sync.Mutex
+				seen := make(map[nostr.ID]struct{})
+				show := func(rumor nostr.Event) {
+					mu.Lock()
+					defer mu.Unlock()
+					if _, ok := seen[originalRumorID(rumor)]; ok {
+						return
+					}
+					seen[originalRumorID(rumor)] = struct{}{}
+					if !sameParticipants(dmParticipants(rumor), conversation) {
+						return
+					}
+					stdout(s.formatMessage(ctx, rumor))
+				}
+
+				for _, rumor := range s.fetch(ctx, getNaturalDate(c, "since")) {
+					show(rumor)
+				}
+
+				if isPiped() {
+					return nil
+				}
+
+				ctx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				go func() {
+					for rumor := range s.live(ctx) {
+						show(rumor)
+					}
+				}()
+
+				scanner := bufio.NewScanner(os.Stdin)
+				for scanner.Scan() {
+					line := strings.TrimSpace(scanner.Text())
+					if line == "" {
+						continue
+					}
+					rumor := s.makeRumor(line, []nostr.PubKey{them})
+					if err := s.send(ctx, rumor, []nostr.PubKey{them}); err != nil {
+						log(color.RedString("failed to send: %s\n"), err)
+						continue
+					}
+					show(rumor)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+// dmSession is what we need to send and receive NIP-17 messages as ourselves
+type dmSession struct {
+	kr nostr.Keyer
+	us nostr.PubKey
+
+	// our rumors are encrypted with this, which is our decoupled key if we have one
+	cipher nostr.Cipher
+
+	// gift-wraps sent to us may be encrypted to any of these, and p-tag any of receivers
+	ciphers   []nostr.Cipher
+	receivers []string
+
+	// our kind:10050 relays
+	relays []string
+}
+
+func newDMSession(ctx context.Context, c *cli.Command) (*dmSession, error) {
+	kr, _, err := gatherKeyerFromArguments(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return newDMSessionWithKeyer(ctx, c, kr)
+}
+
+func newDMSessionWithKeyer(ctx context.Context, c *cli.Command, kr nostr.Keyer) (*dmSession, error) {
+	us, err := kr.GetPublicKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get our public key: %w", err)
+	}
+
+	ciphers, receivers, err := ourGiftCiphers(ctx, c, kr, us)
+	if err != nil {
+		return nil, err
+	}
+	s := &dmSession{
+		kr:        kr,
+		us:        us,
+		cipher:    ciphers[0],
+		ciphers:   ciphers,
+		receivers: receivers,
+	}
+
+	s.relays = dmRelaysOrInbox(ctx, us)
+	if len(s.relays) == 0 {
+		return nil, fmt.Errorf("no relays to use for our messages")
+	}
+	logverbose("our dm relays: %v\n", s.relays)
+
+	return s, nil
+}
+
+func (s *dmSession) makeRumor(content string, recipients []nostr.PubKey) nostr.Event {
+	rumor := nostr.Event{
+		Kind:      14,
+		Content:   content,
+		CreatedAt: nostr.Now(),
+		PubKey:    s.us,
+		Tags:      make(nostr.Tags, 0, len(recipients)),
+	}
+	for _, pk := range recipients {
+		if pk != s.us {
+			rumor.Tags = append(rumor.Tags, nostr.Tag{"p", pk.Hex()})
+		}
+	}
+	rumor.ID = rumor.GetID()
+	return rumor
+}
+
+// send gift-wraps the rumor to each recipient and to ourselves, publishing each to their dm relays
+func (s *dmSession) send(ctx context.Context, rumor nostr.Event, recipients []nostr.PubKey) error {
+	everybody := slices.Clone(recipients)
+	if !slices.Contains(everybody, s.us) {
+		everybody = append(everybody, s.us)
+	}
+	for _, pk := range everybody {
+		target := pk
+		if ePub, exists := getDecoupledEncryptionPublicKey(ctx, pk); exists {
+			target = ePub
+		}
+
+		wrap, err := giftWrap(ctx, s.kr, s.cipher, rumor, target)
+		if err != nil {
+			return fmt.Errorf("failed to wrap to %s: %w", nip19.EncodeNpub(pk), err)
+		}
+
+		relays := s.relays
+		if pk != s.us {
+			relays = dmRelaysOrInbox(ctx, pk)
+		}
+
+		sent := 0
+		for res := range sys.Pool.PublishMany(ctx, relays, wrap) {
+			if res.Error == nil {
+				sent++
+			} else {
+				logverbose("failed to send to %s through %s: %s\n", nip19.EncodeNpub(pk), res.RelayURL, res.Error)
+			}
+		}
+
+		switch {
+		case sent > 0:
+			logverbose("sent to %s through %d relays\n", nip19.EncodeNpub(pk), sent)
+		case pk == s.us:
+			log(color.YellowString("failed to store our own copy of the message\n"))
+		default:
+			return fmt.Errorf("failed to send to %s through any of %v", nip19.EncodeNpub(pk), relays)
+		}
+	}
+
+	return nil
+}
+
+func (s *dmSession) filter(since nostr.Timestamp) nostr.Filter {
+	filter := nostr.Filter{
+		Kinds: []nostr.Kind{1059},
+		Tags:  nostr.TagMap{"p": s.receivers},
+	}
+	if since != 0 {
+		// gift-wraps have their created_at randomized up to two days in the past
+		filter.Since = since - 2*24*60*60
+	}
+	return filter
+}
+
+// open unwraps a gift-wrap, returning false for anything that isn't a message
+func (s *dmSession) open(ctx context.Context, wrap nostr.Event) (nostr.Event, bool) {
+	rumor, err := unwrapGift(ctx, s.ciphers, wrap, s.us)
+	if err != nil {
+		logverbose("failed to unwrap %s: %s\n", wrap.ID.Hex(), err)
+		return rumor, false
+	}
+	return rumor, rumor.Kind == 14 || rumor.Kind == 15
+}
+
+// fetch returns all the messages in our relays, oldest first
+func (s *dmSession) fetch(ctx context.Context, since nostr.Timestamp) []nostr.Event {
+	messages := make([]nostr.Event, 0, 100)
+	seen := make(map[nostr.ID]struct{})
+	for ie := range sys.Pool.FetchMany(ctx, s.relays, s.filter(since), nostr.SubscriptionOptions{Label: "nak-dm"}) {
+		rumor, ok := s.open(ctx, ie.Event)
+		if !ok || rumor.CreatedAt < since {
+			continue
+		}
+		if _, ok := seen[originalRumorID(rumor)]; ok {
+			continue
+		}
+		seen[originalRumorID(rumor)] = struct{}{}
+		messages = append(messages, rumor)
+	}
+
+	slices.SortFunc(messages, func(a, b nostr.Event) int { return int(a.CreatedAt - b.CreatedAt) })
+	return messages
+}
+
+// live yields the messages that arrive from now on (and possibly some older ones) until ctx is canceled
+func (s *dmSession) live(ctx context.Context) chan nostr.Event {
+	ch := make(chan nostr.Event)
+	go func() {
+		defer close(ch)
+		for ie := range sys.Pool.SubscribeMany(ctx, s.relays, s.filter(nostr.Now()), nostr.SubscriptionOptions{Label: "nak-dm"}) {
+			if rumor, ok := s.open(ctx, ie.Event); ok {
+				select {
+				case ch <- rumor:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func (s *dmSession) formatMessage(ctx context.Context, rumor nostr.Event) string {
+	name := color.GreenString("you")
+	if rumor.PubKey != s.us {
+		name = color.CyanString(sys.FetchProfileMetadata(ctx, rumor.PubKey).ShortName())
+	}
+
+	content := rumor.Content
+	if rumor.Kind == 15 {
+		content = colors.italic("file: ") + content
+	}
+	if isMigrated(rumor) {
+		content += " " + color.HiBlackString("(migrated)")
+	}
+
+	return fmt.Sprintf("%s %s: %s",
+		color.HiBlackString(rumor.CreatedAt.Time().Format("2006-01-02 15:04")),
+		name,
+		content,
+	)
+}
+
+// dmParticipants is everybody in the conversation a message belongs to, sorted
+func dmParticipants(rumor nostr.Event) []nostr.PubKey {
+	participants := []nostr.PubKey{rumor.PubKey}
+	for _, tag := range rumor.Tags {
+		if len(tag) < 2 || tag[0] != "p" {
+			continue
+		}
+		if pk, err := nostr.PubKeyFromHex(tag[1]); err == nil && !slices.Contains(participants, pk) {
+			participants = append(participants, pk)
+		}
+	}
+	slices.SortFunc(participants, func(a, b nostr.PubKey) int { return strings.Compare(a.Hex(), b.Hex()) })
+	return participants
+}
+
+func sameParticipants(a []nostr.PubKey, b []nostr.PubKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, pk := range b {
+		if !slices.Contains(a, pk) {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchDMRelays reads the kind:10050 list of relays where someone wants to receive messages
+func fetchDMRelays(ctx context.Context, pubkey nostr.PubKey) []string {
+	relays := sys.FetchWriteRelays(ctx, pubkey)
+
+	result := sys.Pool.FetchManyReplaceable(ctx, relays, nostr.Filter{
+		Kinds:   []nostr.Kind{10050},
+		Authors: []nostr.PubKey{pubkey},
+	}, nostr.SubscriptionOptions{Label: "nak-dm"})
+
+	evt, ok := result.Load(nostr.ReplaceableKey{PubKey: pubkey, D: ""})
+	if !ok {
+		return nil
+	}
+
+	dmRelays := make([]string, 0, 3)
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || tag[0] != "relay" {
+			continue
+		}
+		if url := nostr.NormalizeURL(tag[1]); nostr.IsValidRelayURL(url) {
+			dmRelays = nostr.AppendUnique(dmRelays, url)
+		}
+	}
+	return dmRelays
+}
+
+func dmRelaysOrInbox(ctx context.Context, pubkey nostr.PubKey) []string {
+	if relays := fetchDMRelays(ctx, pubkey); len(relays) > 0 {
+		return relays
+	}
+
+	log(color.YellowString("%s has no kind:10050 dm relays, using their inbox relays\n"), nip19.EncodeNpub(pubkey))
+	return sys.FetchInboxRelays(ctx, pubkey, 3)
+}
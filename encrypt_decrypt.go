@@ -2,10 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
+	"fiatjaf.com/nostr"
 	"fiatjaf.com/nostr/nip04"
+	"fiatjaf.com/nostr/nip44"
+	"github.com/mailru/easyjson"
 	"github.com/urfave/cli/v3"
+	"golang.org/x/crypto/hkdf"
 )
 
 var encrypt = &cli.Command{
@@ -15,21 +26,35 @@ var encrypt = &cli.Command{
 	DisableSliceFlagSeparator: true,
 	Flags: []cli.Flag{
 		&PubKeyFlag{
-			Name:     "recipient-pubkey",
-			Aliases:  []string{"p", "tgt", "target", "pubkey", "to"},
-			Required: true,
+			Name:    "recipient-pubkey",
+			Aliases: []string{"p", "tgt", "target", "pubkey", "to"},
 		},
 		&cli.BoolFlag{
 			Name:  "nip04",
 			Usage: "use nip04 encryption instead of nip44",
 		},
 	},
+	Commands: []*cli.Command{
+		encryptInspect,
+	},
 	Action: func(ctx context.Context, c *cli.Command) error {
+		if !c.IsSet("recipient-pubkey") {
+			return fmt.Errorf("missing --recipient-pubkey")
+		}
 		target := getPubKey(c, "recipient-pubkey")
 
 		plaintext := c.Args().First()
 
 		if c.Bool("nip04") {
+			if as, ok := agentKeyerFromArguments(c); ok {
+				ciphertext, err := as.NIP04Encrypt(ctx, target, plaintext)
+				if err != nil {
+					return fmt.Errorf("failed to encrypt as nip04: %w", err)
+				}
+				stdout(ciphertext)
+				return nil
+			}
+
 			sec, bunker, err := gatherSecretKeyOrBunkerFromArguments(ctx, c)
 			if err != nil {
 				return err
@@ -69,16 +94,94 @@ var encrypt = &cli.Command{
 	},
 }
 
+var encryptInspect = &cli.Command{
+	Name:  "inspect",
+	Usage: "prints what can be known about a nip44 or nip04 ciphertext without decrypting it",
+	Description: `the payload can also be a whole event (kind 4, 13, 1059 or 24133), in which case its content is inspected.
+
+for nip44 payloads the MAC is verified if a --conversation-key is given, or if --recipient-pubkey is given along with our secret key, from which the conversation key is computed.
+
+example:
+  nak encrypt inspect 'AgKz...'
+  nak encrypt inspect --sec nsec1... -p npub1... 'AgKz...'`,
+	ArgsUsage:                 "<payload>",
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "conversation-key",
+			Usage: "nip44 conversation key as hex, used to check the MAC",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		payload, err := readEncryptedPayload(c)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(payload, "{") {
+			var evt nostr.Event
+			if err := easyjson.Unmarshal([]byte(payload), &evt); err != nil {
+				return fmt.Errorf("invalid event: %w", err)
+			}
+			payload = evt.Content
+		}
+
+		var ck *[32]byte
+		if hckey := c.String("conversation-key"); hckey != "" {
+			var key [32]byte
+			if _, err := hex.Decode(key[:], []byte(hckey)); err != nil || len(hckey) != 64 {
+				return fmt.Errorf("invalid conversation key '%s'", hckey)
+			}
+			ck = &key
+		} else if c.IsSet("recipient-pubkey") {
+			target := getPubKey(c, "recipient-pubkey")
+			if as, ok := agentKeyerFromArguments(c); ok {
+				key, err := as.ConversationKey(target)
+				if err != nil {
+					return fmt.Errorf("failed to get the conversation key: %w", err)
+				}
+				ck = &key
+			} else {
+				sec, bunker, err := gatherSecretKeyOrBunkerFromArguments(ctx, c)
+				if err != nil {
+					return err
+				}
+				if bunker != nil {
+					return fmt.Errorf("can't get the conversation key from a bunker, pass --conversation-key")
+				}
+				key, err := nip44.GenerateConversationKey(target, sec)
+				if err != nil {
+					return fmt.Errorf("failed to compute the conversation key: %w", err)
+				}
+				ck = &key
+			}
+		}
+
+		info, err := inspectEncryptedPayload(payload, ck)
+		if err != nil {
+			return err
+		}
+		j, _ := json.Marshal(info)
+		stdout(string(j))
+		return nil
+	},
+}
+
 var decrypt = &cli.Command{
-	Name:                      "decrypt",
-	Usage:                     "decrypts a base64 nip44 ciphertext (or nip04 if specified using a flag) and returns the resulting plaintext",
-	ArgsUsage:                 "[ciphertext base64]",
+	Name:  "decrypt",
+	Usage: "decrypts a base64 nip44 or nip04 ciphertext and returns the resulting plaintext",
+	Description: `the scheme is detected from the payload (nip04 ones have an "?iv=" suffix), --nip04 forces it.
+
+instead of a ciphertext a whole event can be given (kind 4, 13, 1059 or 24133), in which case its content is decrypted and the sender is taken from it (or from its "p" tag if we are the author).
+
+example:
+  nak decrypt --sec nsec1... -p npub1... 'AgKz...'
+  nak req -k 4 -p <our pubkey> --limit 1 relay.damus.io | nak decrypt --sec nsec1...`,
+	ArgsUsage:                 "[ciphertext base64 or event]",
 	DisableSliceFlagSeparator: true,
 	Flags: []cli.Flag{
 		&PubKeyFlag{
-			Name:     "sender-pubkey",
-			Aliases:  []string{"p", "src", "source", "pubkey", "from"},
-			Required: true,
+			Name:    "sender-pubkey",
+			Aliases: []string{"p", "src", "source", "pubkey", "from"},
 		},
 		&cli.BoolFlag{
 			Name:  "nip04",
@@ -86,46 +189,235 @@ var decrypt = &cli.Command{
 		},
 	},
 	Action: func(ctx context.Context, c *cli.Command) error {
-		source := getPubKey(c, "sender-pubkey")
+		ciphertext, err := readEncryptedPayload(c)
+		if err != nil {
+			return err
+		}
 
-		ciphertext := c.Args().First()
+		var source nostr.PubKey
+		hasSource := c.IsSet("sender-pubkey")
+		if hasSource {
+			source = getPubKey(c, "sender-pubkey")
+		}
 
-		if c.Bool("nip04") {
-			sec, bunker, err := gatherSecretKeyOrBunkerFromArguments(ctx, c)
-			if err != nil {
-				return err
+		var evt *nostr.Event
+		if strings.HasPrefix(ciphertext, "{") {
+			evt = &nostr.Event{}
+			if err := easyjson.Unmarshal([]byte(ciphertext), evt); err != nil {
+				return fmt.Errorf("invalid event: %w", err)
+			}
+			switch evt.Kind {
+			case 4, 13, 1059, 24133:
+			default:
+				return fmt.Errorf("don't know how to decrypt an event of kind %d", evt.Kind)
 			}
+			ciphertext = evt.Content
+		}
 
-			if bunker != nil {
-				plaintext, err := bunker.NIP04Decrypt(ctx, source, ciphertext)
-				if err != nil {
+		// the sender of an event is its author, unless it is us, then the other side is whoever it was sent to
+		resolveSource := func(us nostr.PubKey) error {
+			if !hasSource && evt != nil {
+				source = evt.PubKey
+				if evt.PubKey == us {
+					tag := evt.Tags.Find("p")
+					if tag == nil {
+						return fmt.Errorf("event is ours but has no \"p\" tag saying who it was sent to")
+					}
+					var err error
+					if source, err = nostr.PubKeyFromHex(tag[1]); err != nil {
+						return fmt.Errorf("invalid \"p\" tag: %w", err)
+					}
+				}
+				hasSource = true
+			}
+			if !hasSource {
+				return fmt.Errorf("missing --sender-pubkey")
+			}
+			return nil
+		}
+
+		if c.Bool("nip04") || isNIP04Payload(ciphertext) {
+			// the inner scopes shadow err, so the decryption error has its own name
+			var plaintext string
+			var decryptErr error
+			if as, ok := agentKeyerFromArguments(c); ok {
+				if err := resolveSource(as.pubkey); err != nil {
 					return err
 				}
-				stdout(plaintext)
+				plaintext, decryptErr = as.NIP04Decrypt(ctx, source, ciphertext)
 			} else {
-				ss, err := nip04.ComputeSharedSecret(source, sec)
+				sec, bunker, err := gatherSecretKeyOrBunkerFromArguments(ctx, c)
 				if err != nil {
-					return fmt.Errorf("failed to compute nip04 shared secret: %w", err)
+					return err
+				}
+
+				if bunker != nil {
+					us, err := bunker.GetPublicKey(ctx)
+					if err != nil {
+						return fmt.Errorf("failed to get our public key: %w", err)
+					}
+					if err := resolveSource(us); err != nil {
+						return err
+					}
+					plaintext, err := bunker.NIP04Decrypt(ctx, source, ciphertext)
+					if err != nil {
+						return err
+					}
+					stdout(plaintext)
+					return nil
+				}
+
+				if err := resolveSource(sec.Public()); err != nil {
+					return err
 				}
-				plaintext, err := nip04.Decrypt(ciphertext, ss)
+				ss, err := nip04.ComputeSharedSecret(source, sec)
 				if err != nil {
-					return fmt.Errorf("failed to decrypt as nip04: %w", err)
+					return fmt.Errorf("failed to compute nip04 shared secret: %w", err)
 				}
-				stdout(plaintext)
+				plaintext, decryptErr = nip04.Decrypt(ciphertext, ss)
 			}
-		} else {
-			kr, _, err := gatherKeyerFromArguments(ctx, c)
-			if err != nil {
-				return err
+			if decryptErr != nil {
+				info, ierr := inspectEncryptedPayload(ciphertext, nil)
+				if ierr != nil {
+					return fmt.Errorf("failed to decrypt as nip04: %w (%s)", decryptErr, ierr)
+				}
+				return fmt.Errorf("failed to decrypt as nip04: %w (iv %s, %d bytes of ciphertext; wrong sender or key?)",
+					decryptErr, info.Nonce, info.Length)
 			}
+			stdout(plaintext)
+			return nil
+		}
 
-			res, err := kr.Decrypt(ctx, ciphertext, source)
-			if err != nil {
-				return fmt.Errorf("failed to decrypt: %w", err)
-			}
-			stdout(res)
+		kr, sec, err := gatherKeyerFromArguments(ctx, c)
+		if err != nil {
+			return err
+		}
+		us, err := kr.GetPublicKey(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get our public key: %w", err)
+		}
+		if err := resolveSource(us); err != nil {
+			return err
 		}
 
+		res, err := kr.Decrypt(ctx, ciphertext, source)
+		if err != nil {
+			// give some details about why it failed, checking the mac is only possible if we have the plain key
+			var ck *[32]byte
+			if sec != [32]byte{} {
+				if key, err := nip44.GenerateConversationKey(source, sec); err == nil {
+					ck = &key
+				}
+			}
+			info, ierr := inspectEncryptedPayload(ciphertext, ck)
+			switch {
+			case ierr != nil:
+				return fmt.Errorf("failed to decrypt: %w (%s)", err, ierr)
+			case info.MACValid != nil && !*info.MACValid:
+				return fmt.Errorf("failed to decrypt: %w (the MAC doesn't match, it wasn't encrypted between us and %s)",
+					err, source.Hex())
+			default:
+				return fmt.Errorf("failed to decrypt: %w (version %d, %d bytes padded)", err, info.Version, info.Length)
+			}
+		}
+		stdout(res)
 		return nil
 	},
 }
+
+// encryptedPayloadInfo is what "nak encrypt inspect" prints
+type encryptedPayloadInfo struct {
+	Scheme   string `json:"scheme"`
+	Version  int    `json:"version,omitempty"`
+	Nonce    string `json:"nonce"`
+	Length   int    `json:"length"` // padded plaintext for nip44, ciphertext for nip04
+	MAC      string `json:"mac,omitempty"`
+	MACValid *bool  `json:"mac_valid,omitempty"`
+}
+
+func readEncryptedPayload(c *cli.Command) (string, error) {
+	payload := c.Args().First()
+	if payload == "" && isPiped() {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read stdin: %w", err)
+		}
+		payload = string(data)
+	}
+	payload = strings.TrimSpace(payload)
+	if payload == "" {
+		return "", fmt.Errorf("no payload given")
+	}
+	return payload, nil
+}
+
+func isNIP04Payload(payload string) bool {
+	return strings.Contains(payload, "?iv=")
+}
+
+// inspectEncryptedPayload decodes a nip04 or nip44 payload and, for nip44, checks the MAC if the
+// conversation key is given
+func inspectEncryptedPayload(payload string, ck *[32]byte) (encryptedPayloadInfo, error) {
+	if isNIP04Payload(payload) {
+		spl := strings.SplitN(payload, "?iv=", 2)
+		ciphertext, err := base64.StdEncoding.DecodeString(spl[0])
+		if err != nil {
+			return encryptedPayloadInfo{}, fmt.Errorf("invalid nip04 ciphertext base64: %w", err)
+		}
+		iv, err := base64.StdEncoding.DecodeString(spl[1])
+		if err != nil {
+			return encryptedPayloadInfo{}, fmt.Errorf("invalid nip04 iv base64: %w", err)
+		}
+		if len(iv) != 16 {
+			return encryptedPayloadInfo{}, fmt.Errorf("nip04 iv should have 16 bytes, has %d", len(iv))
+		}
+		if len(ciphertext) == 0 || len(ciphertext)%16 != 0 {
+			return encryptedPayloadInfo{}, fmt.Errorf("nip04 ciphertext should be a multiple of 16 bytes, has %d", len(ciphertext))
+		}
+		return encryptedPayloadInfo{
+			Scheme: "nip04",
+			Nonce:  hex.EncodeToString(iv),
+			Length: len(ciphertext),
+		}, nil
+	}
+
+	if strings.HasPrefix(payload, "#") {
+		return encryptedPayloadInfo{}, fmt.Errorf("unsupported nip44 version (payload starts with #)")
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return encryptedPayloadInfo{}, fmt.Errorf("not nip04 and not valid nip44 base64: %w", err)
+	}
+	if len(data) < 99 {
+		return encryptedPayloadInfo{}, fmt.Errorf("nip44 payload too short: %d bytes", len(data))
+	}
+	if data[0] != 2 {
+		return encryptedPayloadInfo{}, fmt.Errorf("unsupported nip44 version %d", data[0])
+	}
+
+	nonce := data[1:33]
+	ciphertext := data[33 : len(data)-32]
+	mac := data[len(data)-32:]
+	info := encryptedPayloadInfo{
+		Scheme:  "nip44",
+		Version: int(data[0]),
+		Nonce:   hex.EncodeToString(nonce),
+		Length:  len(ciphertext),
+		MAC:     hex.EncodeToString(mac),
+	}
+
+	if ck != nil {
+		// the hmac key is the last 32 bytes of the 76 expanded from the conversation key with the nonce
+		okm := make([]byte, 76)
+		if _, err := io.ReadFull(hkdf.Expand(sha256.New, ck[:], nonce), okm); err != nil {
+			return info, fmt.Errorf("failed to derive message keys: %w", err)
+		}
+		h := hmac.New(sha256.New, okm[44:76])
+		h.Write(nonce)
+		h.Write(ciphertext)
+		valid := hmac.Equal(h.Sum(nil), mac)
+		info.MACValid = &valid
+	}
+
+	return info, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip44"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectEncryptedPayload(t *testing.T) {
+	// first valid vector from the nip44 spec
+	sec1 := nostr.SecretKey{31: 1}
+	sec2 := nostr.SecretKey{31: 2}
+	payload := "AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAABee0G5VSK0/9YypIObAtDKfYEAjD35uVkHyB0F4DwrcNaCXlCWZKaArsGrY6M9wnuTMxWfp1RTN9Xga8no+kF5Vsb"
+
+	ck, err := nip44.GenerateConversationKey(sec2.Public(), sec1)
+	require.NoError(t, err)
+	require.Equal(t, "c41c775356fd92eadc63ff5a0dc1da211b268cbea22316767095b2871ea1412d", hex.EncodeToString(ck[:]))
+	plaintext, err := nip44.Decrypt(payload, ck)
+	require.NoError(t, err)
+	require.Equal(t, "a", plaintext)
+
+	info, err := inspectEncryptedPayload(payload, &ck)
+	require.NoError(t, err)
+	require.Equal(t, "nip44", info.Scheme)
+	require.Equal(t, 2, info.Version)
+	require.Equal(t, "0000000000000000000000000000000000000000000000000000000000000001", info.Nonce)
+	require.Equal(t, 34, info.Length)
+	require.NotNil(t, info.MACValid)
+	require.True(t, *info.MACValid)
+
+	// another conversation key doesn't match the mac
+	other, err := nip44.GenerateConversationKey(nostr.SecretKey{31: 3}.Public(), sec1)
+	require.NoError(t, err)
+	info, err = inspectEncryptedPayload(payload, &other)
+	require.NoError(t, err)
+	require.False(t, *info.MACValid)
+
+	// without a key the mac isn't checked
+	info, err = inspectEncryptedPayload(payload, nil)
+	require.NoError(t, err)
+	require.Nil(t, info.MACValid)
+
+	// nip04
+	info, err = inspectEncryptedPayload("zJxfaJ32rN5Dg1ODjOlEew==?iv=EV5bUjcc4OX2Km/icaLl8A==", nil)
+	require.NoError(t, err)
+	require.Equal(t, "nip04", info.Scheme)
+	require.Equal(t, 16, info.Length)
+
+	_, err = inspectEncryptedPayload("#AgAAAA", nil)
+	require.Error(t, err)
+	_, err = inspectEncryptedPayload("AgAAAA==", nil)
+	require.Error(t, err)
+}
@@ -11,7 +11,6 @@ import (
 
 	"fiatjaf.com/nostr"
 	"fiatjaf.com/nostr/keyer"
-	"fiatjaf.com/nostr/nip13"
 	"fiatjaf.com/nostr/nip19"
 	"fiatjaf.com/nostr/schema"
 	"github.com/fatih/color"
@@ -24,6 +23,7 @@ const (
 	CATEGORY_SIGNER       = "SIGNER OPTIONS"
 	CATEGORY_EXTRAS       = "EXTRAS"
 	CATEGORY_AUTH         = "AUTH"
+	CATEGORY_TEMPLATES    = "TEMPLATES"
 )
 
 var eventCmd = &cli.Command{
@@ -74,6 +74,12 @@ example:
 			Value:    false,
 			Category: CATEGORY_SIGNER,
 		},
+		&cli.UintFlag{
+			Name:     "bunker-window",
+			Usage:    "when signing many events from stdin with a bunker, how many sign requests to keep in flight at the same time",
+			Value:    16,
+			Category: CATEGORY_SIGNER,
+		},
 		&cli.BoolFlag{
 			Name:     "no-sign",
 			Usage:    "print the event without signing it, using the specified pubkey",
@@ -85,6 +91,16 @@ example:
 			Usage:    "nip13 difficulty to target when doing hash work on the event id",
 			Category: CATEGORY_EXTRAS,
 		},
+		&cli.DurationFlag{
+			Name:     "pow-timeout",
+			Usage:    "give up mining after this long, progress is saved so calling the same command again resumes from where it stopped",
+			Category: CATEGORY_EXTRAS,
+		},
+		&cli.BoolFlag{
+			Name:     "force",
+			Usage:    "publish a replaceable event even if it is older than the current version or would drop most of its entries",
+			Category: CATEGORY_EXTRAS,
+		},
 		&cli.BoolFlag{
 			Name:     "envelope",
 			Usage:    "print the event enveloped in a [\"EVENT\", ...] message ready to be sent to a relay",
@@ -172,6 +188,21 @@ example:
 			Usage:    "ask before publishing the event",
 			Category: CATEGORY_EXTRAS,
 		},
+		&cli.StringFlag{
+			Name:     "template",
+			Usage:    "load kind, content and tags from a template saved with --save-template, flags given explicitly take precedence",
+			Category: CATEGORY_TEMPLATES,
+		},
+		&cli.StringSliceFlag{
+			Name:     "var",
+			Usage:    "value for a {{placeholder}} in the --template, as key=value (missing ones are taken from environment variables or prompted for)",
+			Category: CATEGORY_TEMPLATES,
+		},
+		&cli.StringFlag{
+			Name:     "save-template",
+			Usage:    "instead of making an event, save the given kind, content and tag flags as a template with this name",
+			Category: CATEGORY_TEMPLATES,
+		},
 
 		// hidden
 		&cli.StringFlag{
@@ -184,7 +215,32 @@ example:
 		},
 	),
 	ArgsUsage: "[relay...]",
+	Commands: []*cli.Command{
+		eventEdit,
+	},
 	Action: func(ctx context.Context, c *cli.Command) error {
+		if name := c.String("save-template"); name != "" {
+			path, err := saveEventTemplate(c, name, eventTemplateFromFlags(c))
+			if err != nil {
+				return err
+			}
+			log("template saved to %s\n", color.CyanString(path))
+			return nil
+		}
+
+		var tmpl *EventTemplate
+		if name := c.String("template"); name != "" {
+			loaded, err := loadEventTemplate(c, name)
+			if err != nil {
+				return err
+			}
+			filled, err := loaded.fill(c.StringSlice("var"))
+			if err != nil {
+				return err
+			}
+			tmpl = &filled
+		}
+
 		argRelayUrls := c.Args().Slice()
 
 		kr, sec, err := gatherKeyerFromArguments(ctx, c)
@@ -199,40 +255,43 @@ example:
 
 		// then process input and generate events:
 
-		// will reuse this
-		var evt nostr.Event
-
-		// this is called when we have a valid json from stdin
-		handleEvent := func(stdinEvent string) error {
-			evt.Content = ""
-			evt.CreatedAt = 0
-			evt.Tags = evt.Tags[:0]
-			evt.ID = nostr.ZeroID
-			evt.PubKey = nostr.ZeroPK
-			evt.Sig = [64]byte{}
-
+		// this is called when we have a valid json from stdin, it fills in the event
+		// and tells if it must be signed again
+		prepareEvent := func(stdinEvent string) (evt nostr.Event, mustRehashAndResign bool, err error) {
 			kindWasSupplied := strings.Contains(stdinEvent, `"kind"`)
 			contentWasSupplied := strings.Contains(stdinEvent, `"content"`)
-			mustRehashAndResign := false
 
 			if err := easyjson.Unmarshal([]byte(stdinEvent), &evt); err != nil {
-				return fmt.Errorf("invalid event received from stdin: %s", err)
+				return evt, false, fmt.Errorf("invalid event received from stdin: %s", err)
 			}
 
+			tmplKind, tmplContent := tmpl.defaults(
+				kindWasSupplied || c.IsSet("kind"),
+				contentWasSupplied || c.IsSet("content"),
+			)
+
 			if c.IsSet("kind") {
 				evt.Kind = getKind(c, "kind")
 				mustRehashAndResign = true
+			} else if tmplKind != nil {
+				evt.Kind = *tmplKind
+				mustRehashAndResign = true
 			} else if !kindWasSupplied {
 				evt.Kind = 1
 				mustRehashAndResign = true
 			}
 
-			if c.IsSet("content") {
-				content := c.String("content")
+			if c.IsSet("content") || tmplContent != nil {
+				var content string
+				if c.IsSet("content") {
+					content = c.String("content")
+				} else {
+					content = *tmplContent
+				}
 				if strings.HasPrefix(content, "@") {
 					filedata, err := os.ReadFile(content[1:])
 					if err != nil {
-						return fmt.Errorf("failed to read file '%s' for content: %w", content[1:], err)
+						return evt, false, fmt.Errorf("failed to read file '%s' for content: %w", content[1:], err)
 					}
 					evt.Content = string(filedata)
 				} else {
@@ -245,24 +304,12 @@ example:
 			}
 
 			tagFlags := c.StringSlice("tag")
+			if tmpl != nil {
+				tagFlags = append(slices.Clone(tmpl.Tags), tagFlags...)
+			}
 			tags := make(nostr.Tags, 0, len(tagFlags)+2)
 			for _, tagFlag := range tagFlags {
-				// tags are in the format key=value
-				tagName, tagValue, found := strings.Cut(tagFlag, "=")
-				tag := []string{tagName}
-				if found {
-					// tags may also contain extra elements separated with a ";"
-					tagValues := strings.Split(tagValue, ";")
-					val := tagValues[0]
-					if len(tagName) == 1 {
-						val = decodeTagValue(val, rune(tagName[0]))
-					}
-					if len(tagValues) >= 1 {
-						tagValues[0] = val
-					}
-					tag = append(tag, tagValues...)
-				}
-				tags = append(tags, tag)
+				tags = append(tags, parseTagFlag(tagFlag))
 			}
 
 			for _, etag := range c.StringSlice("e") {
@@ -302,7 +349,7 @@ example:
 				// or is it an "author" pubkey?
 				if a.PubKey != nostr.ZeroPK {
 					if authorPubKey != nostr.ZeroPK {
-						return fmt.Errorf("multiple author pubkeys provided")
+						return evt, false, fmt.Errorf("multiple author pubkeys provided")
 					}
 					authorPubKey = a.PubKey
 				}
@@ -329,31 +376,54 @@ example:
 				mustRehashAndResign = true
 			}
 
+			// don't let a stale or half-empty list silently replace the one on the relays,
+			// checked before the pow so we don't mine an event we'll refuse anyway
+			if (len(argRelayUrls) > 0 || c.Bool("outbox")) && !c.Bool("no-sign") &&
+				(evt.Kind.IsReplaceable() || evt.Kind.IsAddressable()) && c.Uint("musig") <= 1 {
+				if evt.PubKey == nostr.ZeroPK || mustRehashAndResign {
+					evt.PubKey, _ = kr.GetPublicKey(ctx)
+				}
+				if err := guardReplaceableOverwrite(ctx, slices.Clone(argRelayUrls), evt, c.Bool("force")); err != nil {
+					return evt, false, err
+				}
+			}
+
 			if difficulty := c.Uint("pow"); difficulty > 0 {
 				// before doing pow we need the pubkey
 				if numSigners := c.Uint("musig"); numSigners > 1 {
 					pubkeys := c.StringSlice("musig-pubkey")
 					if int(numSigners) != len(pubkeys) {
-						return fmt.Errorf("when doing a pow with musig we must know all signer pubkeys upfront")
+						return evt, false, fmt.Errorf("when doing a pow with musig we must know all signer pubkeys upfront")
 					}
 					evt.PubKey, err = getMusigAggregatedKey(ctx, pubkeys)
 					if err != nil {
-						return err
+						return evt, false, err
 					}
 				} else if evt.PubKey == nostr.ZeroPK {
 					evt.PubKey, _ = kr.GetPublicKey(ctx)
 				}
 
-				// try to generate work with this difficulty -- runs forever
-				nonceTag, _ := nip13.DoWork(ctx, evt, int(difficulty))
-				evt.Tags = append(evt.Tags, nonceTag)
+				// a previous musig peer may have already done the work
+				if !hasEnoughPow(evt, int(difficulty)) {
+					nonceTag, err := doEventPow(ctx, c, &evt, int(difficulty))
+					if err != nil {
+						return evt, false, err
+					}
+					evt.Tags = append(evt.Tags, nonceTag)
+				}
 
 				mustRehashAndResign = true
 			}
 
+			return evt, mustRehashAndResign, nil
+		}
+
+		// signs the event unless --no-sign was given, returns false when the event is not ready
+		// to be published yet (when musig still needs more rounds)
+		signEvent := func(evt *nostr.Event, mustRehashAndResign bool) (bool, error) {
 			if c.Bool("no-sign") {
 				if evt.PubKey == nostr.ZeroPK {
-					return fmt.Errorf("--no-sign requires a pubkey in the event or via --author")
+					return false, fmt.Errorf("--no-sign requires a pubkey in the event or via --author")
 				}
 				evt.ID = nostr.ZeroID
 				evt.Sig = [64]byte{}
@@ -365,23 +435,28 @@ example:
 					pubNonces := c.StringSlice("musig-nonce")
 					partialSigs := c.StringSlice("musig-partial")
 					signed, err := performMusig(ctx,
-						sec, &evt, int(numSigners), pubkeys, pubNonces, secNonce, partialSigs)
+						sec, evt, int(numSigners), pubkeys, pubNonces, secNonce, partialSigs)
 					if err != nil {
-						return fmt.Errorf("musig error: %w", err)
+						return false, fmt.Errorf("musig error: %w", err)
 					}
 					if !signed {
 						// we haven't finished signing the event, so the users still have to do more steps
 						// instructions for what to do should have been printed by the performMusig() function
-						return nil
+						return false, nil
 					}
-				} else if err := kr.SignEvent(ctx, &evt); err != nil {
+				} else if err := kr.SignEvent(ctx, evt); err != nil {
 					if _, isBunker := kr.(keyer.BunkerSigner); isBunker && errors.Is(ctx.Err(), context.DeadlineExceeded) {
 						err = fmt.Errorf("timeout waiting for bunker to respond")
 					}
-					return fmt.Errorf("error signing with provided key: %w", err)
+					return false, fmt.Errorf("error signing with provided key: %w", err)
 				}
 			}
 
+			return true, nil
+		}
+
+		// prints and publishes the final event
+		finishEvent := func(evt nostr.Event) error {
 			var relays []*nostr.Relay
 			// start from the given relays on every event so --outbox additions
 			// for one event don't leak into the next
@@ -442,9 +517,39 @@ example:
 			return publishFlow(ctx, c, kr, evt, relays)
 		}
 
-		for stdinEvent := range getJsonsOrBlank() {
-			if err := handleEvent(stdinEvent); err != nil {
-				ctx = lineProcessingError(ctx, err.Error())
+		if _, isBunker := kr.(keyer.BunkerSigner); isBunker && c.Uint("bunker-window") > 1 &&
+			c.Uint("musig") <= 1 && !c.Bool("no-sign") {
+			// send many sign requests to the bunker at the same time instead of waiting for each
+			type pendingEvent struct {
+				evt                 nostr.Event
+				mustRehashAndResign bool
+			}
+			ctx = processPipelined(ctx, getJsonsOrBlank(), int(c.Uint("bunker-window")),
+				func(stdinEvent string) (pendingEvent, error) {
+					evt, mustRehashAndResign, err := prepareEvent(stdinEvent)
+					return pendingEvent{evt, mustRehashAndResign}, err
+				},
+				func(p pendingEvent) (pendingEvent, error) {
+					_, err := signEvent(&p.evt, p.mustRehashAndResign)
+					return p, err
+				},
+				func(p pendingEvent) error {
+					return finishEvent(p.evt)
+				},
+			)
+		} else {
+			for stdinEvent := range getJsonsOrBlank() {
+				evt, mustRehashAndResign, err := prepareEvent(stdinEvent)
+				if err == nil {
+					var ready bool
+					ready, err = signEvent(&evt, mustRehashAndResign)
+					if err == nil && ready {
+						err = finishEvent(evt)
+					}
+				}
+				if err != nil {
+					ctx = lineProcessingError(ctx, err.Error())
+				}
 			}
 		}
 
@@ -453,6 +558,26 @@ example:
 	},
 }
 
+// parseTagFlag turns a value like "e=<id>" or "sometag=value one;value two" into a tag
+func parseTagFlag(tagFlag string) nostr.Tag {
+	// tags are in the format key=value
+	tagName, tagValue, found := strings.Cut(tagFlag, "=")
+	tag := nostr.Tag{tagName}
+	if found {
+		// tags may also contain extra elements separated with a ";"
+		tagValues := strings.Split(tagValue, ";")
+		val := tagValues[0]
+		if len(tagName) == 1 {
+			val = decodeTagValue(val, rune(tagName[0]))
+		}
+		if len(tagValues) >= 1 {
+			tagValues[0] = val
+		}
+		tag = append(tag, tagValues...)
+	}
+	return tag
+}
+
 func publishFlow(ctx context.Context, c *cli.Command, kr nostr.Signer, evt nostr.Event, relays []*nostr.Relay) error {
 	doAuth := c.Bool("auth")
 
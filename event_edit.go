@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"fiatjaf.com/nostr/nip19"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+)
+
+var eventEdit = &cli.Command{
+	Name:  "edit",
+	Usage: "fetches the latest version of a replaceable or addressable event, opens it in $EDITOR and republishes it",
+	Description: `the event is fetched from the author's outbox relays (plus any relay hints in the naddr), then opened in your editor with one tag per line (as JSON arrays) followed by a '---' line and the raw content.
+
+after editing a diff is shown and the new version is published with a bumped created_at, unless a newer version showed up on the relays in the meantime.
+
+example:
+		nak event edit 0
+		nak event edit 30023 -d my-article
+		nak event edit naddr1...`,
+	ArgsUsage:                 "<naddr|kind> [relay...]",
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "do not ask for confirmation after showing the diff",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		if c.Args().Len() == 0 {
+			return fmt.Errorf("missing naddr or kind")
+		}
+
+		kr, _, err := gatherKeyerFromArguments(ctx, c)
+		if err != nil {
+			return err
+		}
+		pk, err := kr.GetPublicKey(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get our public key: %w", err)
+		}
+
+		var kind nostr.Kind
+		var dTag string
+		var relayUrls []string
+		target := c.Args().First()
+		if prefix, value, err := nip19.Decode(target); err == nil {
+			if prefix != "naddr" {
+				return fmt.Errorf("expected naddr or kind, got %s", prefix)
+			}
+			ptr := value.(nostr.EntityPointer)
+			if ptr.PublicKey != pk {
+				return fmt.Errorf("naddr points to an event by %s, but we are %s", ptr.PublicKey.Hex(), pk.Hex())
+			}
+			kind = ptr.Kind
+			dTag = ptr.Identifier
+			relayUrls = append(relayUrls, ptr.Relays...)
+		} else {
+			kind, err = stringToKind(target)
+			if err != nil {
+				return err
+			}
+			if ds := c.StringSlice("d"); len(ds) > 0 {
+				dTag = ds[0]
+			}
+		}
+
+		if !kind.IsReplaceable() && !kind.IsAddressable() {
+			return fmt.Errorf("kind %d is not replaceable or addressable", kind)
+		}
+		if !kind.IsAddressable() {
+			dTag = ""
+		}
+
+		relayUrls = nostr.AppendUnique(relayUrls, sys.FetchWriteRelays(ctx, pk)...)
+		for i, url := range relayUrls {
+			relayUrls[i] = nostr.NormalizeURL(url)
+		}
+
+		current := fetchLatestReplaceable(ctx, relayUrls, pk, kind, dTag)
+		if current == nil {
+			log("no existing kind:%d event found, starting from scratch\n", kind)
+			current = &nostr.Event{Kind: kind, PubKey: pk, Tags: nostr.Tags{}}
+			if kind.IsAddressable() {
+				current.Tags = append(current.Tags, nostr.Tag{"d", dTag})
+			}
+		} else {
+			log("editing %s from %s\n", color.CyanString(current.ID.Hex()), current.CreatedAt.Time().Format("2006-01-02 15:04:05"))
+		}
+
+		edited, err := editWithDefaultEditor(
+			fmt.Sprintf("nak-edit-%d-%s.txt", kind, pk.Hex()[0:8]),
+			formatEventForEditing(*current),
+			true,
+		)
+		if err != nil {
+			return err
+		}
+
+		tags, content, err := parseEditedEvent(edited)
+		if err != nil {
+			return err
+		}
+		if kind.IsAddressable() {
+			d := ""
+			if dt := tags.Find("d"); dt != nil {
+				d = dt[1]
+			}
+			if d != dTag {
+				return fmt.Errorf("the 'd' tag can't be changed (from %q to %q), that would be a different event", dTag, d)
+			}
+		}
+
+		if content == current.Content && slices.EqualFunc(tags, current.Tags, func(a, b nostr.Tag) bool {
+			return slices.Equal(a, b)
+		}) {
+			log("no changes.\n")
+			return nil
+		}
+
+		log("%s\n", colors.bold("tags:"))
+		printLinesDiff(tagsToLines(current.Tags), tagsToLines(tags))
+		log("%s\n", colors.bold("content:"))
+		printLinesDiff(strings.Split(current.Content, "\n"), strings.Split(content, "\n"))
+
+		if !c.Bool("yes") && !askConfirmation("publish this new version? [y/n] ") {
+			return fmt.Errorf("aborted")
+		}
+
+		// check again, someone else may have published while we were editing
+		if latest := fetchLatestReplaceable(ctx, relayUrls, pk, kind, dTag); latest != nil &&
+			latest.ID != current.ID && latest.CreatedAt >= current.CreatedAt {
+			return fmt.Errorf("a newer version (%s, from %s) was published while we were editing, refusing to overwrite it",
+				latest.ID.Hex(), latest.CreatedAt.Time().Format("2006-01-02 15:04:05"))
+		}
+
+		if current.ID != nostr.ZeroID {
+			if err := sys.Store.SaveEvent(*current); err != nil && err != eventstore.ErrDupEvent {
+				log("failed to back up the previous version: %s\n", err)
+			}
+		}
+
+		evt := nostr.Event{
+			Kind:      kind,
+			Tags:      tags,
+			Content:   content,
+			CreatedAt: max(nostr.Now(), current.CreatedAt+1),
+		}
+		if err := kr.SignEvent(ctx, &evt); err != nil {
+			return fmt.Errorf("error signing with provided key: %w", err)
+		}
+		stdout(evt.String())
+
+		relayUrls = nostr.AppendUnique(relayUrls, c.Args().Tail()...)
+		relays := connectToAllRelays(ctx, c, relayUrls)
+		if len(relays) == 0 {
+			return fmt.Errorf("failed to connect to any of [ %v ]", relayUrls)
+		}
+
+		return publishFlow(ctx, c, kr, evt, relays)
+	},
+}
+
+func fetchLatestReplaceable(
+	ctx context.Context,
+	relays []string,
+	pk nostr.PubKey,
+	kind nostr.Kind,
+	dTag string,
+) *nostr.Event {
+	filter := nostr.Filter{
+		Kinds:   []nostr.Kind{kind},
+		Authors: []nostr.PubKey{pk},
+	}
+	if kind.IsAddressable() {
+		filter.Tags = nostr.TagMap{"d": []string{dTag}}
+	}
+
+	results := sys.Pool.FetchManyReplaceable(ctx, relays, filter, nostr.SubscriptionOptions{Label: "nak-edit"})
+	if evt, ok := results.Load(nostr.ReplaceableKey{PubKey: pk, D: dTag}); ok {
+		return &evt
+	}
+	return nil
+}
+
+func formatEventForEditing(evt nostr.Event) string {
+	b := strings.Builder{}
+	b.WriteString(fmt.Sprintf("# kind:%d -- one tag per line as a JSON array, then the raw content after the '---' line\n", evt.Kind))
+	for _, tag := range evt.Tags {
+		j, _ := json.Marshal(tag)
+		b.Write(j)
+		b.WriteByte('\n')
+	}
+	b.WriteString("---\n")
+	b.WriteString(evt.Content)
+	return b.String()
+}
+
+func parseEditedEvent(text string) (nostr.Tags, string, error) {
+	header, content, found := strings.Cut(text, "\n---\n")
+	if !found {
+		if strings.HasPrefix(text, "---\n") {
+			header, content = "", text[4:]
+		} else if h, ok := strings.CutSuffix(text, "\n---"); ok {
+			header, content = h, ""
+		} else {
+			return nil, "", fmt.Errorf("couldn't find the '---' line separating tags from content")
+		}
+	}
+
+	tags := make(nostr.Tags, 0, strings.Count(header, "\n")+1)
+	for i, line := range strings.Split(header, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var tag nostr.Tag
+		if err := json.Unmarshal([]byte(line), &tag); err != nil {
+			return nil, "", fmt.Errorf("invalid tag at line %d (%s): %w", i+1, line, err)
+		}
+		if len(tag) == 0 {
+			return nil, "", fmt.Errorf("empty tag at line %d", i+1)
+		}
+		tags = append(tags, tag)
+	}
+
+	// editors like to add a trailing newline
+	content = strings.TrimSuffix(content, "\n")
+
+	return tags, content, nil
+}
+
+func tagsToLines(tags nostr.Tags) []string {
+	lines := make([]string, len(tags))
+	for i, tag := range tags {
+		j, _ := json.Marshal(tag)
+		lines[i] = string(j)
+	}
+	return lines
+}
+
+// printLinesDiff prints a minimal line diff (based on the longest common subsequence) to stderr
+func printLinesDiff(a, b []string) {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			log("  %s\n", a[i])
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			log("%s\n", color.GreenString("+ %s", b[j]))
+			j++
+		default:
+			log("%s\n", color.RedString("- %s", a[i]))
+			i++
+		}
+	}
+}
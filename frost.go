@@ -0,0 +1,1072 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip19"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/fatih/color"
+	"github.com/mailru/easyjson"
+	"github.com/urfave/cli/v3"
+)
+
+// like musigRumorKind, only used to recognize our gift-wrapped messages
+const frostRumorKind nostr.Kind = 21814
+
+var frost = &cli.Command{
+	Name:  "frost",
+	Usage: "t-of-n threshold keys and signatures using FROST",
+	Description: `splits a nostr identity into n shares such that any t of them can produce a normal BIP-340 signature, without the secret key ever being reassembled.
+
+shares are JSON objects printed to stdout, they must be kept secret (each one by its holder). they can be given to --share directly or as @<file>.
+
+keys can be created by a trusted dealer who knows the full secret key ("deal") or by all the participants together without anyone ever knowing it ("dkg"). signing happens over relays, like "nak musig".
+
+example:
+		nak key frost deal --threshold 2 --shares 3 nsec1...
+		nak key frost dkg --threshold 2 --participant npub1... --participant npub1... --participant npub1... relay.example.com
+		echo '{"kind":1,"content":"hello"}' | nak key frost sign --share @share.json --signer npub1... relay.example.com
+		nak key frost join <session-id> relay.example.com --share @share.json`,
+	DisableSliceFlagSeparator: true,
+	Commands: []*cli.Command{
+		{
+			Name:                      "deal",
+			Usage:                     "splits a secret key (or a new one) into shares, as a trusted dealer",
+			ArgsUsage:                 "[secret]",
+			DisableSliceFlagSeparator: true,
+			Flags: []cli.Flag{
+				&cli.UintFlag{
+					Name:     "threshold",
+					Aliases:  []string{"t"},
+					Usage:    "how many shares are needed to sign",
+					Required: true,
+				},
+				&cli.UintFlag{
+					Name:     "shares",
+					Aliases:  []string{"n"},
+					Usage:    "how many shares to create",
+					Required: true,
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				t, n := int(c.Uint("threshold")), int(c.Uint("shares"))
+				if t < 1 || t > n {
+					return fmt.Errorf("threshold must be between 1 and the number of shares")
+				}
+
+				var sk nostr.SecretKey
+				if c.Args().Len() > 0 {
+					var err error
+					sk, err = parseSecretKey(c.Args().First())
+					if err != nil {
+						return err
+					}
+				} else {
+					sk = nostr.Generate()
+				}
+
+				for _, share := range frostDeal(sk, t, n) {
+					j, _ := json.Marshal(share)
+					stdout(string(j))
+				}
+
+				log("group key: %s\n", color.CyanString(nip19.EncodeNpub(sk.Public())))
+				return nil
+			},
+		},
+		{
+			Name:  "dkg",
+			Usage: "generates a new key together with the other participants over relays, nobody ever learns the full secret key",
+			Description: `all participants must call this command with the same --threshold, --participant list (which may or may not include themselves) and --label. messages are gift-wrapped to each participant's pubkey. each one gets their own share in the end.
+
+use a different --label to run it again with the same participants.`,
+			ArgsUsage:                 "[relay...]",
+			DisableSliceFlagSeparator: true,
+			Flags: []cli.Flag{
+				&cli.UintFlag{
+					Name:     "threshold",
+					Aliases:  []string{"t"},
+					Usage:    "how many shares are needed to sign",
+					Required: true,
+				},
+				&PubKeySliceFlag{
+					Name:     "participant",
+					Usage:    "pubkey of each participant",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "label",
+					Usage: "an arbitrary string that identifies this key generation session",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				relays := c.Args().Slice()
+				if len(relays) == 0 {
+					return fmt.Errorf("at least one relay is needed to run the key generation")
+				}
+				for i, url := range relays {
+					relays[i] = nostr.NormalizeURL(url)
+				}
+
+				kr, _, err := gatherKeyerFromArguments(ctx, c)
+				if err != nil {
+					return err
+				}
+				us, err := kr.GetPublicKey(ctx)
+				if err != nil {
+					return err
+				}
+
+				participants := getPubKeySlice(c, "participant")
+				if !slices.Contains(participants, us) {
+					participants = append(participants, us)
+				}
+				slices.SortFunc(participants, func(a, b nostr.PubKey) int { return strings.Compare(a.Hex(), b.Hex()) })
+				participants = slices.Compact(participants)
+
+				t, n := int(c.Uint("threshold")), len(participants)
+				if n < 2 {
+					return fmt.Errorf("at least one other participant is needed")
+				}
+				if t < 1 || t > n {
+					return fmt.Errorf("threshold must be between 1 and the number of participants (%d)", n)
+				}
+				ourIndex := uint32(slices.Index(participants, us) + 1)
+
+				// everybody computes the same session id from the parameters
+				h := sha256.New()
+				for _, pk := range participants {
+					h.Write(pk[:])
+				}
+				fmt.Fprintf(h, "%d:%s", t, c.String("label"))
+				session := hex.EncodeToString(h.Sum(nil))[0:16]
+
+				log("key generation %s: we are participant %d of %d, threshold %d\n",
+					color.CyanString(session), ourIndex, n, t)
+
+				// our random polynomial, its commitments and a proof that we know its constant term
+				coeffs := make([]btcec.ModNScalar, t)
+				commitments := make([]btcec.JacobianPoint, t)
+				for k := range coeffs {
+					coeffs[k] = frostRandomScalar()
+					btcec.ScalarBaseMultNonConst(&coeffs[k], &commitments[k])
+				}
+				pokR, pokZ := frostProveKnowledge(session, ourIndex, coeffs[0], commitments[0])
+
+				encodedCommitments := make([]string, t)
+				for k := range commitments {
+					encodedCommitments[k] = frostEncodePoint(&commitments[k])
+				}
+
+				for j, pk := range participants {
+					if pk == us {
+						continue
+					}
+					share := frostPolyEval(coeffs, uint32(j+1))
+					shareB := share.Bytes()
+					content, _ := json.Marshal(frostMessage{
+						Type:        "dkg",
+						Session:     session,
+						Index:       ourIndex,
+						Commitments: encodedCommitments,
+						PokR:        pokR,
+						PokZ:        pokZ,
+						Share:       hex.EncodeToString(shareB[:]),
+					})
+					if err := sendGiftWrapped(ctx, kr, relays, frostRumorKind, string(content), []nostr.PubKey{pk}); err != nil {
+						return err
+					}
+				}
+
+				// our own contribution
+				finalShare := frostPolyEval(coeffs, ourIndex)
+				groupCommitments := slices.Clone(commitments)
+				received := map[nostr.PubKey]bool{us: true}
+
+				ctx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				for sender, content := range receiveGiftWrapped(ctx, kr, relays, frostRumorKind) {
+					var msg frostMessage
+					if err := json.Unmarshal([]byte(content), &msg); err != nil || msg.Session != session || msg.Type != "dkg" {
+						continue
+					}
+					idx := slices.Index(participants, sender)
+					if idx == -1 || received[sender] {
+						continue
+					}
+					if uint32(idx+1) != msg.Index || len(msg.Commitments) != t {
+						return fmt.Errorf("participant %s sent an invalid message", sender.Hex())
+					}
+
+					theirCommitments := make([]btcec.JacobianPoint, t)
+					for k, enc := range msg.Commitments {
+						if theirCommitments[k], err = frostDecodePoint(enc); err != nil {
+							return fmt.Errorf("participant %s sent an invalid commitment: %w", sender.Hex(), err)
+						}
+					}
+					if !frostVerifyKnowledge(session, msg.Index, theirCommitments[0], msg.PokR, msg.PokZ) {
+						return fmt.Errorf("participant %s sent an invalid proof of knowledge", sender.Hex())
+					}
+
+					share, err := frostDecodeScalar(msg.Share)
+					if err != nil {
+						return fmt.Errorf("participant %s sent an invalid share: %w", sender.Hex(), err)
+					}
+					var expected, got btcec.JacobianPoint
+					btcec.ScalarBaseMultNonConst(&share, &got)
+					expected = frostCommitmentEval(theirCommitments, ourIndex)
+					if !frostPointsEqual(&expected, &got) {
+						return fmt.Errorf("participant %s sent a share that doesn't match their commitments", sender.Hex())
+					}
+
+					finalShare.Add(&share)
+					for k := range groupCommitments {
+						groupCommitments[k] = frostAdd(&groupCommitments[k], &theirCommitments[k])
+					}
+					received[sender] = true
+					log("received contribution from participant %d (%d/%d)\n", msg.Index, len(received), n)
+
+					if len(received) == n {
+						share := frostNewShare(ourIndex, t, finalShare, groupCommitments)
+						j, _ := json.Marshal(share)
+						stdout(string(j))
+						log("group key: %s\n", color.CyanString(nip19.EncodeNpub(share.groupKey())))
+						return nil
+					}
+				}
+
+				return fmt.Errorf("subscription ended before all participants have sent their contributions")
+			},
+		},
+		{
+			Name:                      "sign",
+			Usage:                     "starts a signing session for the event given on stdin with the other share holders",
+			ArgsUsage:                 "[relay...]",
+			DisableSliceFlagSeparator: true,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "share",
+					Usage:    "our share, as JSON or @<file>",
+					Required: true,
+				},
+				&PubKeySliceFlag{
+					Name:     "signer",
+					Usage:    "pubkey of each of the other share holders that will sign, at least threshold-1 of them",
+					Required: true,
+				},
+				&cli.StringSliceFlag{
+					Name:  "publish-to",
+					Usage: "relays to publish the final signed event to, defaults to the relays used for the session",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				relays := c.Args().Slice()
+				if len(relays) == 0 {
+					return fmt.Errorf("at least one relay is needed to run the session")
+				}
+				for i, url := range relays {
+					relays[i] = nostr.NormalizeURL(url)
+				}
+
+				share, err := loadFrostShare(c.String("share"))
+				if err != nil {
+					return err
+				}
+				kr, _, err := gatherKeyerFromArguments(ctx, c)
+				if err != nil {
+					return err
+				}
+				us, err := kr.GetPublicKey(ctx)
+				if err != nil {
+					return err
+				}
+
+				signers := []nostr.PubKey{us}
+				for _, pk := range getPubKeySlice(c, "signer") {
+					if !slices.Contains(signers, pk) {
+						signers = append(signers, pk)
+					}
+				}
+				if len(signers) < share.Threshold {
+					return fmt.Errorf("need at least %d signers, got %d", share.Threshold, len(signers))
+				}
+
+				var evt nostr.Event
+				for stdinEvent := range getJsonsOrBlank() {
+					if err := easyjson.Unmarshal([]byte(stdinEvent), &evt); err != nil {
+						return fmt.Errorf("invalid event received from stdin: %w", err)
+					}
+					break
+				}
+				if evt.Kind == 0 && evt.Content == "" && len(evt.Tags) == 0 {
+					return fmt.Errorf("pipe the event to be signed as JSON")
+				}
+				if evt.CreatedAt == 0 {
+					evt.CreatedAt = nostr.Now()
+				}
+				if evt.Tags == nil {
+					evt.Tags = nostr.Tags{}
+				}
+				evt.PubKey = share.groupKey()
+				evt.Sig = [64]byte{}
+				evt.ID = evt.GetID()
+
+				id := randString(16)
+				log("session %s: signing as %s\n", color.CyanString(id), color.YellowString(nip19.EncodeNpub(evt.PubKey)))
+				log("the other signers should call:\n  nak key frost join %s %s --share <their-share> --sec <their-key>\n",
+					id, strings.Join(relays, " "))
+				log("%s\n", evt.String())
+
+				invite := frostMessage{
+					Type:      "invite",
+					Session:   id,
+					Event:     &evt,
+					PublishTo: c.StringSlice("publish-to"),
+				}
+				for _, pk := range signers {
+					invite.Signers = append(invite.Signers, pk.Hex())
+				}
+				content, _ := json.Marshal(invite)
+				if err := sendGiftWrapped(ctx, kr, relays, frostRumorKind, string(content), signers); err != nil {
+					return fmt.Errorf("failed to send invite: %w", err)
+				}
+
+				round := &frostRound{
+					id:        id,
+					evt:       evt,
+					share:     share,
+					signers:   signers,
+					relays:    relays,
+					publishTo: c.StringSlice("publish-to"),
+					kr:        kr,
+				}
+				return runFrostRound(ctx, c, kr, id, relays, share, round)
+			},
+		},
+		{
+			Name:                      "join",
+			Usage:                     "joins a signing session started by another share holder with \"nak key frost sign\"",
+			ArgsUsage:                 "<session-id> [relay...]",
+			DisableSliceFlagSeparator: true,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "share",
+					Usage:    "our share, as JSON or @<file>",
+					Required: true,
+				},
+				&cli.BoolFlag{
+					Name:    "yes",
+					Aliases: []string{"y"},
+					Usage:   "sign without asking for confirmation after seeing the event",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				id := c.Args().First()
+				if id == "" {
+					return fmt.Errorf("missing session id")
+				}
+				relays := c.Args().Tail()
+				if len(relays) == 0 {
+					return fmt.Errorf("at least one relay is needed to join the session")
+				}
+				for i, url := range relays {
+					relays[i] = nostr.NormalizeURL(url)
+				}
+
+				share, err := loadFrostShare(c.String("share"))
+				if err != nil {
+					return err
+				}
+				kr, _, err := gatherKeyerFromArguments(ctx, c)
+				if err != nil {
+					return err
+				}
+
+				log("waiting for the invite to session %s...\n", color.CyanString(id))
+				return runFrostRound(ctx, c, kr, id, relays, share, nil)
+			},
+		},
+	},
+}
+
+// frostDeal splits a secret key into n shares, any t of which can sign, as a trusted dealer
+func frostDeal(sk nostr.SecretKey, t int, n int) []frostShare {
+	var secret btcec.ModNScalar
+	secret.SetByteSlice(sk[:])
+
+	coeffs := make([]btcec.ModNScalar, t)
+	coeffs[0] = secret
+	for k := 1; k < t; k++ {
+		coeffs[k] = frostRandomScalar()
+	}
+
+	commitments := make([]btcec.JacobianPoint, t)
+	for k := range coeffs {
+		btcec.ScalarBaseMultNonConst(&coeffs[k], &commitments[k])
+	}
+
+	shares := make([]frostShare, n)
+	for i := 1; i <= n; i++ {
+		shares[i-1] = frostNewShare(uint32(i), t, frostPolyEval(coeffs, uint32(i)), commitments)
+	}
+	return shares
+}
+
+// frostShare is what each participant keeps. commitments are the coefficients of the sharing polynomial
+// multiplied by G, from which the public counterpart of every share can be computed.
+type frostShare struct {
+	Index       uint32   `json:"index"`
+	Threshold   int      `json:"threshold"`
+	PubKey      string   `json:"pubkey"`
+	Share       string   `json:"share"`
+	Commitments []string `json:"commitments"`
+
+	secret      btcec.ModNScalar
+	commitments []btcec.JacobianPoint
+}
+
+// frostNewShare builds a share, making sure the group key has an even Y as BIP-340 requires by negating
+// everything if it doesn't
+func frostNewShare(index uint32, threshold int, secret btcec.ModNScalar, commitments []btcec.JacobianPoint) frostShare {
+	commitments = slices.Clone(commitments)
+	group := commitments[0]
+	group.ToAffine()
+	if group.Y.IsOdd() {
+		secret.Negate()
+		for k := range commitments {
+			frostNegatePoint(&commitments[k])
+		}
+	}
+
+	b := secret.Bytes()
+	share := frostShare{
+		Index:       index,
+		Threshold:   threshold,
+		Share:       hex.EncodeToString(b[:]),
+		Commitments: make([]string, len(commitments)),
+		secret:      secret,
+		commitments: commitments,
+	}
+	for k := range commitments {
+		share.Commitments[k] = frostEncodePoint(&commitments[k])
+	}
+	share.PubKey = share.groupKey().Hex()
+	return share
+}
+
+func (s frostShare) groupKey() nostr.PubKey {
+	p := s.commitments[0]
+	p.ToAffine()
+	return nostr.PubKey(p.X.Bytes()[:])
+}
+
+// publicShare is our share multiplied by G, which anyone can compute from the commitments
+func (s frostShare) publicShare(index uint32) btcec.JacobianPoint {
+	return frostCommitmentEval(s.commitments, index)
+}
+
+func loadFrostShare(value string) (frostShare, error) {
+	var share frostShare
+
+	data := []byte(value)
+	if strings.HasPrefix(value, "@") {
+		var err error
+		data, err = os.ReadFile(value[1:])
+		if err != nil {
+			return share, fmt.Errorf("failed to read share from '%s': %w", value[1:], err)
+		}
+	}
+	if err := json.Unmarshal(data, &share); err != nil {
+		return share, fmt.Errorf("invalid share: %w", err)
+	}
+
+	var err error
+	if share.secret, err = frostDecodeScalar(share.Share); err != nil {
+		return share, fmt.Errorf("invalid share secret: %w", err)
+	}
+	if share.Threshold < 1 || len(share.Commitments) != share.Threshold {
+		return share, fmt.Errorf("share has %d commitments for threshold %d", len(share.Commitments), share.Threshold)
+	}
+	share.commitments = make([]btcec.JacobianPoint, len(share.Commitments))
+	for k, enc := range share.Commitments {
+		if share.commitments[k], err = frostDecodePoint(enc); err != nil {
+			return share, fmt.Errorf("invalid share commitment: %w", err)
+		}
+	}
+
+	var got btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(&share.secret, &got)
+	expected := share.publicShare(share.Index)
+	if !frostPointsEqual(&got, &expected) {
+		return share, fmt.Errorf("share doesn't match its commitments")
+	}
+	if share.groupKey().Hex() != share.PubKey {
+		return share, fmt.Errorf("share pubkey doesn't match its commitments")
+	}
+
+	return share, nil
+}
+
+type frostMessage struct {
+	Type    string `json:"type"`
+	Session string `json:"session"`
+	Index   uint32 `json:"index,omitempty"`
+
+	// "dkg"
+	Commitments []string `json:"commitments,omitempty"`
+	PokR        string   `json:"pok_r,omitempty"`
+	PokZ        string   `json:"pok_z,omitempty"`
+	Share       string   `json:"share,omitempty"`
+
+	// "invite"
+	Event     *nostr.Event `json:"event,omitempty"`
+	Signers   []string     `json:"signers,omitempty"`
+	PublishTo []string     `json:"publish_to,omitempty"`
+
+	// "commit"
+	D string `json:"d,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// "partial"
+	Z string `json:"z,omitempty"`
+}
+
+// frostRound holds the state of one signing session from the point of view of one signer
+type frostRound struct {
+	id        string
+	evt       nostr.Event
+	share     frostShare
+	signers   []nostr.PubKey
+	relays    []string
+	publishTo []string
+	kr        nostr.Keyer
+
+	d, e     btcec.ModNScalar
+	indexes  map[nostr.PubKey]uint32
+	nonces   map[uint32][2]btcec.JacobianPoint
+	partials map[uint32]btcec.ModNScalar
+
+	r         btcec.JacobianPoint
+	challenge btcec.ModNScalar
+	signed    bool
+}
+
+func (r *frostRound) send(ctx context.Context, msg frostMessage) error {
+	content, _ := json.Marshal(msg)
+	if err := sendGiftWrapped(ctx, r.kr, r.relays, frostRumorKind, string(content), r.signers); err != nil {
+		return fmt.Errorf("failed to send %s message: %w", msg.Type, err)
+	}
+	return nil
+}
+
+func (r *frostRound) logProgress() {
+	log("session %s: nonces %d/%d, partial signatures %d/%d\n", r.id,
+		len(r.nonces), len(r.signers), len(r.partials), len(r.signers))
+}
+
+// runFrostRound is like runMusigRound, but for FROST: first everybody sends a pair of nonce commitments,
+// then a partial signature, which are all added together when they arrive.
+func runFrostRound(
+	ctx context.Context,
+	c *cli.Command,
+	kr nostr.Keyer,
+	id string,
+	relays []string,
+	share frostShare,
+	round *frostRound,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	us, err := kr.GetPublicKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	var pending []frostMessage
+	var from []nostr.PubKey
+
+	start := func() error {
+		round.indexes = map[nostr.PubKey]uint32{us: share.Index}
+		round.nonces = make(map[uint32][2]btcec.JacobianPoint, len(round.signers))
+		round.partials = make(map[uint32]btcec.ModNScalar, len(round.signers))
+
+		round.d = frostRandomScalar()
+		round.e = frostRandomScalar()
+		var dp, ep btcec.JacobianPoint
+		btcec.ScalarBaseMultNonConst(&round.d, &dp)
+		btcec.ScalarBaseMultNonConst(&round.e, &ep)
+		round.nonces[share.Index] = [2]btcec.JacobianPoint{dp, ep}
+
+		round.logProgress()
+		return round.send(ctx, frostMessage{
+			Type:    "commit",
+			Session: round.id,
+			Index:   share.Index,
+			D:       frostEncodePoint(&dp),
+			E:       frostEncodePoint(&ep),
+		})
+	}
+
+	handle := func(sender nostr.PubKey, msg frostMessage) (bool, error) {
+		if !slices.Contains(round.signers, sender) {
+			return false, fmt.Errorf("got a message from %s, who is not one of the signers", sender.Hex())
+		}
+		if msg.Type == "invite" {
+			return false, nil
+		}
+		if idx, ok := round.indexes[sender]; ok && idx != msg.Index {
+			return false, fmt.Errorf("%s is using two different share indexes", sender.Hex())
+		}
+		for pk, idx := range round.indexes {
+			if idx == msg.Index && pk != sender {
+				return false, fmt.Errorf("%s and %s are using the same share index %d", pk.Hex(), sender.Hex(), idx)
+			}
+		}
+		if msg.Index == 0 {
+			return false, fmt.Errorf("invalid share index from %s", sender.Hex())
+		}
+		round.indexes[sender] = msg.Index
+
+		switch msg.Type {
+		case "commit":
+			if _, ok := round.nonces[msg.Index]; ok {
+				return false, nil
+			}
+			dp, err := frostDecodePoint(msg.D)
+			if err != nil {
+				return false, fmt.Errorf("invalid nonce commitment from %s: %w", sender.Hex(), err)
+			}
+			ep, err := frostDecodePoint(msg.E)
+			if err != nil {
+				return false, fmt.Errorf("invalid nonce commitment from %s: %w", sender.Hex(), err)
+			}
+			round.nonces[msg.Index] = [2]btcec.JacobianPoint{dp, ep}
+		case "partial":
+			if _, ok := round.partials[msg.Index]; ok {
+				return false, nil
+			}
+			z, err := frostDecodeScalar(msg.Z)
+			if err != nil {
+				return false, fmt.Errorf("invalid partial signature from %s: %w", sender.Hex(), err)
+			}
+			round.partials[msg.Index] = z
+		default:
+			logverbose("ignoring unknown message type '%s' from %s\n", msg.Type, sender.Hex())
+			return false, nil
+		}
+
+		// second round: once all nonce commitments are known we can sign
+		if !round.signed && len(round.nonces) == len(round.signers) {
+			z := round.sign()
+			round.partials[share.Index] = z
+			zb := z.Bytes()
+			if err := round.send(ctx, frostMessage{
+				Type:    "partial",
+				Session: round.id,
+				Index:   share.Index,
+				Z:       hex.EncodeToString(zb[:]),
+			}); err != nil {
+				return false, err
+			}
+		}
+
+		round.logProgress()
+		return round.signed && len(round.partials) == len(round.signers), nil
+	}
+
+	if round != nil {
+		if err := start(); err != nil {
+			return err
+		}
+	}
+
+	for sender, content := range receiveGiftWrapped(ctx, kr, relays, frostRumorKind) {
+		var msg frostMessage
+		if err := json.Unmarshal([]byte(content), &msg); err != nil || msg.Session != id {
+			continue
+		}
+
+		if round == nil {
+			if msg.Type != "invite" {
+				pending = append(pending, msg)
+				from = append(from, sender)
+				continue
+			}
+
+			if msg.Event == nil {
+				return fmt.Errorf("invite from %s has no event", sender.Hex())
+			}
+			if msg.Event.PubKey != share.groupKey() {
+				return fmt.Errorf("invite is for signing as %s, but our share is for %s",
+					msg.Event.PubKey.Hex(), share.groupKey().Hex())
+			}
+			signers := make([]nostr.PubKey, 0, len(msg.Signers))
+			for _, s := range msg.Signers {
+				pk, err := nostr.PubKeyFromHex(s)
+				if err != nil {
+					return fmt.Errorf("invite has an invalid signer %s: %w", s, err)
+				}
+				signers = append(signers, pk)
+			}
+			if !slices.Contains(signers, sender) || !slices.Contains(signers, us) {
+				return fmt.Errorf("invite from %s doesn't list both of us as signers", sender.Hex())
+			}
+
+			evt := *msg.Event
+			evt.ID = evt.GetID()
+			log("invited by %s to sign as one of %d signers:\n", color.CyanString(sender.Hex()), len(signers))
+			log("%s\n", evt.String())
+			if !c.Bool("yes") && !askConfirmation("sign this event? [y/n] ") {
+				return fmt.Errorf("aborted")
+			}
+
+			round = &frostRound{
+				id:        id,
+				evt:       evt,
+				share:     share,
+				signers:   signers,
+				relays:    relays,
+				publishTo: msg.PublishTo,
+				kr:        kr,
+			}
+			if err := start(); err != nil {
+				return err
+			}
+
+			for i, msg := range pending {
+				done, err := handle(from[i], msg)
+				if err != nil {
+					return err
+				}
+				if done {
+					return finishFrostRound(ctx, c, round)
+				}
+			}
+			pending = nil
+			continue
+		}
+
+		done, err := handle(sender, msg)
+		if err != nil {
+			return err
+		}
+		if done {
+			return finishFrostRound(ctx, c, round)
+		}
+	}
+
+	return fmt.Errorf("subscription ended before the session was completed")
+}
+
+// sign computes the group nonce R and the challenge, then our partial signature
+func (r *frostRound) sign() btcec.ModNScalar {
+	indexes := r.sortedIndexes()
+	rhos := r.bindingFactors(indexes)
+
+	r.r = r.nonceOf(indexes[0], rhos[indexes[0]])
+	for _, i := range indexes[1:] {
+		ri := r.nonceOf(i, rhos[i])
+		r.r = frostAdd(&r.r, &ri)
+	}
+	r.r.ToAffine()
+	rx := r.r.X.Bytes()
+
+	pk := r.share.groupKey()
+	r.challenge = frostChallenge(rx[:], pk[:], r.evt.ID[:])
+
+	// z_i = d_i + e_i * rho_i + lambda_i * s_i * c, with the nonces negated when R has an odd Y
+	rho := rhos[r.share.Index]
+	k := r.e
+	k.Mul(&rho).Add(&r.d)
+	if r.r.Y.IsOdd() {
+		k.Negate()
+	}
+	lambda := frostLagrange(r.share.Index, indexes)
+	z := r.share.secret
+	z.Mul(&lambda).Mul(&r.challenge).Add(&k)
+
+	r.signed = true
+	return z
+}
+
+// verifyPartial checks z_i * G == R_i + c * lambda_i * Y_i
+func (r *frostRound) verifyPartial(index uint32, z btcec.ModNScalar, indexes []uint32, rhos map[uint32]btcec.ModNScalar) bool {
+	ri := r.nonceOf(index, rhos[index])
+	if r.r.Y.IsOdd() {
+		frostNegatePoint(&ri)
+	}
+
+	lambda := frostLagrange(index, indexes)
+	lambda.Mul(&r.challenge)
+	yi := r.share.publicShare(index)
+	cy := frostMul(&lambda, &yi)
+	right := frostAdd(&ri, &cy)
+	var left btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(&z, &left)
+
+	return frostPointsEqual(&left, &right)
+}
+
+func (r *frostRound) sortedIndexes() []uint32 {
+	indexes := make([]uint32, 0, len(r.nonces))
+	for i := range r.nonces {
+		indexes = append(indexes, i)
+	}
+	slices.Sort(indexes)
+	return indexes
+}
+
+// nonceOf returns D_i + rho_i * E_i
+func (r *frostRound) nonceOf(index uint32, rho btcec.ModNScalar) btcec.JacobianPoint {
+	pair := r.nonces[index]
+	re := frostMul(&rho, &pair[1])
+	return frostAdd(&pair[0], &re)
+}
+
+func (r *frostRound) bindingFactors(indexes []uint32) map[uint32]btcec.ModNScalar {
+	// all the nonce commitments, in order
+	list := make([]byte, 0, len(indexes)*(4+33+33))
+	for _, i := range indexes {
+		pair := r.nonces[i]
+		list = binary.BigEndian.AppendUint32(list, i)
+		d, _ := hex.DecodeString(frostEncodePoint(&pair[0]))
+		e, _ := hex.DecodeString(frostEncodePoint(&pair[1]))
+		list = append(list, d...)
+		list = append(list, e...)
+	}
+
+	pk := r.share.groupKey()
+	rhos := make(map[uint32]btcec.ModNScalar, len(indexes))
+	for _, i := range indexes {
+		h := frostTaggedHash("FROST/rho", pk[:], r.evt.ID[:], list, binary.BigEndian.AppendUint32(nil, i))
+		var rho btcec.ModNScalar
+		rho.SetByteSlice(h[:])
+		rhos[i] = rho
+	}
+	return rhos
+}
+
+// combine checks all the partial signatures and adds them into the final signature of the event
+func (r *frostRound) combine() error {
+	indexes := r.sortedIndexes()
+	rhos := r.bindingFactors(indexes)
+
+	var z btcec.ModNScalar
+	for _, i := range indexes {
+		zi, ok := r.partials[i]
+		if !ok {
+			return fmt.Errorf("missing partial signature from share %d", i)
+		}
+		if !r.verifyPartial(i, zi, indexes, rhos) {
+			return fmt.Errorf("partial signature from share %d is invalid", i)
+		}
+		z.Add(&zi)
+	}
+
+	rx := r.r.X.Bytes()
+	zb := z.Bytes()
+	copy(r.evt.Sig[0:32], rx[:])
+	copy(r.evt.Sig[32:64], zb[:])
+	if !r.evt.VerifySignature() {
+		return fmt.Errorf("the combined signature is invalid")
+	}
+	return nil
+}
+
+func finishFrostRound(ctx context.Context, c *cli.Command, round *frostRound) error {
+	if err := round.combine(); err != nil {
+		return err
+	}
+	stdout(round.evt.String())
+
+	publishTo := round.publishTo
+	if len(publishTo) == 0 {
+		publishTo = round.relays
+	}
+	relays := connectToAllRelays(ctx, c, publishTo)
+	if len(relays) == 0 {
+		return fmt.Errorf("failed to connect to any of [ %v ]", publishTo)
+	}
+	return publishFlow(ctx, c, round.kr, round.evt, relays)
+}
+
+// frostProveKnowledge is a schnorr proof that we know the secret behind our first commitment, so nobody
+// can choose their commitments based on the others' to control the group key
+func frostProveKnowledge(session string, index uint32, secret btcec.ModNScalar, commitment btcec.JacobianPoint) (string, string) {
+	k := frostRandomScalar()
+	var r btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(&k, &r)
+
+	c := frostPokChallenge(session, index, &commitment, &r)
+	z := secret
+	z.Mul(&c).Add(&k)
+
+	zb := z.Bytes()
+	return frostEncodePoint(&r), hex.EncodeToString(zb[:])
+}
+
+func frostVerifyKnowledge(session string, index uint32, commitment btcec.JacobianPoint, encR string, encZ string) bool {
+	r, err := frostDecodePoint(encR)
+	if err != nil {
+		return false
+	}
+	z, err := frostDecodeScalar(encZ)
+	if err != nil {
+		return false
+	}
+
+	c := frostPokChallenge(session, index, &commitment, &r)
+	var left btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(&z, &left)
+	cc := frostMul(&c, &commitment)
+	right := frostAdd(&r, &cc)
+	return frostPointsEqual(&left, &right)
+}
+
+func frostPokChallenge(session string, index uint32, commitment *btcec.JacobianPoint, r *btcec.JacobianPoint) btcec.ModNScalar {
+	cb, _ := hex.DecodeString(frostEncodePoint(commitment))
+	rb, _ := hex.DecodeString(frostEncodePoint(r))
+	h := frostTaggedHash("FROST/pok", []byte(session), binary.BigEndian.AppendUint32(nil, index), cb, rb)
+	var c btcec.ModNScalar
+	c.SetByteSlice(h[:])
+	return c
+}
+
+// frostChallenge is the BIP-340 challenge, so the final signature is a normal schnorr signature
+func frostChallenge(rx []byte, pk []byte, msg []byte) btcec.ModNScalar {
+	h := frostTaggedHash("BIP0340/challenge", rx, pk, msg)
+	var c btcec.ModNScalar
+	c.SetByteSlice(h[:])
+	return c
+}
+
+func frostTaggedHash(tag string, msgs ...[]byte) [32]byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, m := range msgs {
+		h.Write(m)
+	}
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// frostLagrange computes the lagrange coefficient for index at x=0 given all the indexes taking part
+func frostLagrange(index uint32, indexes []uint32) btcec.ModNScalar {
+	var num, den btcec.ModNScalar
+	num.SetInt(1)
+	den.SetInt(1)
+	for _, j := range indexes {
+		if j == index {
+			continue
+		}
+		var xj, diff btcec.ModNScalar
+		xj.SetInt(j)
+		num.Mul(&xj)
+
+		// j - index
+		var xi btcec.ModNScalar
+		xi.SetInt(index)
+		xi.Negate()
+		diff.Add2(&xj, &xi)
+		den.Mul(&diff)
+	}
+	den.InverseNonConst()
+	return *num.Mul(&den)
+}
+
+func frostPolyEval(coeffs []btcec.ModNScalar, x uint32) btcec.ModNScalar {
+	var xs, result btcec.ModNScalar
+	xs.SetInt(x)
+	for k := len(coeffs) - 1; k >= 0; k-- {
+		result.Mul(&xs).Add(&coeffs[k])
+	}
+	return result
+}
+
+// frostCommitmentEval computes sum(C_k * x^k), which is the polynomial evaluated at x multiplied by G
+func frostCommitmentEval(commitments []btcec.JacobianPoint, x uint32) btcec.JacobianPoint {
+	var xs btcec.ModNScalar
+	xs.SetInt(x)
+	result := commitments[len(commitments)-1]
+	for k := len(commitments) - 2; k >= 0; k-- {
+		result = frostMul(&xs, &result)
+		result = frostAdd(&result, &commitments[k])
+	}
+	return result
+}
+
+func frostAdd(a, b *btcec.JacobianPoint) btcec.JacobianPoint {
+	var result btcec.JacobianPoint
+	btcec.AddNonConst(a, b, &result)
+	return result
+}
+
+func frostMul(k *btcec.ModNScalar, p *btcec.JacobianPoint) btcec.JacobianPoint {
+	var result btcec.JacobianPoint
+	btcec.ScalarMultNonConst(k, p, &result)
+	return result
+}
+
+func frostRandomScalar() btcec.ModNScalar {
+	sk, err := btcec.NewPrivateKey()
+	if err != nil {
+		panic(err)
+	}
+	return sk.Key
+}
+
+func frostNegatePoint(p *btcec.JacobianPoint) {
+	p.ToAffine()
+	p.Y.Negate(1).Normalize()
+}
+
+func frostPointsEqual(a, b *btcec.JacobianPoint) bool {
+	return frostEncodePoint(a) == frostEncodePoint(b)
+}
+
+func frostEncodePoint(p *btcec.JacobianPoint) string {
+	q := *p
+	q.ToAffine()
+	return hex.EncodeToString(btcec.NewPublicKey(&q.X, &q.Y).SerializeCompressed())
+}
+
+func frostDecodePoint(s string) (btcec.JacobianPoint, error) {
+	var p btcec.JacobianPoint
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return p, err
+	}
+	pk, err := btcec.ParsePubKey(b)
+	if err != nil {
+		return p, err
+	}
+	pk.AsJacobian(&p)
+	return p, nil
+}
+
+func frostDecodeScalar(s string) (btcec.ModNScalar, error) {
+	var k btcec.ModNScalar
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return k, err
+	}
+	if len(b) != 32 {
+		return k, fmt.Errorf("expected 32 bytes, got %d", len(b))
+	}
+	if overflow := k.SetByteSlice(b); overflow {
+		return k, fmt.Errorf("value is out of range")
+	}
+	return k, nil
+}
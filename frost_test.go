@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// frostTestRounds sets up one signing round per share, as if all the nonce commitments had been exchanged,
+// and has each signer produce its partial signature. the first round has all of them.
+func frostTestRounds(shares []frostShare, evt nostr.Event) []*frostRound {
+	rounds := make([]*frostRound, len(shares))
+	nonces := make(map[uint32][2]btcec.JacobianPoint, len(shares))
+	for i, share := range shares {
+		r := &frostRound{
+			evt:      evt,
+			share:    share,
+			partials: make(map[uint32]btcec.ModNScalar, len(shares)),
+			d:        frostRandomScalar(),
+			e:        frostRandomScalar(),
+		}
+		var dp, ep btcec.JacobianPoint
+		btcec.ScalarBaseMultNonConst(&r.d, &dp)
+		btcec.ScalarBaseMultNonConst(&r.e, &ep)
+		nonces[share.Index] = [2]btcec.JacobianPoint{dp, ep}
+		rounds[i] = r
+	}
+
+	for _, r := range rounds {
+		r.nonces = nonces
+	}
+	for _, r := range rounds {
+		rounds[0].partials[r.share.Index] = r.sign()
+	}
+	return rounds
+}
+
+func frostTestEvent(pk nostr.PubKey) nostr.Event {
+	evt := nostr.Event{
+		Kind:      1,
+		CreatedAt: 1699485669,
+		Content:   "signed by a threshold",
+		PubKey:    pk,
+		Tags:      nostr.Tags{},
+	}
+	evt.ID = evt.GetID()
+	return evt
+}
+
+// frostSubsets returns all the subsets of size k of the shares
+func frostSubsets(shares []frostShare, k int) [][]frostShare {
+	if k == 0 {
+		return [][]frostShare{{}}
+	}
+	var result [][]frostShare
+	for i := 0; i+k <= len(shares); i++ {
+		for _, rest := range frostSubsets(shares[i+1:], k-1) {
+			result = append(result, append([]frostShare{shares[i]}, rest...))
+		}
+	}
+	return result
+}
+
+func TestFrostDealAndSign(t *testing.T) {
+	for _, tn := range [][2]int{{1, 1}, {2, 3}, {3, 5}} {
+		threshold, n := tn[0], tn[1]
+
+		// a few different keys so both even and odd group keys are exercised
+		for range 4 {
+			sk := nostr.Generate()
+			shares := frostDeal(sk, threshold, n)
+			require.Len(t, shares, n)
+
+			for _, share := range shares {
+				require.Equal(t, sk.Public(), share.groupKey())
+
+				// shares survive being serialized and loaded again
+				j, err := json.Marshal(share)
+				require.NoError(t, err)
+				loaded, err := loadFrostShare(string(j))
+				require.NoError(t, err)
+				require.Equal(t, share.Share, loaded.Share)
+			}
+
+			evt := frostTestEvent(shares[0].groupKey())
+			for _, subset := range frostSubsets(shares, threshold) {
+				rounds := frostTestRounds(subset, evt)
+				require.NoError(t, rounds[0].combine(), "%d-of-%d", threshold, n)
+				require.True(t, rounds[0].evt.VerifySignature())
+				require.Equal(t, sk.Public(), rounds[0].evt.PubKey)
+			}
+		}
+	}
+}
+
+func TestFrostNotEnoughShares(t *testing.T) {
+	sk := nostr.Generate()
+	shares := frostDeal(sk, 3, 5)
+	evt := frostTestEvent(shares[0].groupKey())
+
+	for _, subset := range frostSubsets(shares, 2) {
+		rounds := frostTestRounds(subset, evt)
+		require.Error(t, rounds[0].combine())
+		require.False(t, rounds[0].evt.VerifySignature())
+	}
+}
+
+func TestFrostTamperedPartial(t *testing.T) {
+	sk := nostr.Generate()
+	shares := frostDeal(sk, 2, 3)
+	evt := frostTestEvent(shares[0].groupKey())
+
+	rounds := frostTestRounds(shares[0:2], evt)
+	r := rounds[0]
+	indexes := r.sortedIndexes()
+	rhos := r.bindingFactors(indexes)
+
+	for _, i := range indexes {
+		require.True(t, r.verifyPartial(i, r.partials[i], indexes, rhos))
+	}
+
+	var one btcec.ModNScalar
+	one.SetInt(1)
+	tampered := r.partials[indexes[1]]
+	tampered.Add(&one)
+	require.False(t, r.verifyPartial(indexes[1], tampered, indexes, rhos))
+
+	r.partials[indexes[1]] = tampered
+	require.ErrorContains(t, r.combine(), "is invalid")
+}
+
+func TestFrostProofOfKnowledge(t *testing.T) {
+	secret := frostRandomScalar()
+	var commitment btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(&secret, &commitment)
+
+	pokR, pokZ := frostProveKnowledge("session-a", 1, secret, commitment)
+	require.True(t, frostVerifyKnowledge("session-a", 1, commitment, pokR, pokZ))
+
+	// not valid under another session or for another participant
+	require.False(t, frostVerifyKnowledge("session-b", 1, commitment, pokR, pokZ))
+	require.False(t, frostVerifyKnowledge("session-a", 2, commitment, pokR, pokZ))
+
+	// nor for another commitment
+	other := frostRandomScalar()
+	var otherCommitment btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(&other, &otherCommitment)
+	require.False(t, frostVerifyKnowledge("session-a", 1, otherCommitment, pokR, pokZ))
+}
+
+func TestFrostLagrange(t *testing.T) {
+	// interpolating a polynomial at zero from any t points gives back the secret
+	coeffs := []btcec.ModNScalar{frostRandomScalar(), frostRandomScalar(), frostRandomScalar()}
+	for _, indexes := range [][]uint32{{1, 2, 3}, {2, 4, 5}, {1, 3, 7}} {
+		var result btcec.ModNScalar
+		for _, i := range indexes {
+			lambda := frostLagrange(i, indexes)
+			y := frostPolyEval(coeffs, i)
+			result.Add(y.Mul(&lambda))
+		}
+		require.True(t, result.Equals(&coeffs[0]))
+	}
+}
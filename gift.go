@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"iter"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"slices"
 	"time"
 
 	"fiatjaf.com/nostr"
@@ -106,44 +108,12 @@ a decoupled key (if it has been created or received with "nak dekey" previously)
 					rumor := originalEvent
 					rumor.Sig = [64]byte{} // remove signature
 					rumor.PubKey = sender
-					rumor.ID = rumor.GetID() // compute ID
 
-					// create seal
-					rumorJSON, _ := easyjson.Marshal(rumor)
-					encryptedRumor, err := cipher.Encrypt(ctx, string(rumorJSON), recipient)
+					wrap, err := giftWrap(ctx, kr, cipher, rumor, recipient)
 					if err != nil {
-						return fmt.Errorf("failed to encrypt rumor: %w", err)
-					}
-					seal := &nostr.Event{
-						Kind:      13,
-						Content:   encryptedRumor,
-						PubKey:    sender,
-						CreatedAt: randomNow(),
-						Tags:      nostr.Tags{},
-					}
-					if err := kr.SignEvent(ctx, seal); err != nil {
-						return fmt.Errorf("failed to sign seal: %w", err)
+						return err
 					}
 
-					// create gift wrap
-					ephemeral := nostr.Generate()
-					sealJSON, _ := easyjson.Marshal(seal)
-					convkey, err := nip44.GenerateConversationKey(recipient, ephemeral)
-					if err != nil {
-						return fmt.Errorf("failed to generate conversation key: %w", err)
-					}
-					encryptedSeal, err := nip44.Encrypt(string(sealJSON), convkey)
-					if err != nil {
-						return fmt.Errorf("failed to encrypt seal: %w", err)
-					}
-					wrap := &nostr.Event{
-						Kind:      1059,
-						Content:   encryptedSeal,
-						CreatedAt: randomNow(),
-						Tags:      nostr.Tags{{"p", recipient.Hex()}},
-					}
-					wrap.Sign(ephemeral)
-
 					// print the gift-wrap
 					wrapJSON, err := easyjson.Marshal(wrap)
 					if err != nil {
@@ -291,9 +261,212 @@ a decoupled key (if it has been created or received with "nak dekey" previously)
 				return nil
 			},
 		},
+		giftInbox,
 	},
 }
 
+// giftWrap seals the rumor with kr (encrypting it with cipher) then wraps the seal with an ephemeral key
+// to the recipient, as in NIP-59.
+func giftWrap(ctx context.Context, kr nostr.Keyer, cipher nostr.Cipher, rumor nostr.Event, recipient nostr.PubKey) (nostr.Event, error) {
+	rumor.Sig = [64]byte{}
+	rumor.ID = rumor.GetID()
+
+	// create seal
+	rumorJSON, _ := easyjson.Marshal(rumor)
+	encryptedRumor, err := cipher.Encrypt(ctx, string(rumorJSON), recipient)
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("failed to encrypt rumor: %w", err)
+	}
+	seal := nostr.Event{
+		Kind:      13,
+		Content:   encryptedRumor,
+		PubKey:    rumor.PubKey,
+		CreatedAt: randomNow(),
+		Tags:      nostr.Tags{},
+	}
+	if err := kr.SignEvent(ctx, &seal); err != nil {
+		return nostr.Event{}, fmt.Errorf("failed to sign seal: %w", err)
+	}
+
+	// create gift wrap
+	ephemeral := nostr.Generate()
+	sealJSON, _ := easyjson.Marshal(seal)
+	convkey, err := nip44.GenerateConversationKey(recipient, ephemeral)
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("failed to generate conversation key: %w", err)
+	}
+	encryptedSeal, err := nip44.Encrypt(string(sealJSON), convkey)
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("failed to encrypt seal: %w", err)
+	}
+	wrap := nostr.Event{
+		Kind:      1059,
+		Content:   encryptedSeal,
+		CreatedAt: randomNow(),
+		Tags:      nostr.Tags{{"p", recipient.Hex()}},
+	}
+	wrap.Sign(ephemeral)
+
+	return wrap, nil
+}
+
+// unwrapGift opens a gift-wrap with the first of the given ciphers that works and returns the rumor
+// inside, after checking that it was written by the same key that signed the seal. the only exception are
+// rumors marked as migrated inside seals signed by us, see markMigrated.
+func unwrapGift(ctx context.Context, ciphers []nostr.Cipher, wrap nostr.Event, us nostr.PubKey) (nostr.Event, error) {
+	if wrap.Kind != 1059 {
+		return nostr.Event{}, fmt.Errorf("not a gift wrap event (kind %d)", wrap.Kind)
+	}
+
+	var err error
+	for _, cipher := range ciphers {
+		sealj, thisErr := cipher.Decrypt(ctx, wrap.Content, wrap.PubKey)
+		if thisErr != nil {
+			err = thisErr
+			continue
+		}
+		var seal nostr.Event
+		if thisErr := easyjson.Unmarshal([]byte(sealj), &seal); thisErr != nil {
+			err = fmt.Errorf("invalid seal JSON: %w", thisErr)
+			continue
+		}
+		if seal.Kind != 13 {
+			return nostr.Event{}, fmt.Errorf("not a seal event (kind %d)", seal.Kind)
+		}
+		if !seal.VerifySignature() {
+			return nostr.Event{}, fmt.Errorf("seal signature is invalid")
+		}
+
+		rumorj, thisErr := cipher.Decrypt(ctx, seal.Content, seal.PubKey)
+		if thisErr != nil {
+			// they may have encrypted it with their decoupled key
+			if theirEPub, exists := getDecoupledEncryptionPublicKey(ctx, seal.PubKey); exists {
+				rumorj, thisErr = cipher.Decrypt(ctx, seal.Content, theirEPub)
+			}
+		}
+		if thisErr != nil {
+			return nostr.Event{}, fmt.Errorf("failed to decrypt rumor: %w", thisErr)
+		}
+		var rumor nostr.Event
+		if thisErr := easyjson.Unmarshal([]byte(rumorj), &rumor); thisErr != nil {
+			return nostr.Event{}, fmt.Errorf("invalid rumor JSON: %w", thisErr)
+		}
+
+		// otherwise anyone could seal a rumor claiming to be from someone else
+		if rumor.PubKey != seal.PubKey && (seal.PubKey != us || !isMigrated(rumor)) {
+			return nostr.Event{}, fmt.Errorf("rumor author %s doesn't match seal author %s", rumor.PubKey.Hex(), seal.PubKey.Hex())
+		}
+		rumor.ID = rumor.GetID()
+		return rumor, nil
+	}
+
+	return nostr.Event{}, fmt.Errorf("failed to decrypt seal: %w", err)
+}
+
+// sendGiftWrapped gift-wraps a rumor with the given kind and content to each of the recipients (except
+// ourselves) and publishes the wraps to the given relays.
+func sendGiftWrapped(
+	ctx context.Context,
+	kr nostr.Keyer,
+	relays []string,
+	kind nostr.Kind,
+	content string,
+	recipients []nostr.PubKey,
+) error {
+	us, err := kr.GetPublicKey(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get our public key: %w", err)
+	}
+
+	rumor := nostr.Event{
+		Kind:      kind,
+		Content:   content,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{},
+		PubKey:    us,
+	}
+
+	for _, pk := range recipients {
+		if pk == us {
+			continue
+		}
+		wrap, err := giftWrap(ctx, kr, kr, rumor, pk)
+		if err != nil {
+			return fmt.Errorf("failed to wrap to %s: %w", pk.Hex(), err)
+		}
+
+		ok := false
+		for res := range sys.Pool.PublishMany(ctx, relays, wrap) {
+			if res.Error == nil {
+				ok = true
+			} else {
+				logverbose("failed to send to %s through %s: %s\n", pk.Hex(), res.RelayURL, res.Error)
+			}
+		}
+		if !ok {
+			return fmt.Errorf("failed to send to %s through any relay", pk.Hex())
+		}
+	}
+
+	return nil
+}
+
+// receiveGiftWrapped yields the sender and content of every rumor with the given kind gift-wrapped to us
+// on the given relays, including the ones sent in the last couple of days, until ctx is canceled.
+func receiveGiftWrapped(
+	ctx context.Context,
+	kr nostr.Keyer,
+	relays []string,
+	kind nostr.Kind,
+) iter.Seq2[nostr.PubKey, string] {
+	return func(yield func(nostr.PubKey, string) bool) {
+		us, err := kr.GetPublicKey(ctx)
+		if err != nil {
+			return
+		}
+
+		// gift-wraps have their created_at randomized up to two days in the past
+		for ie := range sys.Pool.SubscribeMany(ctx, relays, nostr.Filter{
+			Kinds: []nostr.Kind{1059},
+			Tags:  nostr.TagMap{"p": []string{us.Hex()}},
+			Since: nostr.Now() - 3*24*60*60,
+		}, nostr.SubscriptionOptions{Label: "nak-gift"}) {
+			rumor, err := unwrapGift(ctx, []nostr.Cipher{kr}, ie.Event, us)
+			if err != nil || rumor.Kind != kind {
+				continue
+			}
+			if !yield(rumor.PubKey, rumor.Content) {
+				return
+			}
+		}
+	}
+}
+
+// markMigrated tags a rumor from someone else that we are going to seal ourselves, which happens when
+// 'nak dekey migrate' moves messages to a new decoupled key. the tag holds the original rumor id.
+func markMigrated(rumor nostr.Event) nostr.Event {
+	if isMigrated(rumor) {
+		return rumor
+	}
+	rumor.Tags = append(slices.Clone(rumor.Tags), nostr.Tag{"migrated", rumor.ID.Hex()})
+	rumor.ID = rumor.GetID()
+	return rumor
+}
+
+func isMigrated(rumor nostr.Event) bool {
+	return rumor.Tags.Find("migrated") != nil
+}
+
+// originalRumorID is the id of the rumor before it was migrated, so both copies can be told to be the same
+func originalRumorID(rumor nostr.Event) nostr.ID {
+	if tag := rumor.Tags.Find("migrated"); len(tag) >= 2 {
+		if id, err := nostr.IDFromHex(tag[1]); err == nil {
+			return id
+		}
+	}
+	return rumor.ID
+}
+
 func randomNow() nostr.Timestamp {
 	const twoDays = 2 * 24 * 60 * 60
 	now := time.Now().Unix()
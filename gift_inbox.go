@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/keyer"
+	"fiatjaf.com/nostr/nip44"
+	"github.com/mailru/easyjson"
+	"github.com/urfave/cli/v3"
+)
+
+var giftInbox = &cli.Command{
+	Name:  "inbox",
+	Usage: "fetches the gift-wraps sent to us from our inbox relays and prints the rumors inside",
+	Description: `both our identity key and our decoupled encryption key are tried. rumors whose author doesn't match the key that signed their seal are discarded, except those marked as migrated by 'nak dekey migrate' under our own seal.
+
+the rumors are kept in a local store (encrypted with a key that is itself encrypted to us) so they don't have to be fetched and decrypted again: each call only asks relays for what arrived since the previous one.
+
+example:
+  nak gift inbox --kind 14 --since '1 week ago'
+  nak gift inbox --offline | jq -r .content`,
+	ArgsUsage:                 "[relay...]",
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&NaturalTimeFlag{
+			Name:    "since",
+			Aliases: []string{"s"},
+			Usage:   "only rumors newer than this",
+		},
+		&KindSliceFlag{
+			Name:    "kind",
+			Aliases: []string{"k"},
+			Usage:   "only rumors of this kind",
+		},
+		&cli.BoolFlag{
+			Name:  "offline",
+			Usage: "don't query relays, just print what is in the local store",
+		},
+		&cli.BoolFlag{
+			Name:  "full",
+			Usage: "fetch everything from relays again instead of only what arrived since the last time",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		kr, _, err := gatherKeyerFromArguments(ctx, c)
+		if err != nil {
+			return err
+		}
+		us, err := kr.GetPublicKey(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get our public key: %w", err)
+		}
+
+		store, err := openGiftStore(ctx, c.String("config-path"), kr, us)
+		if err != nil {
+			return err
+		}
+		defer store.close()
+
+		since := getNaturalDate(c, "since")
+
+		if !c.Bool("offline") {
+			if _, err := store.update(ctx, c, kr, c.Args().Slice(), since, c.Bool("full")); err != nil {
+				return err
+			}
+		}
+
+		kinds := getKindSlice(c, "kind")
+		for _, rumor := range store.rumors() {
+			if rumor.CreatedAt < since {
+				continue
+			}
+			if len(kinds) > 0 && !slices.Contains(kinds, rumor.Kind) {
+				continue
+			}
+			stdout(rumor.String())
+		}
+
+		return nil
+	},
+}
+
+// ourGiftCiphers returns the keys gift-wraps sent to us may have been encrypted to (our decoupled key
+// first, if we have one) and the pubkeys they may be p-tagging
+func ourGiftCiphers(ctx context.Context, c *cli.Command, kr nostr.Keyer, us nostr.PubKey) ([]nostr.Cipher, []string, error) {
+	eSec, has, err := getDecoupledEncryptionSecretKey(ctx, c.String("config-path"), us)
+	if !has {
+		return []nostr.Cipher{kr}, []string{us.Hex()}, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("our decoupled encryption key exists, but we failed to get it: %w; call `nak dekey` to attempt a fix", err)
+	}
+	logverbose("using our decoupled encryption key %s\n", eSec.Public().Hex())
+	return []nostr.Cipher{keyer.NewPlainKeySigner(eSec), kr}, []string{us.Hex(), eSec.Public().Hex()}, nil
+}
+
+// update fetches the gift-wraps sent to us from the given relays (or from our inbox and dm relays) and
+// adds their rumors to the store. unless full is given, it only asks for what arrived since the last time.
+// it returns false when that last time can't be moved forward because we may have skipped something.
+func (gs *giftStore) update(
+	ctx context.Context,
+	c *cli.Command,
+	kr nostr.Keyer,
+	relays []string,
+	since nostr.Timestamp,
+	full bool,
+) (bool, error) {
+	ciphers, receivers, err := ourGiftCiphers(ctx, c, kr, gs.us)
+	if err != nil {
+		return false, err
+	}
+
+	// only move the checkpoint forward when we know we haven't skipped anything
+	ourRelays := len(relays) == 0
+	complete := since == 0 && ourRelays
+
+	relays = slices.Clone(relays)
+	for i, url := range relays {
+		relays[i] = nostr.NormalizeURL(url)
+	}
+	if len(relays) == 0 {
+		relays = nostr.AppendUnique(sys.FetchInboxRelays(ctx, gs.us, 3), fetchDMRelays(ctx, gs.us)...)
+	}
+	if len(relays) == 0 {
+		return false, fmt.Errorf("no inbox relays found, give some as arguments")
+	}
+	logverbose("querying %v\n", relays)
+
+	filter := nostr.Filter{
+		Kinds: []nostr.Kind{1059},
+		Tags:  nostr.TagMap{"p": receivers},
+	}
+	// gift-wraps have their created_at randomized up to two days in the past
+	if since != 0 {
+		filter.Since = since - 2*24*60*60
+	}
+	if checkpoint := gs.checkpoint(); !full && checkpoint != 0 && checkpoint-2*24*60*60 > filter.Since {
+		filter.Since = checkpoint - 2*24*60*60
+		complete = ourRelays
+	}
+
+	startedAt := nostr.Now()
+	fetched, added := 0, 0
+	eosed, err := fetchGiftWraps(ctx, kr, relays, filter, func(wrap nostr.Event) error {
+		fetched++
+		if gs.has(wrap.ID) {
+			return nil
+		}
+
+		rumor, err := unwrapGift(ctx, ciphers, wrap, gs.us)
+		if err != nil {
+			logverbose("failed to unwrap %s: %s\n", wrap.ID.Hex(), err)
+			return nil
+		}
+		if err := gs.add(wrap.ID, rumor); err != nil {
+			return err
+		}
+		added++
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	log("got %d gift-wraps, %d new\n", fetched, added)
+
+	if eosed == 0 {
+		log("no relay sent all its gift-wraps, next time we'll ask for them again\n")
+		return false, nil
+	}
+	if complete {
+		gs.setCheckpoint(startedAt)
+	}
+	return complete, nil
+}
+
+// fetchGiftWraps queries each relay on its own so we know which of them got to the end of their stored
+// events, as opposed to failing or timing out. handle is called once for each distinct gift-wrap.
+// it returns how many relays sent an EOSE.
+func fetchGiftWraps(
+	ctx context.Context,
+	kr nostr.Keyer,
+	relays []string,
+	filter nostr.Filter,
+	handle func(nostr.Event) error,
+) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := make(chan nostr.Event)
+	var eosed atomic.Int32
+	wg := sync.WaitGroup{}
+	for _, url := range relays {
+		wg.Go(func() {
+			if fetchGiftWrapsFrom(ctx, kr, url, filter, events) {
+				eosed.Add(1)
+			}
+		})
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	seen := make(map[nostr.ID]struct{})
+	var handleErr error
+	for evt := range events {
+		if _, ok := seen[evt.ID]; ok || handleErr != nil {
+			continue
+		}
+		seen[evt.ID] = struct{}{}
+		if err := handle(evt); err != nil {
+			handleErr = err
+			cancel()
+		}
+	}
+
+	return int(eosed.Load()), handleErr
+}
+
+// fetchGiftWrapsFrom returns true if the relay sent everything it had, authenticating if it asks for it
+func fetchGiftWrapsFrom(ctx context.Context, kr nostr.Keyer, url string, filter nostr.Filter, events chan<- nostr.Event) bool {
+	r, ok := sys.Pool.Relays.Load(url)
+	if !ok || r == nil || !r.IsConnected() {
+		ct, cancel := context.WithTimeout(ctx, connectTimeout)
+		var err error
+		r, err = nostr.RelayConnect(ct, url, sys.Pool.RelayOptions)
+		cancel()
+		if err != nil {
+			log("failed to connect to %s: %s\n", url, err)
+			return false
+		}
+		sys.Pool.Relays.Store(url, r)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	authed := false
+	for {
+		sub, err := r.Subscribe(ctx, filter, nostr.SubscriptionOptions{Label: "nak-gift"})
+		if err != nil {
+			log("failed to query %s: %s\n", url, err)
+			return false
+		}
+
+	read:
+		for {
+			select {
+			case evt := <-sub.Events:
+				select {
+				case events <- evt:
+				case <-ctx.Done():
+					return false
+				}
+			case <-sub.EndOfStoredEvents:
+				return true
+			case reason := <-sub.ClosedReason:
+				if !authed && strings.HasPrefix(reason, "auth-required:") {
+					authed = true
+					if err := r.Auth(ctx, kr.SignEvent); err == nil {
+						break read
+					}
+				}
+				log("%s CLOSED: %s\n", url, reason)
+				return false
+			case <-sub.Context.Done():
+				return false
+			}
+		}
+	}
+}
+
+// giftStore keeps the rumors we have unwrapped, indexed by the id of the gift-wrap that carried them.
+// each record is encrypted with a random local key, which is stored encrypted to ourselves.
+type giftStore struct {
+	us    nostr.PubKey
+	dir   string
+	ck    [32]byte
+	file  *os.File
+	wraps map[nostr.ID]struct{}
+	all   []nostr.Event
+}
+
+type giftStoreRecord struct {
+	Wrap  string `json:"wrap"`
+	Rumor string `json:"rumor"`
+}
+
+func openGiftStore(ctx context.Context, configPath string, kr nostr.Keyer, us nostr.PubKey) (*giftStore, error) {
+	if configPath == "" {
+		// otherwise we would be writing our messages to the current directory
+		return nil, fmt.Errorf("can't keep gift-wraps without a config path")
+	}
+
+	gs := &giftStore{
+		us:    us,
+		dir:   filepath.Join(configPath, "gift", us.Hex()),
+		wraps: make(map[nostr.ID]struct{}),
+	}
+	if err := os.MkdirAll(gs.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create gift store directory: %w", err)
+	}
+
+	keyPath := filepath.Join(gs.dir, "key")
+	if data, err := os.ReadFile(keyPath); err == nil {
+		plain, err := kr.Decrypt(ctx, strings.TrimSpace(string(data)), us)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt gift store key at %s: %w", keyPath, err)
+		}
+		if _, err := hex.Decode(gs.ck[:], []byte(plain)); err != nil {
+			return nil, fmt.Errorf("invalid gift store key at %s: %w", keyPath, err)
+		}
+	} else if os.IsNotExist(err) {
+		rand.Read(gs.ck[:])
+		ciphertext, err := kr.Encrypt(ctx, hex.EncodeToString(gs.ck[:]), us)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt gift store key: %w", err)
+		}
+		if err := os.WriteFile(keyPath, []byte(ciphertext), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write gift store key: %w", err)
+		}
+	} else {
+		return nil, err
+	}
+
+	rumorsPath := filepath.Join(gs.dir, "rumors.jsonl")
+	if file, err := os.Open(rumorsPath); err == nil {
+		seen := make(map[nostr.ID]struct{})
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+		for scanner.Scan() {
+			var rec giftStoreRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				continue
+			}
+			wrapID, err := nostr.IDFromHex(rec.Wrap)
+			if err != nil {
+				continue
+			}
+			plain, err := nip44.Decrypt(rec.Rumor, gs.ck)
+			if err != nil {
+				log("failed to decrypt stored rumor from wrap %s: %s\n", rec.Wrap, err)
+				continue
+			}
+			var rumor nostr.Event
+			if err := easyjson.Unmarshal([]byte(plain), &rumor); err != nil {
+				continue
+			}
+
+			gs.wraps[wrapID] = struct{}{}
+			if _, ok := seen[rumor.ID]; !ok {
+				// the same rumor is often wrapped more than once (e.g. to each of our keys)
+				seen[rumor.ID] = struct{}{}
+				gs.all = append(gs.all, rumor)
+			}
+		}
+		file.Close()
+	}
+
+	var err error
+	gs.file, err = os.OpenFile(rumorsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open gift store: %w", err)
+	}
+
+	return gs, nil
+}
+
+func (gs *giftStore) has(wrapID nostr.ID) bool {
+	_, ok := gs.wraps[wrapID]
+	return ok
+}
+
+func (gs *giftStore) add(wrapID nostr.ID, rumor nostr.Event) error {
+	ciphertext, err := nip44.Encrypt(rumor.String(), gs.ck)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt rumor for storage: %w", err)
+	}
+	data, _ := json.Marshal(giftStoreRecord{Wrap: wrapID.Hex(), Rumor: ciphertext})
+	if _, err := gs.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write to gift store: %w", err)
+	}
+
+	gs.wraps[wrapID] = struct{}{}
+	if !slices.ContainsFunc(gs.all, func(r nostr.Event) bool { return r.ID == rumor.ID }) {
+		gs.all = append(gs.all, rumor)
+	}
+	return nil
+}
+
+// rumors returns everything in the store, oldest first
+func (gs *giftStore) rumors() []nostr.Event {
+	slices.SortFunc(gs.all, func(a, b nostr.Event) int { return int(a.CreatedAt - b.CreatedAt) })
+	return gs.all
+}
+
+// checkpoint is when we last fetched from relays
+func (gs *giftStore) checkpoint() nostr.Timestamp {
+	data, err := os.ReadFile(filepath.Join(gs.dir, "checkpoint"))
+	if err != nil {
+		return 0
+	}
+	ts, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return nostr.Timestamp(ts)
+}
+
+func (gs *giftStore) setCheckpoint(ts nostr.Timestamp) {
+	os.WriteFile(filepath.Join(gs.dir, "checkpoint"), []byte(strconv.FormatInt(int64(ts), 10)), 0600)
+}
+
+func (gs *giftStore) close() {
+	gs.file.Close()
+}
@@ -388,6 +388,58 @@ func exitIfLineProcessingError(ctx context.Context) {
 	}
 }
 
+// processPipelined calls prepare on each line in order, then runs work on up to window of the prepared
+// values concurrently and finally calls finish on each result in the same order the lines came in.
+// failures at any step are reported per line through lineProcessingError.
+func processPipelined[T any](
+	ctx context.Context,
+	lines iter.Seq[string],
+	window int,
+	prepare func(line string) (T, error),
+	work func(T) (T, error),
+	finish func(T) error,
+) context.Context {
+	type item struct {
+		value T
+		err   error
+		done  chan struct{}
+	}
+
+	queue := make(chan *item, window)
+	go func() {
+		defer close(queue)
+		sem := make(chan struct{}, window)
+		for line := range lines {
+			it := &item{done: make(chan struct{})}
+			it.value, it.err = prepare(line)
+			if it.err != nil {
+				close(it.done)
+			} else {
+				sem <- struct{}{}
+				go func() {
+					defer close(it.done)
+					defer func() { <-sem }()
+					it.value, it.err = work(it.value)
+				}()
+			}
+			queue <- it
+		}
+	}()
+
+	for it := range queue {
+		<-it.done
+		err := it.err
+		if err == nil {
+			err = finish(it.value)
+		}
+		if err != nil {
+			ctx = lineProcessingError(ctx, err.Error())
+		}
+	}
+
+	return ctx
+}
+
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 func randString(n int) string {
@@ -511,6 +563,10 @@ func parseSecretKey(input string) (nostr.SecretKey, error) {
 		return ski.(nostr.SecretKey), nil
 	}
 
+	if looksLikeMnemonic(input) {
+		return secretKeyFromMnemonic(input, "", 0)
+	}
+
 	sk, err := nostr.SecretKeyFromHex(input)
 	if err != nil {
 		return nostr.SecretKey{}, fmt.Errorf("invalid secret key: %w", err)
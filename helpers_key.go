@@ -34,6 +34,10 @@ func defaultKey() nostr.SecretKey {
 }
 
 func gatherKeyerFromArguments(ctx context.Context, c *cli.Command) (nostr.Keyer, nostr.SecretKey, error) {
+	if kr, ok := agentKeyerFromArguments(c); ok {
+		return kr, nostr.SecretKey{}, nil
+	}
+
 	key, bunker, err := gatherSecretKeyOrBunkerFromArguments(ctx, c)
 	if err != nil {
 		return nil, nostr.SecretKey{}, err
@@ -52,6 +56,16 @@ func gatherKeyerFromArguments(ctx context.Context, c *cli.Command) (nostr.Keyer,
 func gatherSecretKeyOrBunkerFromArguments(ctx context.Context, c *cli.Command) (nostr.SecretKey, *nip46.BunkerClient, error) {
 	sec := c.String("sec")
 
+	if name, ident, ok, err := resolveIdentity(c); err != nil {
+		return nostr.SecretKey{}, nil, err
+	} else if ok {
+		if ident.Bunker == "" {
+			sk, err := unlockIdentity(name, ident)
+			return sk, nil, err
+		}
+		sec = ident.Bunker
+	}
+
 	if strings.HasPrefix(sec, "bunker://") {
 		// it's a bunker
 		bunkerURL := sec
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessPipelined(t *testing.T) {
+	const window = 4
+
+	lines := make([]string, 40)
+	for i := range lines {
+		lines[i] = strconv.Itoa(i)
+	}
+	lines[5] = "not a number"
+
+	var running, maxRunning atomic.Int32
+	var finished []int
+
+	ctx := processPipelined(context.Background(), slices.Values(lines), window,
+		strconv.Atoi,
+		func(n int) (int, error) {
+			now := running.Add(1)
+			defer running.Add(-1)
+			for {
+				prev := maxRunning.Load()
+				if now <= prev || maxRunning.CompareAndSwap(prev, now) {
+					break
+				}
+			}
+
+			time.Sleep(time.Duration(1+rand.IntN(5)) * time.Millisecond)
+			if n == 13 {
+				return 0, fmt.Errorf("work failed on %d", n)
+			}
+			return n * 10, nil
+		},
+		func(n int) error {
+			if n == 210 {
+				return fmt.Errorf("finish failed on %d", n)
+			}
+			finished = append(finished, n/10)
+			return nil
+		},
+	)
+
+	// the failing lines were reported, everything else went through in order
+	require.Equal(t, true, ctx.Value(LINE_PROCESSING_ERROR))
+	expected := make([]int, 0, len(lines))
+	for i := range lines {
+		if i != 5 && i != 13 && i != 21 {
+			expected = append(expected, i)
+		}
+	}
+	require.Equal(t, expected, finished)
+
+	require.LessOrEqual(t, maxRunning.Load(), int32(window))
+	require.Greater(t, maxRunning.Load(), int32(1), "work should run concurrently")
+}
+
+func TestProcessPipelinedNoErrors(t *testing.T) {
+	ctx := processPipelined(context.Background(), slices.Values([]string{"a", "b", "c"}), 2,
+		func(line string) (string, error) { return line, nil },
+		func(s string) (string, error) { return s + s, nil },
+		func(s string) error { return nil },
+	)
+	require.Nil(t, ctx.Value(LINE_PROCESSING_ERROR))
+}
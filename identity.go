@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip19"
+	"fiatjaf.com/nostr/nip46"
+	"fiatjaf.com/nostr/nip49"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+)
+
+// IdentityStore is what gets stored under ~/.config/nak/identities.json.
+// secret keys are only ever stored encrypted as ncryptsec.
+type IdentityStore struct {
+	Default    string              `json:"default,omitempty"`
+	Identities map[string]Identity `json:"identities"`
+}
+
+type Identity struct {
+	PubKey    nostr.PubKey `json:"pubkey"`
+	NCryptSec string       `json:"ncryptsec,omitempty"`
+	Bunker    string       `json:"bunker,omitempty"`
+}
+
+// decrypted identities and the last password that worked, so we only ask once per session
+var (
+	identityKeys     = make(map[string]nostr.SecretKey)
+	identityPassword string
+)
+
+var identity = &cli.Command{
+	Name:  "identity",
+	Usage: "manages named keys and bunkers to be used with --as <name>",
+	Description: `identities are stored under the config path (~/.config/nak/identities.json), secret keys are always encrypted with a password (nip49).
+
+any command that signs things accepts --as <name> to use one of them, and the one selected with 'nak identity use' is used by default when neither --as nor --sec are given.
+
+example:
+		nak identity add personal nsec1...
+		nak identity add bot bunker://...
+		nak identity use personal
+		nak event --as bot -c hello relay.example.com`,
+	DisableSliceFlagSeparator: true,
+	Commands: []*cli.Command{
+		{
+			Name:                      "add",
+			Usage:                     "stores a new identity from a secret key (nsec, hex, ncryptsec or seed phrase) or a bunker URI",
+			ArgsUsage:                 "<name> [key-or-bunker]",
+			DisableSliceFlagSeparator: true,
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "logn",
+					Usage:       "the bigger the number the harder it will be to bruteforce the password",
+					Value:       16,
+					DefaultText: "16",
+				},
+				&cli.BoolFlag{
+					Name:  "use",
+					Usage: "also make it the default identity",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				name := c.Args().First()
+				if err := validateIdentityName(name); err != nil {
+					return err
+				}
+
+				store, err := loadIdentityStore(c)
+				if err != nil {
+					return err
+				}
+				if _, exists := store.Identities[name]; exists {
+					return fmt.Errorf("identity '%s' already exists, remove it first", name)
+				}
+
+				input := strings.Join(c.Args().Tail(), " ")
+				if input == "" {
+					input, err = askPassword("type your secret key as ncryptsec, nsec or hex, or a bunker URI: ", nil)
+					if err != nil {
+						return fmt.Errorf("failed to get secret key: %w", err)
+					}
+				}
+
+				var ident Identity
+				switch {
+				case strings.HasPrefix(input, "bunker://"):
+					clientKey := getSecretKey(c, "connect-as")
+					bunker, err := nip46.ConnectBunker(ctx, clientKey, input, sys.Pool, func(s string) {
+						log(color.CyanString("[nip46]: open the following URL: %s"), s)
+					})
+					if err != nil {
+						return fmt.Errorf("failed to connect to %s: %w", input, err)
+					}
+					ident.PubKey, err = bunker.GetPublicKey(ctx)
+					if err != nil {
+						return fmt.Errorf("failed to get public key from bunker: %w", err)
+					}
+					ident.Bunker = input
+				case strings.HasPrefix(input, "ncryptsec1"):
+					sk, err := decryptIdentityKey(input)
+					if err != nil {
+						return err
+					}
+					ident.PubKey = sk.Public()
+					ident.NCryptSec = input
+					identityKeys[name] = sk
+				default:
+					sk, err := parseSecretKey(input)
+					if err != nil {
+						return err
+					}
+					password, err := askNewPassword()
+					if err != nil {
+						return err
+					}
+					ident.NCryptSec, err = nip49.Encrypt(sk, password, uint8(c.Int("logn")), 0x02)
+					if err != nil {
+						return fmt.Errorf("failed to encrypt: %w", err)
+					}
+					ident.PubKey = sk.Public()
+				}
+
+				store.Identities[name] = ident
+				if c.Bool("use") || len(store.Identities) == 1 {
+					store.Default = name
+				}
+				if err := saveIdentityStore(c, store); err != nil {
+					return err
+				}
+
+				log("added identity %s: %s\n", color.YellowString(name), color.CyanString(nip19.EncodeNpub(ident.PubKey)))
+				return nil
+			},
+		},
+		{
+			Name:                      "list",
+			Usage:                     "lists stored identities, the default one is marked with a *",
+			DisableSliceFlagSeparator: true,
+			Action: func(ctx context.Context, c *cli.Command) error {
+				store, err := loadIdentityStore(c)
+				if err != nil {
+					return err
+				}
+
+				for _, name := range slices.Sorted(maps.Keys(store.Identities)) {
+					ident := store.Identities[name]
+					mark := " "
+					if name == store.Default {
+						mark = "*"
+					}
+					stdout(fmt.Sprintf("%s %s %s %s", mark, color.YellowString(name), nip19.EncodeNpub(ident.PubKey), ident.kind()))
+				}
+				return nil
+			},
+		},
+		{
+			Name:                      "remove",
+			Usage:                     "deletes a stored identity",
+			ArgsUsage:                 "<name>",
+			DisableSliceFlagSeparator: true,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "yes",
+					Aliases: []string{"y"},
+					Usage:   "don't ask for confirmation",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				name := c.Args().First()
+				store, err := loadIdentityStore(c)
+				if err != nil {
+					return err
+				}
+				ident, exists := store.Identities[name]
+				if !exists {
+					return fmt.Errorf("identity '%s' not found", name)
+				}
+
+				if !c.Bool("yes") {
+					if ident.NCryptSec != "" {
+						log("make sure you have a backup of the key, this is the only copy nak has: %s\n", ident.NCryptSec)
+					}
+					if !askConfirmation(fmt.Sprintf("remove identity '%s'? [y/n] ", name)) {
+						return fmt.Errorf("aborted")
+					}
+				}
+
+				delete(store.Identities, name)
+				if store.Default == name {
+					store.Default = ""
+				}
+				return saveIdentityStore(c, store)
+			},
+		},
+		{
+			Name:                      "use",
+			Usage:                     "sets the identity to be used when neither --as nor --sec are given, or clears it if no name is given",
+			ArgsUsage:                 "[name]",
+			DisableSliceFlagSeparator: true,
+			Action: func(ctx context.Context, c *cli.Command) error {
+				name := c.Args().First()
+				store, err := loadIdentityStore(c)
+				if err != nil {
+					return err
+				}
+				if _, exists := store.Identities[name]; name != "" && !exists {
+					return fmt.Errorf("identity '%s' not found", name)
+				}
+
+				store.Default = name
+				return saveIdentityStore(c, store)
+			},
+		},
+		{
+			Name:                      "show",
+			Usage:                     "prints the details of an identity (or of the default one)",
+			ArgsUsage:                 "[name]",
+			DisableSliceFlagSeparator: true,
+			Action: func(ctx context.Context, c *cli.Command) error {
+				store, err := loadIdentityStore(c)
+				if err != nil {
+					return err
+				}
+				name := c.Args().First()
+				if name == "" {
+					name = store.Default
+				}
+				ident, exists := store.Identities[name]
+				if !exists {
+					return fmt.Errorf("identity '%s' not found", name)
+				}
+
+				log("name: %s\n", color.YellowString(name))
+				log("type: %s\n", ident.kind())
+				log("pubkey: %s\n", ident.PubKey.Hex())
+				stdout(nip19.EncodeNpub(ident.PubKey))
+				if ident.NCryptSec != "" {
+					log("ncryptsec: %s\n", ident.NCryptSec)
+				} else {
+					log("bunker: %s\n", ident.Bunker)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+func (ident Identity) kind() string {
+	if ident.Bunker != "" {
+		return "bunker"
+	}
+	return "ncryptsec"
+}
+
+func validateIdentityName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\n/\\") || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("invalid identity name '%s'", name)
+	}
+	return nil
+}
+
+func getIdentityStorePath(c *cli.Command) string {
+	return filepath.Join(c.String("config-path"), "identities.json")
+}
+
+func loadIdentityStore(c *cli.Command) (IdentityStore, error) {
+	store := IdentityStore{Identities: make(map[string]Identity)}
+
+	data, err := os.ReadFile(getIdentityStorePath(c))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return store, fmt.Errorf("failed to read identities: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &store); err != nil {
+		return store, fmt.Errorf("invalid identities file: %w", err)
+	}
+	if store.Identities == nil {
+		store.Identities = make(map[string]Identity)
+	}
+
+	return store, nil
+}
+
+func saveIdentityStore(c *cli.Command, store IdentityStore) error {
+	path := getIdentityStorePath(c)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write identities: %w", err)
+	}
+
+	return nil
+}
+
+// resolveIdentity returns the identity named by --as, or the default identity when
+// no key was given explicitly. ok is false when no identity applies.
+func resolveIdentity(c *cli.Command) (name string, ident Identity, ok bool, err error) {
+	name = c.String("as")
+	if name == "" && (c.IsSet("sec") || c.Bool("prompt-sec")) {
+		return "", Identity{}, false, nil
+	}
+
+	store, err := loadIdentityStore(c)
+	if err != nil {
+		return "", Identity{}, false, err
+	}
+
+	if name == "" {
+		if store.Default == "" {
+			return "", Identity{}, false, nil
+		}
+		name = store.Default
+	}
+
+	ident, exists := store.Identities[name]
+	if !exists {
+		return "", Identity{}, false, fmt.Errorf("identity '%s' not found, see 'nak identity list'", name)
+	}
+
+	return name, ident, true, nil
+}
+
+// unlockIdentity decrypts the key of an identity, asking for the password only if we haven't got it yet
+func unlockIdentity(name string, ident Identity) (nostr.SecretKey, error) {
+	if sk, ok := identityKeys[name]; ok {
+		return sk, nil
+	}
+
+	sk, err := decryptIdentityKey(ident.NCryptSec)
+	if err != nil {
+		return nostr.SecretKey{}, fmt.Errorf("identity '%s': %w", name, err)
+	}
+	if sk.Public() != ident.PubKey {
+		return nostr.SecretKey{}, fmt.Errorf("identity '%s': decrypted key doesn't match the stored pubkey", name)
+	}
+
+	identityKeys[name] = sk
+	return sk, nil
+}
+
+func decryptIdentityKey(ncryptsec string) (nostr.SecretKey, error) {
+	if identityPassword != "" {
+		if sk, err := nip49.Decrypt(ncryptsec, identityPassword); err == nil {
+			return sk, nil
+		}
+	}
+
+	for i := 1; i < 4; i++ {
+		var attemptStr string
+		if i > 1 {
+			attemptStr = fmt.Sprintf(" [%d/3]", i)
+		}
+		password, err := askPassword("type the password to decrypt your secret key"+attemptStr+": ", nil)
+		if err != nil {
+			return nostr.SecretKey{}, err
+		}
+		if sk, err := nip49.Decrypt(ncryptsec, password); err == nil {
+			identityPassword = password
+			return sk, nil
+		}
+	}
+
+	return nostr.SecretKey{}, fmt.Errorf("couldn't decrypt private key")
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcec/v2/schnorr/musig2"
 	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/fatih/color"
 	"github.com/urfave/cli/v3"
 )
 
@@ -22,11 +23,16 @@ var key = &cli.Command{
 	DisableSliceFlagSeparator: true,
 	Commands: []*cli.Command{
 		generate,
+		fromMnemonic,
+		vanity,
 		public,
 		expand,
 		encryptKey,
 		decryptKey,
 		combine,
+		frost,
+		splitKey,
+		recoverKey,
 		validate,
 		defaultCommand,
 	},
@@ -35,9 +41,35 @@ var key = &cli.Command{
 var generate = &cli.Command{
 	Name:                      "generate",
 	Usage:                     "generates a secret key",
-	Description:               ``,
+	Description:               `with --mnemonic a nip06 seed phrase is printed instead, the key can then be derived from it with 'nak key from-mnemonic'.`,
 	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "mnemonic",
+			Usage: "generate a bip39 seed phrase (nip06) instead of a raw key",
+		},
+		&cli.IntFlag{
+			Name:        "words",
+			Usage:       "number of words in the seed phrase (12, 15, 18, 21 or 24)",
+			Value:       12,
+			DefaultText: "12",
+		},
+	},
 	Action: func(ctx context.Context, c *cli.Command) error {
+		if c.Bool("mnemonic") {
+			mnemonic, err := generateMnemonic(int(c.Int("words")))
+			if err != nil {
+				return err
+			}
+			sk, err := secretKeyFromMnemonic(mnemonic, "", 0)
+			if err != nil {
+				return err
+			}
+			log("%s\n", color.CyanString(nip19.EncodeNpub(sk.Public())))
+			stdout(mnemonic)
+			return nil
+		}
+
 		sec := nostr.Generate()
 		stdout(sec.Hex())
 		return nil
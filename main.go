@@ -33,12 +33,18 @@ var authFlags = []cli.Flag{
 var defaultKeyFlags = []cli.Flag{
 	&cli.StringFlag{
 		Name:        "sec",
-		Usage:       "secret key to sign the event, as nsec, ncryptsec or hex, or a bunker URL",
+		Usage:       "secret key to sign the event, as nsec, ncryptsec, hex or nip06 seed phrase, or a bunker URL",
 		Category:    CATEGORY_SIGNER,
 		Sources:     cli.EnvVars("NOSTR_SECRET_KEY"),
 		Value:       defaultKey().Hex(),
 		DefaultText: "a default key specific to your machine, see it with `nak key default`",
 	},
+	&cli.StringFlag{
+		Name:     "as",
+		Usage:    "name of a stored identity to use instead of --sec (see `nak identity`)",
+		Category: CATEGORY_SIGNER,
+		Sources:  cli.EnvVars("NAK_IDENTITY"),
+	},
 	&cli.BoolFlag{
 		Name:     "prompt-sec",
 		Usage:    "prompt the user to paste a hex or nsec with which to sign the event",
@@ -76,6 +82,8 @@ var app = &cli.Command{
 		decode,
 		encode,
 		key,
+		identity,
+		agent,
 		kindCmd,
 		verify,
 		relay,
@@ -87,6 +95,7 @@ var app = &cli.Command{
 		encrypt,
 		decrypt,
 		gift,
+		dm,
 		outboxCmd,
 		wallet,
 		mcpServer,
@@ -102,6 +111,8 @@ var app = &cli.Command{
 		spell,
 		profile,
 		validateCmd,
+		powCmd,
+		musigCmd,
 	},
 	Version: version,
 	Flags: combineFlags([][]cli.Flag{
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip19"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/fatih/color"
+	"github.com/tyler-smith/go-bip39"
+	"github.com/urfave/cli/v3"
+)
+
+var fromMnemonic = &cli.Command{
+	Name:  "from-mnemonic",
+	Usage: "derives a secret key from a bip39 seed phrase (nip06)",
+	Description: `the key is derived along the path m/44'/1237'/<account>'/0/0, as specified by nip06.
+
+the seed phrase can be given as arguments (quoted or not) or through stdin, one per line.
+
+example:
+		nak key from-mnemonic leader monkey parrot ring guide accident before fence cannon height naive bean
+		nak key generate --mnemonic | nak key from-mnemonic --account 2`,
+	ArgsUsage:                 "[word...]",
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "passphrase",
+			Usage: "optional bip39 passphrase (the \"25th word\")",
+		},
+		&cli.UintFlag{
+			Name:        "account",
+			Usage:       "account index in the derivation path",
+			DefaultText: "0",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		mnemonics := getStdinLinesOrBlank()
+		if c.Args().Len() > 0 {
+			mnemonics = slices.Values([]string{strings.Join(c.Args().Slice(), " ")})
+		}
+
+		for mnemonic := range mnemonics {
+			sk, err := secretKeyFromMnemonic(mnemonic, c.String("passphrase"), uint64(c.Uint("account")))
+			if err != nil {
+				ctx = lineProcessingError(ctx, "%s", err)
+				continue
+			}
+			log("%s\n", color.CyanString(nip19.EncodeNpub(sk.Public())))
+			stdout(sk.Hex())
+		}
+
+		exitIfLineProcessingError(ctx)
+		return nil
+	},
+}
+
+func generateMnemonic(words int) (string, error) {
+	if words < 12 || words > 24 || words%3 != 0 {
+		return "", fmt.Errorf("the number of words must be 12, 15, 18, 21 or 24, not %d", words)
+	}
+
+	// each 3 words encode 32 bits of entropy
+	entropy, err := bip39.NewEntropy(words / 3 * 32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate entropy: %w", err)
+	}
+
+	return bip39.NewMnemonic(entropy)
+}
+
+func normalizeMnemonic(mnemonic string) string {
+	return strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+}
+
+// looksLikeMnemonic tells if the input is meant to be a seed phrase rather than a single-word key
+func looksLikeMnemonic(input string) bool {
+	return len(strings.Fields(input)) >= 12
+}
+
+func secretKeyFromMnemonic(mnemonic string, passphrase string, account uint64) (nostr.SecretKey, error) {
+	// the account is a hardened index, anything above this would wrap around into a non-hardened one
+	if account >= hdkeychain.HardenedKeyStart {
+		return nostr.SecretKey{}, fmt.Errorf("account must be lower than %d", hdkeychain.HardenedKeyStart)
+	}
+
+	seed, err := bip39.NewSeedWithErrorChecking(normalizeMnemonic(mnemonic), passphrase)
+	if err != nil {
+		return nostr.SecretKey{}, fmt.Errorf("invalid mnemonic: %w", err)
+	}
+
+	key, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		return nostr.SecretKey{}, fmt.Errorf("failed to derive master key: %w", err)
+	}
+
+	// m/44'/1237'/<account>'/0/0
+	for _, index := range []uint32{
+		hdkeychain.HardenedKeyStart + 44,
+		hdkeychain.HardenedKeyStart + 1237,
+		hdkeychain.HardenedKeyStart + uint32(account),
+		0,
+		0,
+	} {
+		key, err = key.Derive(index)
+		if err != nil {
+			return nostr.SecretKey{}, fmt.Errorf("failed to derive key: %w", err)
+		}
+	}
+
+	priv, err := key.ECPrivKey()
+	if err != nil {
+		return nostr.SecretKey{}, fmt.Errorf("failed to get private key: %w", err)
+	}
+
+	return nostr.SecretKey(priv.Key.Bytes()), nil
+}
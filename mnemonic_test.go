@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretKeyFromMnemonic(t *testing.T) {
+	// test vectors from nip06
+	for _, v := range []struct {
+		mnemonic string
+		sec      string
+		pub      string
+	}{
+		{
+			"leader monkey parrot ring guide accident before fence cannon height naive bean",
+			"7f7ff03d123792d6ac594bfa67bf6d0c0ab55b6b1fdb6249303fe861f1ccba9a",
+			"17162c921dc4d2518f9a101db33695df1afb56ab82f5ff3e5da6eec3ca5cd917",
+		},
+		{
+			"what bleak badge arrange retreat wolf trade produce cricket blur garlic valid proud rude strong choose busy staff weather area salt hollow arm fade",
+			"c15d739894c81a2fcfd3a2df85a0d2c0dbc47a280d092799f144d73d7ae78add",
+			"d41b22899549e1f3d335a31002cfd382174006e166d3e658e3a5eecdb6463573",
+		},
+	} {
+		sk, err := secretKeyFromMnemonic(v.mnemonic, "", 0)
+		require.NoError(t, err)
+		require.Equal(t, v.sec, sk.Hex())
+		require.Equal(t, v.pub, sk.Public().Hex())
+
+		// extra whitespace and uppercase don't matter
+		sk, err = secretKeyFromMnemonic("  "+strings.ToUpper(v.mnemonic)+"\n", "", 0)
+		require.NoError(t, err)
+		require.Equal(t, v.sec, sk.Hex())
+
+		// other accounts and passphrases give other keys
+		other, err := secretKeyFromMnemonic(v.mnemonic, "", 1)
+		require.NoError(t, err)
+		require.NotEqual(t, v.sec, other.Hex())
+		other, err = secretKeyFromMnemonic(v.mnemonic, "banana", 0)
+		require.NoError(t, err)
+		require.NotEqual(t, v.sec, other.Hex())
+	}
+
+	mnemonic := "leader monkey parrot ring guide accident before fence cannon height naive bean"
+	_, err := secretKeyFromMnemonic(mnemonic, "", 1<<31-1)
+	require.NoError(t, err)
+	_, err = secretKeyFromMnemonic(mnemonic, "", 1<<31)
+	require.Error(t, err)
+
+	_, err = secretKeyFromMnemonic("leader monkey parrot ring guide accident before fence cannon height naive naive", "", 0)
+	require.Error(t, err)
+}
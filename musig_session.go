@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/keyer"
+	"fiatjaf.com/nostr/nip19"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr/musig2"
+	"github.com/fatih/color"
+	"github.com/mailru/easyjson"
+	"github.com/urfave/cli/v3"
+)
+
+// rumors carrying musig messages are never published by themselves, so this kind only serves to
+// tell them apart from other gift-wrapped stuff
+const musigRumorKind nostr.Kind = 21813
+
+var musigCmd = &cli.Command{
+	Name:  "musig",
+	Usage: "coordinates musig2 signing rounds between multiple signers over relays",
+	Description: `instead of passing "nak event --musig ..." command lines around by hand, signers exchange their public nonces and partial signatures as gift-wrapped messages addressed to each other's pubkeys.
+
+the event is signed by the key aggregated from all the signers' pubkeys, which is printed when the session starts. each signer must keep its "nak musig" process running until the event is signed, and any of them will publish the final event when the last partial signature arrives.
+
+example:
+		echo '{"kind":1,"content":"hello from all of us"}' | nak musig session --signer npub1... --signer npub1... --sec <my-key> relay.example.com
+		nak musig join <session-id> relay.example.com --sec <their-key>`,
+	DisableSliceFlagSeparator: true,
+	Commands: []*cli.Command{
+		{
+			Name:                      "session",
+			Usage:                     "starts a signing session for the event given on stdin and invites all the other signers to it",
+			ArgsUsage:                 "[relay...]",
+			DisableSliceFlagSeparator: true,
+			Flags: []cli.Flag{
+				&PubKeySliceFlag{
+					Name:     "signer",
+					Usage:    "pubkey of each of the other signers (ours is always included)",
+					Required: true,
+				},
+				&cli.StringSliceFlag{
+					Name:  "publish-to",
+					Usage: "relays to publish the final signed event to, defaults to the relays used for the session",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				relays := c.Args().Slice()
+				if len(relays) == 0 {
+					return fmt.Errorf("at least one relay is needed to run the session")
+				}
+				for i, url := range relays {
+					relays[i] = nostr.NormalizeURL(url)
+				}
+
+				_, sec, err := gatherKeyerFromArguments(ctx, c)
+				if err != nil {
+					return err
+				}
+				if sec == [32]byte{} {
+					return fmt.Errorf("musig signing requires a plain secret key, bunkers can't do it")
+				}
+
+				signers := []nostr.PubKey{sec.Public()}
+				for _, pk := range getPubKeySlice(c, "signer") {
+					if !slices.Contains(signers, pk) {
+						signers = append(signers, pk)
+					}
+				}
+				if len(signers) < 2 {
+					return fmt.Errorf("at least one other signer is needed")
+				}
+
+				var evt nostr.Event
+				for stdinEvent := range getJsonsOrBlank() {
+					if err := easyjson.Unmarshal([]byte(stdinEvent), &evt); err != nil {
+						return fmt.Errorf("invalid event received from stdin: %w", err)
+					}
+					break
+				}
+				if evt.Kind == 0 && evt.Content == "" && len(evt.Tags) == 0 {
+					return fmt.Errorf("pipe the event to be signed as JSON")
+				}
+				if evt.CreatedAt == 0 {
+					evt.CreatedAt = nostr.Now()
+				}
+				if evt.Tags == nil {
+					evt.Tags = nostr.Tags{}
+				}
+				evt.Sig = [64]byte{}
+
+				round, err := newMusigRound(randString(16), evt, signers, sec)
+				if err != nil {
+					return err
+				}
+				round.relays = relays
+				round.publishTo = c.StringSlice("publish-to")
+
+				log("session %s: signing as %s\n", color.CyanString(round.id),
+					color.YellowString(nip19.EncodeNpub(round.evt.PubKey)))
+				log("the other signers should call:\n  nak musig join %s %s --sec <their-key>\n",
+					round.id, strings.Join(relays, " "))
+				log("%s\n", round.evt.String())
+
+				// invite everybody with the full event and the list of signers
+				invite := musigMessage{
+					Type:      "invite",
+					Session:   round.id,
+					Event:     &round.evt,
+					Relays:    relays,
+					PublishTo: round.publishTo,
+				}
+				for _, pk := range signers {
+					invite.Signers = append(invite.Signers, pk.Hex())
+				}
+				if err := round.broadcast(ctx, invite); err != nil {
+					return err
+				}
+
+				return runMusigRound(ctx, c, sec, round.id, relays, round)
+			},
+		},
+		{
+			Name:                      "join",
+			Usage:                     "joins a signing session started by another signer with \"nak musig session\"",
+			ArgsUsage:                 "<session-id> [relay...]",
+			DisableSliceFlagSeparator: true,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "yes",
+					Aliases: []string{"y"},
+					Usage:   "sign without asking for confirmation after seeing the event",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				id := c.Args().First()
+				if id == "" {
+					return fmt.Errorf("missing session id")
+				}
+				relays := c.Args().Tail()
+				if len(relays) == 0 {
+					return fmt.Errorf("at least one relay is needed to join the session")
+				}
+				for i, url := range relays {
+					relays[i] = nostr.NormalizeURL(url)
+				}
+
+				_, sec, err := gatherKeyerFromArguments(ctx, c)
+				if err != nil {
+					return err
+				}
+				if sec == [32]byte{} {
+					return fmt.Errorf("musig signing requires a plain secret key, bunkers can't do it")
+				}
+
+				log("waiting for the invite to session %s...\n", color.CyanString(id))
+				return runMusigRound(ctx, c, sec, id, relays, nil)
+			},
+		},
+	},
+}
+
+type musigMessage struct {
+	Type    string `json:"type"`
+	Session string `json:"session"`
+
+	// only in "invite"
+	Event     *nostr.Event `json:"event,omitempty"`
+	Signers   []string     `json:"signers,omitempty"`
+	Relays    []string     `json:"relays,omitempty"`
+	PublishTo []string     `json:"publish_to,omitempty"`
+
+	// "nonce" and "partial"
+	Nonce   string `json:"nonce,omitempty"`
+	Partial string `json:"partial,omitempty"`
+}
+
+// musigRound holds the state of one signing session from the point of view of one signer
+type musigRound struct {
+	id        string
+	evt       nostr.Event
+	signers   []nostr.PubKey
+	relays    []string
+	publishTo []string
+
+	us      nostr.PubKey
+	kr      nostr.Keyer
+	session *musig2.Session
+
+	nonces   map[nostr.PubKey][musig2.PubNonceSize]byte
+	partials map[nostr.PubKey]*musig2.PartialSignature
+	signed   bool
+}
+
+func newMusigRound(id string, evt nostr.Event, signers []nostr.PubKey, sec nostr.SecretKey) (*musigRound, error) {
+	// nostr pubkeys have no parity, so everybody is taken as the even point and we negate our key if needed
+	seck, pubk := btcec.PrivKeyFromBytes(sec[:])
+	if pubk.SerializeCompressed()[0] == 0x03 {
+		seck.Key.Negate()
+	}
+
+	knownSigners := make([]*btcec.PublicKey, len(signers))
+	for i, pk := range signers {
+		bpk, err := schnorr.ParsePubKey(pk[:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid signer pubkey %s: %w", pk.Hex(), err)
+		}
+		knownSigners[i] = bpk
+	}
+
+	mctx, err := musig2.NewContext(seck, true, musig2.WithKnownSigners(knownSigners))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signing context: %w", err)
+	}
+	comb, err := mctx.CombinedKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to combine keys: %w", err)
+	}
+	aggpk := nostr.PubKey(comb.SerializeCompressed()[1:])
+	if evt.PubKey != nostr.ZeroPK && evt.PubKey != aggpk {
+		return nil, fmt.Errorf("event pubkey %s doesn't match the aggregated key %s", evt.PubKey.Hex(), aggpk.Hex())
+	}
+	evt.PubKey = aggpk
+	evt.ID = evt.GetID()
+
+	session, err := mctx.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signing session: %w", err)
+	}
+
+	us := sec.Public()
+	return &musigRound{
+		id:       id,
+		evt:      evt,
+		signers:  signers,
+		us:       us,
+		kr:       keyer.NewPlainKeySigner(sec),
+		session:  session,
+		nonces:   map[nostr.PubKey][musig2.PubNonceSize]byte{us: session.PublicNonce()},
+		partials: make(map[nostr.PubKey]*musig2.PartialSignature, len(signers)),
+	}, nil
+}
+
+// broadcast gift-wraps the message to each of the other signers and publishes it to the session relays
+func (r *musigRound) broadcast(ctx context.Context, msg musigMessage) error {
+	content, _ := json.Marshal(msg)
+	if err := sendGiftWrapped(ctx, r.kr, r.relays, musigRumorKind, string(content), r.signers); err != nil {
+		return fmt.Errorf("failed to send %s message: %w", msg.Type, err)
+	}
+	return nil
+}
+
+func (r *musigRound) logProgress() {
+	log("session %s: nonces %d/%d, partial signatures %d/%d\n", r.id,
+		len(r.nonces), len(r.signers), len(r.partials), len(r.signers))
+}
+
+// runMusigRound listens for messages from the other signers and moves the session forward as they arrive.
+// when round is nil we're still waiting for the invite.
+func runMusigRound(
+	ctx context.Context,
+	c *cli.Command,
+	sec nostr.SecretKey,
+	id string,
+	relays []string,
+	round *musigRound,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	us := sec.Public()
+
+	// messages that arrive before the invite
+	var pending []musigMessage
+	var from []nostr.PubKey
+
+	handle := func(sender nostr.PubKey, msg musigMessage) (bool, error) {
+		if !slices.Contains(round.signers, sender) {
+			return false, fmt.Errorf("got a message from %s, who is not one of the signers", sender.Hex())
+		}
+
+		switch msg.Type {
+		case "nonce":
+			nb, err := hex.DecodeString(msg.Nonce)
+			if err != nil || len(nb) != musig2.PubNonceSize {
+				return false, fmt.Errorf("invalid nonce from %s", sender.Hex())
+			}
+			nonce := [musig2.PubNonceSize]byte(nb)
+			if existing, ok := round.nonces[sender]; ok {
+				if existing != nonce {
+					return false, fmt.Errorf("%s sent two different nonces, aborting", sender.Hex())
+				}
+				return false, nil
+			}
+			round.nonces[sender] = nonce
+			if _, err := round.session.RegisterPubNonce(nonce); err != nil {
+				return false, fmt.Errorf("failed to register nonce from %s: %w", sender.Hex(), err)
+			}
+		case "partial":
+			if _, ok := round.partials[sender]; ok {
+				return false, nil
+			}
+			pb, err := hex.DecodeString(msg.Partial)
+			if err != nil {
+				return false, fmt.Errorf("invalid partial signature from %s", sender.Hex())
+			}
+			var ps musig2.PartialSignature
+			if err := ps.Decode(bytes.NewBuffer(pb)); err != nil {
+				return false, fmt.Errorf("invalid partial signature from %s: %w", sender.Hex(), err)
+			}
+			round.partials[sender] = &ps
+		case "invite":
+			return false, nil
+		default:
+			logverbose("ignoring unknown message type '%s' from %s\n", msg.Type, sender.Hex())
+			return false, nil
+		}
+
+		// round 2: once all nonces are known we can sign
+		if !round.signed && len(round.nonces) == len(round.signers) {
+			ps, err := round.session.Sign(round.evt.ID)
+			if err != nil {
+				return false, fmt.Errorf("failed to produce partial signature: %w", err)
+			}
+			round.signed = true
+			round.partials[us] = ps
+
+			w := &bytes.Buffer{}
+			ps.Encode(w)
+			if err := round.broadcast(ctx, musigMessage{
+				Type:    "partial",
+				Session: round.id,
+				Partial: hex.EncodeToString(w.Bytes()),
+			}); err != nil {
+				return false, err
+			}
+		}
+
+		round.logProgress()
+
+		// done when we have everybody's partial signature
+		return round.signed && len(round.partials) == len(round.signers), nil
+	}
+
+	start := func() error {
+		round.logProgress()
+		return round.broadcast(ctx, musigMessage{
+			Type:    "nonce",
+			Session: round.id,
+			Nonce:   hex.EncodeToString(round.nonces[us][:]),
+		})
+	}
+	if round != nil {
+		if err := start(); err != nil {
+			return err
+		}
+	}
+
+	for sender, content := range receiveGiftWrapped(ctx, keyer.NewPlainKeySigner(sec), relays, musigRumorKind) {
+		var msg musigMessage
+		if err := json.Unmarshal([]byte(content), &msg); err != nil || msg.Session != id {
+			continue
+		}
+
+		if round == nil {
+			if msg.Type != "invite" {
+				pending = append(pending, msg)
+				from = append(from, sender)
+				continue
+			}
+
+			if msg.Event == nil {
+				return fmt.Errorf("invite from %s has no event", sender.Hex())
+			}
+			signers := make([]nostr.PubKey, 0, len(msg.Signers))
+			for _, s := range msg.Signers {
+				pk, err := nostr.PubKeyFromHex(s)
+				if err != nil {
+					return fmt.Errorf("invite has an invalid signer %s: %w", s, err)
+				}
+				signers = append(signers, pk)
+			}
+			if !slices.Contains(signers, sender) || !slices.Contains(signers, us) {
+				return fmt.Errorf("invite from %s doesn't list both of us as signers", sender.Hex())
+			}
+
+			log("invited by %s to sign as one of %d signers:\n", color.CyanString(sender.Hex()), len(signers))
+			var err error
+			round, err = newMusigRound(id, *msg.Event, signers, sec)
+			if err != nil {
+				return err
+			}
+			round.relays = relays
+			round.publishTo = msg.PublishTo
+			log("%s\n", round.evt.String())
+			if !c.Bool("yes") {
+				if !askConfirmation("sign this event? [y/n] ") {
+					return fmt.Errorf("aborted")
+				}
+			}
+			if err := start(); err != nil {
+				return err
+			}
+
+			for i, msg := range pending {
+				done, err := handle(from[i], msg)
+				if err != nil {
+					return err
+				}
+				if done {
+					return finishMusigRound(ctx, c, round)
+				}
+			}
+			pending = nil
+			continue
+		}
+
+		done, err := handle(sender, msg)
+		if err != nil {
+			return err
+		}
+		if done {
+			return finishMusigRound(ctx, c, round)
+		}
+	}
+
+	return fmt.Errorf("subscription ended before the session was completed")
+}
+
+func finishMusigRound(ctx context.Context, c *cli.Command, round *musigRound) error {
+	for _, pk := range round.signers {
+		if pk == round.us {
+			continue
+		}
+		if _, err := round.session.CombineSig(round.partials[pk]); err != nil {
+			return fmt.Errorf("failed to combine partial signature from %s: %w", pk.Hex(), err)
+		}
+	}
+
+	round.evt.Sig = [64]byte(round.session.FinalSig().Serialize())
+	if !round.evt.VerifySignature() {
+		return fmt.Errorf("the combined signature is invalid, some signer sent a bad partial signature")
+	}
+	stdout(round.evt.String())
+
+	publishTo := round.publishTo
+	if len(publishTo) == 0 {
+		publishTo = round.relays
+	}
+	relays := connectToAllRelays(ctx, c, publishTo)
+	if len(relays) == 0 {
+		return fmt.Errorf("failed to connect to any of [ %v ]", publishTo)
+	}
+	return publishFlow(ctx, c, round.kr, round.evt, relays)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+	"golang.org/x/term"
+)
+
+var powCmd = &cli.Command{
+	Name:                      "pow",
+	Usage:                     "nip13 proof-of-work utilities",
+	DisableSliceFlagSeparator: true,
+	Commands: []*cli.Command{
+		{
+			Name:  "bench",
+			Usage: "measures the hashrate of this machine and prints the expected time to mine each difficulty",
+			Description: `mines a dummy event on all cores for a while, then uses the measured hashrate to estimate how long "nak event --pow <difficulty>" would take on average.
+
+keep in mind that mining is a lottery: the actual time for a single event can be much lower or much higher than the average.`,
+			DisableSliceFlagSeparator: true,
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "duration",
+					Usage: "for how long to measure",
+					Value: 5 * time.Second,
+				},
+				&cli.UintFlag{
+					Name:  "min",
+					Usage: "lowest difficulty to include in the report",
+					Value: 8,
+				},
+				&cli.UintFlag{
+					Name:  "max",
+					Usage: "highest difficulty to include in the report",
+					Value: 40,
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				evt := nostr.Event{
+					Kind:      1,
+					CreatedAt: nostr.Now(),
+					Content:   "hello from the nostr army knife",
+					Tags:      nostr.Tags{},
+					PubKey:    defaultKey().Public(),
+				}
+
+				workers := runtime.NumCPU()
+				log("measuring hashrate on %d cores for %s...\n", workers, c.Duration("duration"))
+
+				ctx, cancel := context.WithTimeout(ctx, c.Duration("duration"))
+				defer cancel()
+
+				// nothing will ever reach this difficulty, so it will just run until the timeout
+				start := time.Now()
+				res := minePow(ctx, evt, 256, 0, workers, nil)
+				rate := float64(res.attempts) / time.Since(start).Seconds()
+
+				stdout(fmt.Sprintf("hashrate: %s", formatHashrate(rate)))
+				for d := c.Uint("min"); d <= c.Uint("max"); d++ {
+					stdout(fmt.Sprintf("  %2d: %s", d, formatPowDuration(powExpectedDuration(int(d), rate))))
+				}
+
+				return nil
+			},
+		},
+	},
+}
+
+type powResult struct {
+	tag      nostr.Tag
+	attempts uint64
+
+	// all nonces below this have been tried, mining can be resumed from here
+	checkpoint uint64
+}
+
+const powBatchSize = 4096
+
+// minePow searches for a nonce tag that gives the event an id with at least the given number of
+// leading zero bits, using as many goroutines as workers. it stops when it finds one or when ctx is canceled,
+// in that case the returned tag is nil.
+func minePow(
+	ctx context.Context,
+	evt nostr.Event,
+	difficulty int,
+	startNonce uint64,
+	workers int,
+	progress func(attempts uint64, elapsed time.Duration),
+) powResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var next atomic.Uint64
+	next.Store(startNonce)
+	var attempts atomic.Uint64
+
+	// the batch each worker is currently on, used to compute the checkpoint
+	current := make([]atomic.Uint64, workers)
+	for w := range current {
+		current[w].Store(math.MaxUint64)
+	}
+
+	found := make(chan nostr.Tag, 1)
+	wg := sync.WaitGroup{}
+	for w := range workers {
+		wg.Add(1)
+		go func(evt nostr.Event) {
+			defer wg.Done()
+
+			tag := nostr.Tag{"nonce", "", strconv.Itoa(difficulty)}
+			evt.Tags = append(slices.Clone(evt.Tags), tag)
+
+			for ctx.Err() == nil {
+				batch := next.Add(powBatchSize) - powBatchSize
+				current[w].Store(batch)
+
+				for nonce := batch; nonce < batch+powBatchSize; nonce++ {
+					tag[1] = strconv.FormatUint(nonce, 10)
+					if powDifficulty(evt.GetID()) >= difficulty {
+						attempts.Add(nonce - batch + 1)
+						select {
+						case found <- slices.Clone(tag):
+						default:
+						}
+						cancel()
+						return
+					}
+				}
+				attempts.Add(powBatchSize)
+			}
+		}(evt)
+	}
+
+	if progress != nil {
+		go func() {
+			start := time.Now()
+			ticker := time.NewTicker(time.Millisecond * 500)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					progress(attempts.Load(), time.Since(start))
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	cancel()
+
+	res := powResult{attempts: attempts.Load(), checkpoint: math.MaxUint64}
+	select {
+	case res.tag = <-found:
+	default:
+	}
+	for w := range current {
+		res.checkpoint = min(res.checkpoint, current[w].Load())
+	}
+	if res.checkpoint == math.MaxUint64 {
+		res.checkpoint = startNonce
+	}
+
+	return res
+}
+
+// doEventPow mines the event according to the --pow flags, displaying progress, saving a checkpoint
+// if interrupted or timed out and resuming from a previous checkpoint if one exists for this same event.
+func doEventPow(ctx context.Context, c *cli.Command, evt *nostr.Event, difficulty int) (nostr.Tag, error) {
+	checkpointPath := powCheckpointPath(c, *evt, difficulty)
+
+	var startNonce uint64
+	if checkpointPath != "" {
+		if data, err := os.ReadFile(checkpointPath); err == nil {
+			var cp powCheckpoint
+			if err := json.Unmarshal(data, &cp); err == nil {
+				// resuming restores the old created_at, so only do it if the previous run was recent,
+				// otherwise calling the same command days later would publish a backdated event
+				maxAge := max(powCheckpointMaxAge, 3*c.Duration("pow-timeout"))
+				age := time.Since(cp.CreatedAt.Time())
+
+				switch {
+				case c.IsSet("created-at"):
+					if cp.CreatedAt == evt.CreatedAt {
+						startNonce = cp.Nonce
+						log("resuming proof-of-work from a previous run (%d nonces already tried)\n", cp.Nonce)
+					}
+				case age <= maxAge:
+					evt.CreatedAt = cp.CreatedAt
+					startNonce = cp.Nonce
+					log("resuming proof-of-work from a previous run (%d nonces already tried), created_at restored to %s\n",
+						cp.Nonce, color.YellowString(cp.CreatedAt.Time().Format(time.DateTime)))
+				default:
+					os.Remove(checkpointPath)
+					log("discarding proof-of-work checkpoint from %s ago, starting over with the current time\n",
+						formatPowDuration(age))
+				}
+			}
+		}
+	}
+
+	if timeout := c.Duration("pow-timeout"); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	var progress func(uint64, time.Duration)
+	if term.IsTerminal(int(os.Stderr.Fd())) {
+		progress = func(attempts uint64, elapsed time.Duration) {
+			rate := float64(attempts) / elapsed.Seconds()
+			// since every attempt is independent the expected remaining time is always the same
+			eta := powExpectedDuration(difficulty, rate)
+			log("\r\033[2Kmining difficulty %d: %d hashes, %s, expected %s\r",
+				difficulty, startNonce+attempts, formatHashrate(rate), formatPowDuration(eta))
+		}
+	}
+
+	workers := runtime.NumCPU()
+	res := minePow(ctx, *evt, difficulty, startNonce, workers, progress)
+	if progress != nil {
+		log("\r\033[2K")
+	}
+
+	if res.tag == nil {
+		if checkpointPath != "" {
+			data, _ := json.Marshal(powCheckpoint{CreatedAt: evt.CreatedAt, Nonce: res.checkpoint})
+			os.MkdirAll(filepath.Dir(checkpointPath), 0755)
+			if err := os.WriteFile(checkpointPath, data, 0644); err == nil {
+				log("proof-of-work stopped, %s to resume\n",
+					color.YellowString("call the same command again"))
+			}
+		}
+		return nil, fmt.Errorf("gave up mining difficulty %d after %d hashes: %w",
+			difficulty, startNonce+res.attempts, context.Cause(ctx))
+	}
+
+	if checkpointPath != "" {
+		os.Remove(checkpointPath)
+	}
+	logverbose("mined difficulty %d after %d hashes\n", difficulty, startNonce+res.attempts)
+
+	return res.tag, nil
+}
+
+// checkpoints older than this (or than a few --pow-timeout) are not resumed when --created-at isn't given
+const powCheckpointMaxAge = time.Hour
+
+type powCheckpoint struct {
+	CreatedAt nostr.Timestamp `json:"created_at"`
+	Nonce     uint64          `json:"nonce"`
+}
+
+// powCheckpointPath identifies an event by everything except its created_at (which is restored from the
+// checkpoint), so the same command can be called again to resume.
+func powCheckpointPath(c *cli.Command, evt nostr.Event, difficulty int) string {
+	configPath := c.String("config-path")
+	if configPath == "" {
+		return ""
+	}
+
+	j, _ := json.Marshal([]any{evt.PubKey.Hex(), evt.Kind, evt.Tags, evt.Content, difficulty})
+	h := sha256.Sum256(j)
+	return filepath.Join(configPath, "pow", hex.EncodeToString(h[:]))
+}
+
+// hasEnoughPow checks if the event already has a nonce tag that satisfies the given difficulty,
+// which is the case when it was mined by someone else (for example, a previous peer in the musig flow)
+func hasEnoughPow(evt nostr.Event, difficulty int) bool {
+	return evt.Tags.Find("nonce") != nil && powDifficulty(evt.GetID()) >= difficulty
+}
+
+func powDifficulty(id nostr.ID) int {
+	for i, b := range id {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return 256
+}
+
+func powExpectedDuration(difficulty int, rate float64) time.Duration {
+	return expectedDuration(math.Pow(2, float64(difficulty)), rate)
+}
+
+func formatHashrate(rate float64) string {
+	switch {
+	case rate >= 1_000_000:
+		return fmt.Sprintf("%.2f MH/s", rate/1_000_000)
+	case rate >= 1_000:
+		return fmt.Sprintf("%.2f kH/s", rate/1_000)
+	default:
+		return fmt.Sprintf("%.0f H/s", rate)
+	}
+}
+
+func formatPowDuration(d time.Duration) string {
+	switch {
+	case d == math.MaxInt64:
+		return "forever"
+	case d < time.Second:
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	case d < time.Minute:
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	case d < time.Hour:
+		return fmt.Sprintf("%.1f minutes", d.Minutes())
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%.1f hours", d.Hours())
+	case d < 2*365*24*time.Hour:
+		return fmt.Sprintf("%.1f days", d.Hours()/24)
+	default:
+		return fmt.Sprintf("%.1f years", d.Hours()/24/365)
+	}
+}
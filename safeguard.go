@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"github.com/fatih/color"
+)
+
+// guardReplaceableOverwrite fetches the current version of a replaceable or addressable event from the
+// author's relays and compares it with the one we're about to publish. destructive changes (going back in
+// time, dropping most list entries or profile fields) are refused unless force is true, other big
+// changes only cause a warning. the version being replaced is saved to the local store as a backup.
+func guardReplaceableOverwrite(ctx context.Context, relays []string, evt nostr.Event, force bool) error {
+	if !evt.Kind.IsReplaceable() && !evt.Kind.IsAddressable() {
+		return nil
+	}
+
+	dTag := ""
+	if evt.Kind.IsAddressable() {
+		if d := evt.Tags.Find("d"); d != nil {
+			dTag = d[1]
+		}
+	}
+
+	relays = nostr.AppendUnique(relays, sys.FetchWriteRelays(ctx, evt.PubKey)...)
+	for i, url := range relays {
+		relays[i] = nostr.NormalizeURL(url)
+	}
+
+	current := fetchLatestReplaceable(ctx, relays, evt.PubKey, evt.Kind, dTag)
+	if current == nil || current.ID == evt.ID {
+		return nil
+	}
+
+	destructive, warnings := compareReplaceable(*current, evt)
+	for _, w := range warnings {
+		log("%s %s\n", color.YellowString("warning:"), w)
+	}
+	for _, d := range destructive {
+		log("%s %s\n", color.RedString("danger:"), d)
+	}
+	if len(destructive) > 0 && !force {
+		return fmt.Errorf("refusing to replace kind:%d event %s from %s, use --force if you really mean it",
+			evt.Kind, current.ID.Hex(), current.CreatedAt.Time().Format("2006-01-02 15:04:05"))
+	}
+
+	if err := sys.Store.SaveEvent(*current); err != nil && err != eventstore.ErrDupEvent {
+		log("failed to back up the previous version of kind:%d: %s\n", evt.Kind, err)
+	} else {
+		logverbose("previous version %s backed up to the local store\n", current.ID.Hex())
+	}
+
+	return nil
+}
+
+func compareReplaceable(current, next nostr.Event) (destructive []string, warnings []string) {
+	if next.CreatedAt < current.CreatedAt {
+		destructive = append(destructive, fmt.Sprintf("the new event is older than the one on relays (%s < %s)",
+			next.CreatedAt.Time().Format("2006-01-02 15:04:05"), current.CreatedAt.Time().Format("2006-01-02 15:04:05")))
+	}
+
+	// list entries are the tags, except for the "d" identifier and the pow nonce
+	isEntry := func(line string) bool {
+		return !strings.HasPrefix(line, `["d",`) && !strings.HasPrefix(line, `["nonce",`)
+	}
+	var currentEntries, nextEntries []string
+	for _, line := range tagsToLines(current.Tags) {
+		if isEntry(line) {
+			currentEntries = append(currentEntries, line)
+		}
+	}
+	for _, line := range tagsToLines(next.Tags) {
+		if isEntry(line) {
+			nextEntries = append(nextEntries, line)
+		}
+	}
+	kept := make(map[string]struct{}, len(nextEntries))
+	for _, line := range nextEntries {
+		kept[line] = struct{}{}
+	}
+	dropped := 0
+	for _, line := range currentEntries {
+		if _, ok := kept[line]; !ok {
+			dropped++
+		}
+	}
+	if len(currentEntries) >= 4 && dropped*2 > len(currentEntries) {
+		destructive = append(destructive, fmt.Sprintf("%d of the %d existing entries would be dropped", dropped, len(currentEntries)))
+	} else if dropped > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d of the %d existing entries would be dropped", dropped, len(currentEntries)))
+	}
+
+	if next.Kind == 0 {
+		var currentMeta, nextMeta map[string]any
+		if json.Unmarshal([]byte(current.Content), &currentMeta) == nil {
+			json.Unmarshal([]byte(next.Content), &nextMeta)
+			lost := make([]string, 0, len(currentMeta))
+			for k, v := range currentMeta {
+				if v == nil || v == "" {
+					continue
+				}
+				if nv, ok := nextMeta[k]; !ok || nv == nil || nv == "" {
+					lost = append(lost, k)
+				}
+			}
+			if len(lost) > 0 && len(lost)*2 >= len(currentMeta) {
+				destructive = append(destructive, fmt.Sprintf("profile fields would be removed: %s", strings.Join(lost, ", ")))
+			} else if len(lost) > 0 {
+				warnings = append(warnings, fmt.Sprintf("profile fields would be removed: %s", strings.Join(lost, ", ")))
+			}
+		}
+	} else if !next.Kind.IsAddressable() {
+		// content of replaceable lists is usually encrypted private entries, can't compare that
+	} else if current.Content != "" && next.Content == "" {
+		destructive = append(destructive, "the existing content would be erased")
+	} else if contentSimilarity(current.Content, next.Content) < 0.5 {
+		warnings = append(warnings, "the content differs a lot from the existing version")
+	}
+
+	return destructive, warnings
+}
+
+// contentSimilarity returns the fraction of lines the two contents have in common, from 0 to 1
+func contentSimilarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	linesA := strings.Split(a, "\n")
+	linesB := strings.Split(b, "\n")
+	count := make(map[string]int, len(linesA))
+	for _, line := range linesA {
+		count[line]++
+	}
+	common := 0
+	for _, line := range linesB {
+		if count[line] > 0 {
+			count[line]--
+			common++
+		}
+	}
+	return float64(common) / float64(max(len(linesA), len(linesB)))
+}
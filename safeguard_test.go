@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareReplaceable(t *testing.T) {
+	follows := func(n int) nostr.Tags {
+		tags := make(nostr.Tags, n)
+		for i := range tags {
+			tags[i] = nostr.Tag{"p", nostr.SecretKey{31: byte(i + 1)}.Public().Hex()}
+		}
+		return tags
+	}
+
+	for _, tc := range []struct {
+		name        string
+		current     nostr.Event
+		next        nostr.Event
+		destructive bool
+		warnings    bool
+	}{
+		{
+			name:    "follow list grows",
+			current: nostr.Event{Kind: 3, CreatedAt: 10, Tags: follows(5)},
+			next:    nostr.Event{Kind: 3, CreatedAt: 20, Tags: follows(6)},
+		},
+		{
+			name:     "follow list loses one",
+			current:  nostr.Event{Kind: 3, CreatedAt: 10, Tags: follows(6)},
+			next:     nostr.Event{Kind: 3, CreatedAt: 20, Tags: follows(5)},
+			warnings: true,
+		},
+		{
+			name:        "follow list loses most",
+			current:     nostr.Event{Kind: 3, CreatedAt: 10, Tags: follows(10)},
+			next:        nostr.Event{Kind: 3, CreatedAt: 20, Tags: follows(2)},
+			destructive: true,
+		},
+		{
+			name:        "follow list emptied",
+			current:     nostr.Event{Kind: 3, CreatedAt: 10, Tags: follows(4)},
+			next:        nostr.Event{Kind: 3, CreatedAt: 20},
+			destructive: true,
+		},
+		{
+			name:    "pow nonce is not an entry",
+			current: nostr.Event{Kind: 3, CreatedAt: 10, Tags: append(follows(4), nostr.Tag{"nonce", "123", "20"})},
+			next:    nostr.Event{Kind: 3, CreatedAt: 20, Tags: follows(4)},
+		},
+		{
+			name:        "older created_at",
+			current:     nostr.Event{Kind: 3, CreatedAt: 20, Tags: follows(4)},
+			next:        nostr.Event{Kind: 3, CreatedAt: 10, Tags: follows(5)},
+			destructive: true,
+		},
+		{
+			name:    "profile changes a field",
+			current: nostr.Event{Kind: 0, CreatedAt: 10, Content: `{"name":"a","about":"b","picture":"c"}`},
+			next:    nostr.Event{Kind: 0, CreatedAt: 20, Content: `{"name":"x","about":"b","picture":"c"}`},
+		},
+		{
+			name:     "profile loses one field",
+			current:  nostr.Event{Kind: 0, CreatedAt: 10, Content: `{"name":"a","about":"b","picture":"c"}`},
+			next:     nostr.Event{Kind: 0, CreatedAt: 20, Content: `{"name":"a","about":"b"}`},
+			warnings: true,
+		},
+		{
+			name:        "profile loses most fields",
+			current:     nostr.Event{Kind: 0, CreatedAt: 10, Content: `{"name":"a","about":"b","picture":"c"}`},
+			next:        nostr.Event{Kind: 0, CreatedAt: 20, Content: `{"name":"a","about":""}`},
+			destructive: true,
+		},
+		{
+			name:        "article erased",
+			current:     nostr.Event{Kind: 30023, CreatedAt: 10, Tags: nostr.Tags{{"d", "x"}}, Content: "long text"},
+			next:        nostr.Event{Kind: 30023, CreatedAt: 20, Tags: nostr.Tags{{"d", "x"}}},
+			destructive: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			destructive, warnings := compareReplaceable(tc.current, tc.next)
+			require.Equal(t, tc.destructive, len(destructive) > 0, "destructive: %v", destructive)
+			require.Equal(t, tc.warnings, len(warnings) > 0, "warnings: %v", warnings)
+		})
+	}
+}
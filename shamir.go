@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip19"
+	"fiatjaf.com/nostr/nip49"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/fatih/color"
+	"github.com/mdp/qrterminal/v3"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	shamirVersion      = 1
+	shamirPrefix       = "nshare"
+	shamirCryptoPrefix = "ncryptshare"
+)
+
+var splitKey = &cli.Command{
+	Name:  "split",
+	Usage: "splits a secret key into shamir shares for backup",
+	Description: `any --threshold of the --shares can be given to 'nak key recover' to rebuild the key, with fewer than that nothing can be learned about it.
+
+each share is printed in its own line as a bech32 string (with a checksum), starting with "nshare1", or with "ncryptshare1" when --encrypt is used.
+
+example:
+		nak key split --shares 5 --threshold 3 nsec1...
+		nak key split --shares 3 --threshold 2 --qrcode --encrypt < key.txt`,
+	ArgsUsage:                 "[secret]",
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&cli.UintFlag{
+			Name:     "shares",
+			Aliases:  []string{"n"},
+			Usage:    "how many shares to create",
+			Required: true,
+		},
+		&cli.UintFlag{
+			Name:     "threshold",
+			Aliases:  []string{"t"},
+			Usage:    "how many shares are needed to recover the key",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  "qrcode",
+			Usage: "also display each share as a QR code",
+		},
+		&cli.BoolFlag{
+			Name:  "encrypt",
+			Usage: "ask for a password and encrypt each share with it using nip49",
+		},
+		&cli.IntFlag{
+			Name:        "logn",
+			Usage:       "the bigger the number the harder it will be to bruteforce the password (only with --encrypt)",
+			Value:       16,
+			DefaultText: "16",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		t, n := int(c.Uint("threshold")), int(c.Uint("shares"))
+		if t < 2 || t > n {
+			return fmt.Errorf("threshold must be at least 2 and at most the number of shares")
+		}
+		if n > 255 {
+			return fmt.Errorf("can't create more than 255 shares")
+		}
+
+		var sk nostr.SecretKey
+		for input := range getStdinLinesOrArguments(c.Args()) {
+			var err error
+			sk, err = parseSecretKey(input)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if sk == [32]byte{} {
+			return fmt.Errorf("missing secret key")
+		}
+
+		var password string
+		if c.Bool("encrypt") {
+			var err error
+			password, err = askNewPassword()
+			if err != nil {
+				return err
+			}
+		}
+
+		pk := sk.Public()
+		for i, share := range shamirDeal(sk, t, n) {
+			var encoded string
+			var err error
+			if password != "" {
+				encoded, err = share.encrypt(password, uint8(c.Int("logn")))
+			} else {
+				encoded, err = share.encode()
+			}
+			if err != nil {
+				return err
+			}
+
+			if c.Bool("qrcode") {
+				log("share %d/%d:\n", i+1, n)
+				qrterminal.Generate(encoded, qrterminal.L, os.Stderr)
+				log("\n")
+			}
+			stdout(encoded)
+		}
+
+		log("%d-of-%d shares for %s\n", t, n, color.CyanString(nip19.EncodeNpub(pk)))
+		return nil
+	},
+}
+
+var recoverKey = &cli.Command{
+	Name:  "recover",
+	Usage: "rebuilds a secret key from shamir shares created with 'nak key split'",
+	Description: `shares can be given as arguments or through stdin, one per line. encrypted shares will prompt for their password.
+
+the recovered key is printed along with its npub, so you can confirm it is the expected one.
+
+example:
+		nak key recover nshare1... nshare1... nshare1...
+		cat shares.txt | nak key recover`,
+	ArgsUsage:                 "[share...]",
+	DisableSliceFlagSeparator: true,
+	Action: func(ctx context.Context, c *cli.Command) error {
+		var shares []shamirShare
+		var password string
+		for input := range getStdinLinesOrArguments(c.Args()) {
+			share, err := decodeShamirShare(input, &password)
+			if err != nil {
+				return err
+			}
+			if len(shares) > 0 {
+				if share.Fingerprint != shares[0].Fingerprint || share.Threshold != shares[0].Threshold {
+					return fmt.Errorf("share %d doesn't belong to the same set as share %d", share.Index, shares[0].Index)
+				}
+				if slices.ContainsFunc(shares, func(s shamirShare) bool { return s.Index == share.Index }) {
+					log("ignoring duplicated share %d\n", share.Index)
+					continue
+				}
+			}
+			shares = append(shares, share)
+		}
+
+		sk, err := shamirCombine(shares)
+		if err != nil {
+			return err
+		}
+
+		log("recovered %s\n", color.CyanString(nip19.EncodeNpub(sk.Public())))
+		stdout(sk.Hex())
+		return nil
+	},
+}
+
+// shamirDeal splits the key into n shares, any t of which can rebuild it
+func shamirDeal(sk nostr.SecretKey, t int, n int) []shamirShare {
+	var secret btcec.ModNScalar
+	secret.SetByteSlice(sk[:])
+	coeffs := make([]btcec.ModNScalar, t)
+	coeffs[0] = secret
+	for k := 1; k < t; k++ {
+		coeffs[k] = frostRandomScalar()
+	}
+
+	pk := sk.Public()
+	shares := make([]shamirShare, n)
+	for i := range shares {
+		value := frostPolyEval(coeffs, uint32(i+1))
+		shares[i] = shamirShare{
+			Threshold:   uint8(t),
+			Index:       uint8(i + 1),
+			Fingerprint: [4]byte(pk[0:4]),
+			Value:       value.Bytes(),
+		}
+	}
+	return shares
+}
+
+// shamirCombine rebuilds the key from the shares. when there are more than the threshold it tries
+// every combination of them until one matches the fingerprint, so a corrupted share can be outvoted.
+func shamirCombine(shares []shamirShare) (nostr.SecretKey, error) {
+	if len(shares) == 0 {
+		return nostr.SecretKey{}, fmt.Errorf("no shares given")
+	}
+	t := int(shares[0].Threshold)
+	if len(shares) < t {
+		return nostr.SecretKey{}, fmt.Errorf("got %d shares, but %d are needed", len(shares), t)
+	}
+
+	subset := make([]shamirShare, 0, t)
+	var try func(start int) (nostr.SecretKey, bool)
+	try = func(start int) (nostr.SecretKey, bool) {
+		if len(subset) == t {
+			sk := shamirInterpolate(subset)
+			pk := sk.Public()
+			return sk, bytes.Equal(pk[0:4], subset[0].Fingerprint[:])
+		}
+		for i := start; len(shares)-i >= t-len(subset); i++ {
+			subset = append(subset, shares[i])
+			if sk, ok := try(i + 1); ok {
+				return sk, true
+			}
+			subset = subset[0 : len(subset)-1]
+		}
+		return nostr.SecretKey{}, false
+	}
+
+	if sk, ok := try(0); ok {
+		return sk, nil
+	}
+	if len(shares) == t {
+		return nostr.SecretKey{}, fmt.Errorf("recovered key doesn't match the shares fingerprint, some share is corrupted")
+	}
+	return nostr.SecretKey{}, fmt.Errorf("no combination of %d shares matches the fingerprint, too many shares are corrupted", t)
+}
+
+func shamirInterpolate(shares []shamirShare) nostr.SecretKey {
+	indexes := make([]uint32, len(shares))
+	for i, share := range shares {
+		indexes[i] = uint32(share.Index)
+	}
+	var secret btcec.ModNScalar
+	for _, share := range shares {
+		var value btcec.ModNScalar
+		value.SetByteSlice(share.Value[:])
+		lambda := frostLagrange(uint32(share.Index), indexes)
+		secret.Add(value.Mul(&lambda))
+	}
+	return nostr.SecretKey(secret.Bytes())
+}
+
+type shamirShare struct {
+	Threshold   uint8
+	Index       uint8
+	Fingerprint [4]byte // first bytes of the pubkey, to check shares belong together
+	Value       [32]byte
+}
+
+func (s shamirShare) header() []byte {
+	return append([]byte{shamirVersion, s.Threshold, s.Index}, s.Fingerprint[:]...)
+}
+
+func (s shamirShare) encode() (string, error) {
+	return shamirBech32Encode(shamirPrefix, append(s.header(), s.Value[:]...))
+}
+
+// encrypt uses nip49 on the share value, then takes the raw ncryptsec bytes and
+// reencodes them together with the share metadata
+func (s shamirShare) encrypt(password string, logn uint8) (string, error) {
+	ncryptsec, err := nip49.Encrypt(nostr.SecretKey(s.Value), password, logn, 0x02)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt share: %w", err)
+	}
+	_, raw, err := shamirBech32Decode(ncryptsec)
+	if err != nil {
+		return "", err
+	}
+	return shamirBech32Encode(shamirCryptoPrefix, append(s.header(), raw...))
+}
+
+// decodeShamirShare decodes a share, asking for a password if it is encrypted.
+// the last password that worked is kept so it doesn't have to be typed again for every share.
+func decodeShamirShare(input string, password *string) (shamirShare, error) {
+	prefix, data, err := shamirBech32Decode(input)
+	if err != nil {
+		return shamirShare{}, fmt.Errorf("invalid share '%s': %w", input, err)
+	}
+	if len(data) < 7 || data[0] != shamirVersion {
+		return shamirShare{}, fmt.Errorf("invalid share '%s': unsupported version", input)
+	}
+
+	share := shamirShare{
+		Threshold:   data[1],
+		Index:       data[2],
+		Fingerprint: [4]byte(data[3:7]),
+	}
+	if share.Index == 0 || share.Threshold < 2 {
+		return shamirShare{}, fmt.Errorf("invalid share '%s'", input)
+	}
+
+	switch prefix {
+	case shamirPrefix:
+		if len(data) != 7+32 {
+			return shamirShare{}, fmt.Errorf("invalid share '%s': wrong size", input)
+		}
+		share.Value = [32]byte(data[7:])
+	case shamirCryptoPrefix:
+		ncryptsec, err := shamirBech32Encode("ncryptsec", data[7:])
+		if err != nil {
+			return shamirShare{}, err
+		}
+		if *password != "" {
+			if value, err := nip49.Decrypt(ncryptsec, *password); err == nil {
+				share.Value = value
+				return share, nil
+			}
+		}
+		for i := 1; i < 4; i++ {
+			attemptStr := ""
+			if i > 1 {
+				attemptStr = fmt.Sprintf(" [%d/3]", i)
+			}
+			*password, err = askPassword(fmt.Sprintf("type the password to decrypt share %d%s: ", share.Index, attemptStr), nil)
+			if err != nil {
+				return shamirShare{}, err
+			}
+			if value, err := nip49.Decrypt(ncryptsec, *password); err == nil {
+				share.Value = value
+				return share, nil
+			}
+		}
+		return shamirShare{}, fmt.Errorf("couldn't decrypt share %d", share.Index)
+	default:
+		return shamirShare{}, fmt.Errorf("invalid share '%s': unexpected prefix '%s'", input, prefix)
+	}
+
+	return share, nil
+}
+
+func shamirBech32Encode(prefix string, data []byte) (string, error) {
+	bits5, err := bech32.ConvertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32.Encode(prefix, bits5)
+}
+
+func shamirBech32Decode(input string) (string, []byte, error) {
+	prefix, bits5, err := bech32.DecodeNoLimit(input)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := bech32.ConvertBits(bits5, 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return prefix, data, nil
+}
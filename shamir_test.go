@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShamirRoundtrip(t *testing.T) {
+	for _, tn := range [][2]int{{2, 2}, {2, 3}, {3, 5}} {
+		threshold, n := tn[0], tn[1]
+		sk := nostr.Generate()
+		shares := shamirDeal(sk, threshold, n)
+		require.Len(t, shares, n)
+
+		// shares survive being encoded and decoded
+		password := ""
+		for i, share := range shares {
+			encoded, err := share.encode()
+			require.NoError(t, err)
+			decoded, err := decodeShamirShare(encoded, &password)
+			require.NoError(t, err)
+			require.Equal(t, share, decoded)
+			shares[i] = decoded
+		}
+
+		// any threshold of them gives back the key, in whatever order they come
+		for i := 0; i+threshold <= n; i++ {
+			recovered, err := shamirCombine(shares[i : i+threshold])
+			require.NoError(t, err)
+			require.Equal(t, sk, recovered)
+		}
+		reversed := make([]shamirShare, n)
+		for i, share := range shares {
+			reversed[n-1-i] = share
+		}
+		recovered, err := shamirCombine(reversed)
+		require.NoError(t, err)
+		require.Equal(t, sk, recovered)
+
+		// fewer don't
+		_, err = shamirCombine(shares[0 : threshold-1])
+		require.Error(t, err)
+	}
+}
+
+func TestShamirEncrypted(t *testing.T) {
+	sk := nostr.Generate()
+	shares := shamirDeal(sk, 2, 3)
+
+	encoded := make([]string, len(shares))
+	for i, share := range shares {
+		var err error
+		encoded[i], err = share.encrypt("banana", 8)
+		require.NoError(t, err)
+		require.Contains(t, encoded[i], shamirCryptoPrefix+"1")
+	}
+
+	// the password is already known, so nothing is asked
+	password := "banana"
+	decoded := make([]shamirShare, 0, len(shares))
+	for _, e := range encoded[1:] {
+		share, err := decodeShamirShare(e, &password)
+		require.NoError(t, err)
+		decoded = append(decoded, share)
+	}
+	recovered, err := shamirCombine(decoded)
+	require.NoError(t, err)
+	require.Equal(t, sk, recovered)
+}
+
+func TestShamirCorruptedShare(t *testing.T) {
+	sk := nostr.Generate()
+	shares := shamirDeal(sk, 3, 5)
+	shares[1].Value[10] ^= 0xff
+
+	// with exactly the threshold the corrupted one can't be avoided
+	_, err := shamirCombine(shares[0:3])
+	require.Error(t, err)
+
+	// with more the other combinations are tried
+	recovered, err := shamirCombine(shares)
+	require.NoError(t, err)
+	require.Equal(t, sk, recovered)
+
+	// but not if too many are bad
+	shares[3].Value[10] ^= 0xff
+	shares[4].Value[10] ^= 0xff
+	_, err = shamirCombine(shares)
+	require.Error(t, err)
+}
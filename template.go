@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"github.com/AlecAivazis/survey/v2"
+	"github.com/urfave/cli/v3"
+)
+
+// EventTemplate is what gets stored under ~/.config/nak/templates/<name>.json.
+// tags are kept in the same "key=value;extra;extra" format accepted by `nak event -t`.
+type EventTemplate struct {
+	Kind    *nostr.Kind `json:"kind,omitempty"`
+	Content *string     `json:"content,omitempty"`
+	Tags    []string    `json:"tags,omitempty"`
+}
+
+var templateVariable = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+func getTemplatePath(c *cli.Command, name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid template name '%s'", name)
+	}
+	return filepath.Join(c.String("config-path"), "templates", name+".json"), nil
+}
+
+func loadEventTemplate(c *cli.Command, name string) (EventTemplate, error) {
+	var tmpl EventTemplate
+
+	path, err := getTemplatePath(c, name)
+	if err != nil {
+		return tmpl, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tmpl, fmt.Errorf("template '%s' not found at %s", name, path)
+		}
+		return tmpl, fmt.Errorf("failed to read template '%s': %w", name, err)
+	}
+
+	if err := json.Unmarshal(data, &tmpl); err != nil {
+		return tmpl, fmt.Errorf("invalid template '%s': %w", name, err)
+	}
+
+	return tmpl, nil
+}
+
+func saveEventTemplate(c *cli.Command, name string, tmpl EventTemplate) (string, error) {
+	path, err := getTemplatePath(c, name)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create templates directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(tmpl, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write template: %w", err)
+	}
+
+	return path, nil
+}
+
+// eventTemplateFromFlags captures the event field flags given to `nak event` so they can be saved.
+func eventTemplateFromFlags(c *cli.Command) EventTemplate {
+	tmpl := EventTemplate{}
+
+	if c.IsSet("kind") {
+		kind := getKind(c, "kind")
+		tmpl.Kind = &kind
+	}
+	if c.IsSet("content") {
+		content := c.String("content")
+		tmpl.Content = &content
+	}
+
+	tmpl.Tags = append(tmpl.Tags, c.StringSlice("tag")...)
+	for _, letter := range []string{"e", "p", "d", "h"} {
+		for _, value := range c.StringSlice(letter) {
+			tmpl.Tags = append(tmpl.Tags, letter+"="+value)
+		}
+	}
+	for _, a := range getPubKeyOrAddressSlice(c, "author") {
+		if a.Addr != nil {
+			tmpl.Tags = append(tmpl.Tags, "a="+a.Addr.AsTagReference())
+		}
+	}
+
+	return tmpl
+}
+
+// defaults returns the kind and content from the template that should be applied to an event, which is
+// only when they weren't given already, either through flags or in the event read from stdin.
+func (tmpl *EventTemplate) defaults(hasKind, hasContent bool) (*nostr.Kind, *string) {
+	if tmpl == nil {
+		return nil, nil
+	}
+
+	var kind *nostr.Kind
+	var content *string
+	if !hasKind {
+		kind = tmpl.Kind
+	}
+	if !hasContent {
+		content = tmpl.Content
+	}
+	return kind, content
+}
+
+// fill replaces all {{var}} placeholders in the template, taking values from --var first,
+// then from environment variables and finally by prompting the user.
+func (tmpl EventTemplate) fill(vars []string) (EventTemplate, error) {
+	values := make(map[string]string, len(vars))
+	for _, v := range vars {
+		k, val, found := strings.Cut(v, "=")
+		if !found {
+			return tmpl, fmt.Errorf("invalid --var '%s', expected key=value", v)
+		}
+		values[k] = val
+	}
+
+	var missing error
+	replace := func(s string) string {
+		return templateVariable.ReplaceAllStringFunc(s, func(match string) string {
+			name := templateVariable.FindStringSubmatch(match)[1]
+			if val, ok := values[name]; ok {
+				return val
+			}
+			if val, ok := os.LookupEnv(name); ok {
+				values[name] = val
+				return val
+			}
+			if val, ok := os.LookupEnv(strings.ToUpper(name)); ok {
+				values[name] = val
+				return val
+			}
+
+			if isPiped() {
+				missing = fmt.Errorf("no value for template variable '%s', pass it with --var %s=<value>", name, name)
+				return match
+			}
+			var val string
+			if err := survey.AskOne(&survey.Input{Message: name}, &val); err != nil {
+				missing = fmt.Errorf("no value for template variable '%s': %w", name, err)
+				return match
+			}
+			values[name] = val
+			return val
+		})
+	}
+
+	filled := EventTemplate{Kind: tmpl.Kind}
+	if tmpl.Content != nil {
+		content := replace(*tmpl.Content)
+		filled.Content = &content
+	}
+	filled.Tags = make([]string, len(tmpl.Tags))
+	for i, tag := range tmpl.Tags {
+		filled.Tags[i] = replace(tag)
+	}
+
+	return filled, missing
+}
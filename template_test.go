@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplateFill(t *testing.T) {
+	kind := nostr.Kind(30023)
+	content := "hello {{name}}, this is {{ topic }}"
+	tmpl := EventTemplate{
+		Kind:    &kind,
+		Content: &content,
+		Tags:    []string{"d={{slug}}", "t=nostr", "title={{topic}};{{name}}"},
+	}
+
+	t.Setenv("SLUG", "from-env")
+	filled, err := tmpl.fill([]string{"name=fiatjaf", "topic=templates"})
+	require.NoError(t, err)
+
+	require.Equal(t, kind, *filled.Kind)
+	require.Equal(t, "hello fiatjaf, this is templates", *filled.Content)
+	require.Equal(t, []string{"d=from-env", "t=nostr", "title=templates;fiatjaf"}, filled.Tags)
+
+	// the original is untouched
+	require.Equal(t, "hello {{name}}, this is {{ topic }}", *tmpl.Content)
+	require.Equal(t, "d={{slug}}", tmpl.Tags[0])
+
+	// a value with an equal sign in it
+	filled, err = tmpl.fill([]string{"name=a=b", "topic=x", "slug=y"})
+	require.NoError(t, err)
+	require.Equal(t, "hello a=b, this is x", *filled.Content)
+
+	_, err = tmpl.fill([]string{"name"})
+	require.Error(t, err)
+}
+
+func TestTemplateDefaults(t *testing.T) {
+	kind := nostr.Kind(30023)
+	content := "from template"
+	tmpl := &EventTemplate{Kind: &kind, Content: &content}
+
+	// nothing given: the template fills both
+	k, c := tmpl.defaults(false, false)
+	require.Equal(t, kind, *k)
+	require.Equal(t, content, *c)
+
+	// kind from stdin or -k wins over the template
+	k, c = tmpl.defaults(true, false)
+	require.Nil(t, k)
+	require.Equal(t, content, *c)
+
+	// and so does content
+	k, c = tmpl.defaults(false, true)
+	require.Equal(t, kind, *k)
+	require.Nil(t, c)
+
+	// no template
+	var none *EventTemplate
+	k, c = none.defaults(false, false)
+	require.Nil(t, k)
+	require.Nil(t, c)
+}
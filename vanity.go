@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip19"
+	"fiatjaf.com/nostr/nip49"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v3"
+	"golang.org/x/term"
+)
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var vanity = &cli.Command{
+	Name:  "vanity",
+	Usage: "generates a secret key whose npub or hex pubkey matches a pattern",
+	Description: `searches on all cores for a key whose npub starts with --prefix (after the "npub1" part) and/or ends with --suffix, or whose hex pubkey starts with --hex-prefix.
+
+each extra bech32 character makes the search 32 times longer on average (16 times for hex), so anything above 6 or 7 characters is probably going to take too long.
+
+example:
+		nak key vanity --prefix nak
+		nak key vanity --hex-prefix 0000 --encrypt`,
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "prefix",
+			Usage: "bech32 characters the npub should start with, after the \"npub1\"",
+		},
+		&cli.StringFlag{
+			Name:  "suffix",
+			Usage: "bech32 characters the npub should end with",
+		},
+		&cli.StringFlag{
+			Name:  "hex-prefix",
+			Usage: "hex characters the pubkey should start with",
+		},
+		&cli.BoolFlag{
+			Name:  "encrypt",
+			Usage: "ask for a password and output the key as an ncryptsec (nip49)",
+		},
+		&cli.IntFlag{
+			Name:        "logn",
+			Usage:       "the bigger the number the harder it will be to bruteforce the password (only with --encrypt)",
+			Value:       16,
+			DefaultText: "16",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		prefix := strings.TrimPrefix(c.String("prefix"), "npub1")
+		suffix := c.String("suffix")
+		hexPrefix := strings.ToLower(c.String("hex-prefix"))
+		if prefix == "" && suffix == "" && hexPrefix == "" {
+			return fmt.Errorf("give at least one of --prefix, --suffix or --hex-prefix")
+		}
+
+		bits, err := vanityPatternBits(prefix, suffix, hexPrefix)
+		if err != nil {
+			return err
+		}
+
+		// ask for the password upfront so the user doesn't have to stay around waiting
+		var password string
+		if c.Bool("encrypt") {
+			var err error
+			password, err = askNewPassword()
+			if err != nil {
+				return err
+			}
+		}
+
+		expected := math.Pow(2, float64(bits))
+		workers := runtime.NumCPU()
+		log("searching on %d cores, %.0f attempts expected on average\n", workers, expected)
+
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+
+		match := func(pk nostr.PubKey) bool {
+			if hexPrefix != "" && !strings.HasPrefix(pk.Hex(), hexPrefix) {
+				return false
+			}
+			if prefix != "" || suffix != "" {
+				npub := nip19.EncodeNpub(pk)
+				return strings.HasPrefix(npub[5:], prefix) && strings.HasSuffix(npub, suffix)
+			}
+			return true
+		}
+
+		var progress func(uint64, time.Duration)
+		if term.IsTerminal(int(os.Stderr.Fd())) {
+			progress = func(attempts uint64, elapsed time.Duration) {
+				rate := float64(attempts) / elapsed.Seconds()
+				log("\r\033[2K%d attempts, %.0f keys/s, expected %s\r",
+					attempts, rate, formatPowDuration(expectedDuration(expected, rate)))
+			}
+		}
+
+		start := time.Now()
+		sk, attempts, found := searchVanityKey(ctx, workers, match, progress)
+		if progress != nil {
+			log("\r\033[2K")
+		}
+		if !found {
+			return fmt.Errorf("gave up after %d attempts: %w", attempts, context.Cause(ctx))
+		}
+
+		log("found %s after %d attempts in %s\n",
+			color.CyanString(nip19.EncodeNpub(sk.Public())), attempts, formatPowDuration(time.Since(start)))
+
+		if password != "" {
+			ncryptsec, err := nip49.Encrypt(sk, password, uint8(c.Int("logn")), 0x02)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt: %w", err)
+			}
+			stdout(ncryptsec)
+			return nil
+		}
+
+		stdout(sk.Hex())
+		return nil
+	},
+}
+
+// searchVanityKey walks from a random key on each worker, adding 1 to the secret key (and G to the public key)
+// at each step, which is much cheaper than computing each public key from scratch.
+func searchVanityKey(
+	ctx context.Context,
+	workers int,
+	match func(nostr.PubKey) bool,
+	progress func(attempts uint64, elapsed time.Duration),
+) (nostr.SecretKey, uint64, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var attempts atomic.Uint64
+	found := make(chan nostr.SecretKey, 1)
+
+	var one btcec.ModNScalar
+	one.SetInt(1)
+	var g btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(&one, &g)
+
+	wg := sync.WaitGroup{}
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			start := nostr.Generate()
+			var sk btcec.ModNScalar
+			sk.SetByteSlice(start[:])
+			var p btcec.JacobianPoint
+			btcec.ScalarBaseMultNonConst(&sk, &p)
+
+			for i := 0; ctx.Err() == nil; i++ {
+				affine := p
+				affine.ToAffine()
+				if match(nostr.PubKey(*affine.X.Bytes())) {
+					select {
+					case found <- nostr.SecretKey(sk.Bytes()):
+					default:
+					}
+					cancel()
+					return
+				}
+
+				sk.Add(&one)
+				var next btcec.JacobianPoint
+				btcec.AddNonConst(&p, &g, &next)
+				p = next
+
+				if i%1024 == 1023 {
+					attempts.Add(1024)
+				}
+			}
+		}()
+	}
+
+	if progress != nil {
+		go func() {
+			start := time.Now()
+			ticker := time.NewTicker(time.Millisecond * 500)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					progress(attempts.Load(), time.Since(start))
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	select {
+	case sk := <-found:
+		return sk, attempts.Load(), true
+	default:
+		return nostr.SecretKey{}, attempts.Load(), false
+	}
+}
+
+// expectedDuration is how long it takes on average to make the expected number of attempts at the given rate
+func expectedDuration(expected float64, rate float64) time.Duration {
+	secs := expected / rate
+	if secs >= float64(math.MaxInt64/int64(time.Second)) {
+		return math.MaxInt64
+	}
+	return time.Duration(secs * float64(time.Second))
+}
+
+// askNewPassword asks for a password twice to make sure it was typed correctly
+func askNewPassword() (string, error) {
+	for {
+		password, err := askPassword("type a password to encrypt the key: ", nil)
+		if err != nil {
+			return "", err
+		}
+		if password == "" {
+			log("the password can't be empty.\n")
+			continue
+		}
+		again, err := askPassword("type it again: ", nil)
+		if err != nil {
+			return "", err
+		}
+		if again != password {
+			log("passwords don't match, try again.\n")
+			continue
+		}
+		return password, nil
+	}
+}
+
+// vanityPatternBits validates the patterns and returns how many bits of the npub they fix, so the expected
+// number of attempts is 2^bits. the npub has 52 data characters (256 bits of pubkey plus 4 bits of zero
+// padding, so the 52nd can only be 'q' or 's') followed by 6 characters of checksum.
+func vanityPatternBits(prefix, suffix, hexPrefix string) (int, error) {
+	if len(prefix) > 52 {
+		return 0, fmt.Errorf("--prefix can have at most 52 characters, the rest of the npub is a checksum")
+	}
+	if len(suffix) > 58 {
+		return 0, fmt.Errorf("--suffix can have at most 58 characters")
+	}
+	if len(hexPrefix) > 64 {
+		return 0, fmt.Errorf("--hex-prefix can have at most 64 characters")
+	}
+	if len(prefix)+len(suffix) > 58 {
+		return 0, fmt.Errorf("--prefix and --suffix overlap")
+	}
+
+	// -1 is a bit we don't care about
+	var data [260]int8
+	for i := range data {
+		data[i] = -1
+	}
+	conflict := false
+	set := func(start int, value int, size int) {
+		for b := range size {
+			bit := int8((value >> (size - 1 - b)) & 1)
+			if data[start+b] != -1 && data[start+b] != bit {
+				conflict = true
+			}
+			data[start+b] = bit
+		}
+	}
+
+	checksumChars := 0
+	for i, char := range prefix {
+		value := strings.IndexRune(bech32Charset, char)
+		if value == -1 {
+			return 0, fmt.Errorf("'%c' can't appear in an npub, the valid characters are %s", char, bech32Charset)
+		}
+		set(i*5, value, 5)
+	}
+	for j, char := range suffix {
+		value := strings.IndexRune(bech32Charset, char)
+		if value == -1 {
+			return 0, fmt.Errorf("'%c' can't appear in an npub, the valid characters are %s", char, bech32Charset)
+		}
+		if pos := 58 - len(suffix) + j; pos < 52 {
+			set(pos*5, value, 5)
+		} else {
+			checksumChars++
+		}
+	}
+	for i, char := range hexPrefix {
+		value := strings.IndexRune("0123456789abcdef", char)
+		if value == -1 {
+			return 0, fmt.Errorf("'%c' is not a hex character", char)
+		}
+		set(i*4, value, 4)
+	}
+
+	for _, bit := range data[256:] {
+		if bit == 1 {
+			return 0, fmt.Errorf("the 52nd character of an npub after \"npub1\" (the 7th from the end) can only be 'q' or 's'")
+		}
+	}
+	if conflict {
+		return 0, fmt.Errorf("--prefix, --suffix and --hex-prefix contradict each other")
+	}
+
+	bits := checksumChars * 5
+	for _, bit := range data[0:256] {
+		if bit != -1 {
+			bits++
+		}
+	}
+	return bits, nil
+}
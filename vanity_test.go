@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip19"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVanityPatternBits(t *testing.T) {
+	bits, err := vanityPatternBits("nak", "", "")
+	require.NoError(t, err)
+	require.Equal(t, 15, bits)
+
+	bits, err = vanityPatternBits("", "", "0000")
+	require.NoError(t, err)
+	require.Equal(t, 16, bits)
+
+	// "q" is 00000, so a hex 0 only adds what it doesn't already cover
+	bits, err = vanityPatternBits("q", "", "0")
+	require.NoError(t, err)
+	require.Equal(t, 5, bits)
+
+	// "l" is 11111, which can't start with a hex 0
+	_, err = vanityPatternBits("l", "", "0")
+	require.Error(t, err)
+
+	// characters outside the charsets
+	_, err = vanityPatternBits("b", "", "")
+	require.Error(t, err)
+	_, err = vanityPatternBits("", "1", "")
+	require.Error(t, err)
+	_, err = vanityPatternBits("", "", "g")
+	require.Error(t, err)
+
+	// the 52nd data character only has one bit of the pubkey, followed by 4 bits of padding
+	_, err = vanityPatternBits("", "pqqqqqq", "")
+	require.Error(t, err)
+	bits, err = vanityPatternBits("", "sqqqqqq", "")
+	require.NoError(t, err)
+	require.Equal(t, 31, bits)
+	bits, err = vanityPatternBits("", "qqqqqq", "")
+	require.NoError(t, err)
+	require.Equal(t, 30, bits)
+
+	// too long or overlapping
+	long := "qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqq"
+	_, err = vanityPatternBits(long+"p", "", "")
+	require.Error(t, err)
+	_, err = vanityPatternBits(long+"q"+"q", "", "")
+	require.Error(t, err)
+	_, err = vanityPatternBits(long, "qqqqqqqq", "")
+	require.Error(t, err)
+
+	// patterns taken from real keys are always valid
+	for range 20 {
+		pk := nostr.Generate().Public()
+		npub := nip19.EncodeNpub(pk)
+
+		bits, err := vanityPatternBits(npub[5:5+52], "", "")
+		require.NoError(t, err, npub)
+		require.Equal(t, 256, bits)
+
+		_, err = vanityPatternBits("", npub[len(npub)-7:], "")
+		require.NoError(t, err, npub)
+
+		_, err = vanityPatternBits(npub[5:13], npub[len(npub)-10:], pk.Hex()[0:10])
+		require.NoError(t, err, npub)
+	}
+}